@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hdngo/whisper/internal/config"
+	"github.com/hdngo/whisper/internal/token"
+)
+
+const keysUsage = `usage: whisper keys <command> [flags]
+
+commands:
+  list           show the keys in auth.keys_file
+  generate       add a new signing key and retire the current one
+  retire <kid>   stop signing with a key; it verifies tokens until they expire
+  remove <kid>   delete a key immediately, invalidating tokens it signed`
+
+// runKeysCommand implements `whisper keys <subcommand> [flags]`. Running
+// servers pick up changes to the key file within a minute.
+func runKeysCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, keysUsage)
+		return 2
+	}
+
+	command, args := args[0], args[1:]
+	var kid string
+	if command == "retire" || command == "remove" {
+		if len(args) == 0 {
+			fmt.Fprintln(os.Stderr, keysUsage)
+			return 2
+		}
+		kid, args = args[0], args[1:]
+	}
+
+	cfg, err := config.Load(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if cfg.Auth.KeysFile == "" {
+		fmt.Fprintln(os.Stderr, "auth.keys_file is not set")
+		return 1
+	}
+
+	keys, err := token.LoadKeys(cfg.Auth.KeysFile)
+	if err != nil && !(errors.Is(err, os.ErrNotExist) && command == "generate") {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch command {
+	case "list":
+		printKeys(keys, cfg.Auth)
+		return 0
+
+	case "generate":
+		alg := cfg.Auth.SigningAlgorithm
+		if alg == "HS256" {
+			fmt.Fprintln(os.Stderr, "auth.signing_algorithm must be RS256 or EdDSA to use signing keys")
+			return 1
+		}
+		var key *token.Key
+		keys, key, err = token.Rotate(keys, alg, cfg.Auth.AccessTokenTTL)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Generated %s key %s\n", alg, key.ID)
+
+	case "retire":
+		key, err := token.FindKey(keys, kid)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if !key.Retired() {
+			key.RetiredAt = time.Now()
+		}
+		fmt.Printf("Retired key %s\n", kid)
+
+	case "remove":
+		if _, err := token.FindKey(keys, kid); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		kept := keys[:0]
+		for _, key := range keys {
+			if key.ID != kid {
+				kept = append(kept, key)
+			}
+		}
+		keys = kept
+		fmt.Printf("Removed key %s\n", kid)
+
+	default:
+		fmt.Fprintln(os.Stderr, keysUsage)
+		return 2
+	}
+
+	if err := token.SaveKeys(cfg.Auth.KeysFile, keys); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func printKeys(keys []*token.Key, cfg config.AuthConfig) {
+	signing := token.SigningKey(keys, cfg.SigningAlgorithm)
+	now := time.Now()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KID\tALG\tCREATED\tSTATUS")
+	for _, key := range keys {
+		status := "active"
+		switch {
+		case key == signing:
+			status = "signing"
+		case key.Verifies(now, cfg.AccessTokenTTL) && key.Retired():
+			status = "retired, verifying until " + key.RetiredAt.Add(cfg.AccessTokenTTL).Format(time.RFC3339)
+		case key.Retired():
+			status = "expired"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", key.ID, key.Algorithm, key.CreatedAt.Format(time.RFC3339), status)
+	}
+	tw.Flush()
+}
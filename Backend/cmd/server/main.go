@@ -5,110 +5,244 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/gorilla/mux"
+	"github.com/hdngo/whisper/internal/auth"
 	"github.com/hdngo/whisper/internal/cache"
 	"github.com/hdngo/whisper/internal/config"
+	"github.com/hdngo/whisper/internal/database"
 	"github.com/hdngo/whisper/internal/handler"
+	"github.com/hdngo/whisper/internal/ldapauth"
+	"github.com/hdngo/whisper/internal/logging"
 	"github.com/hdngo/whisper/internal/repository"
+	"github.com/hdngo/whisper/internal/server"
 	"github.com/hdngo/whisper/internal/service"
+	"github.com/hdngo/whisper/internal/token"
+	"github.com/hdngo/whisper/internal/webhook"
 	"github.com/hdngo/whisper/internal/ws"
 	"github.com/hdngo/whisper/pkg/middleware"
-	_ "github.com/lib/pq"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		os.Exit(runKeysCommand(os.Args[2:]))
+	}
+
 	// Load configuration
-	cfg, err := config.Load()
+	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
-		log.Fatal("Failed to load config", err)
+		log.Fatal("Failed to load config: ", err)
+	}
+
+	if err := logging.Init(cfg.Log.Level); err != nil {
+		log.Fatal("Failed to initialize logging: ", err)
 	}
 
 	// Initialize database
-	db, err := initDB(cfg)
+	db, err := database.Open(cfg.Database)
 	if err != nil {
 		log.Fatal("Failed to initialize database", err)
 	}
 	defer db.Close()
 
 	// Run migrations
-	if err := runMigrations(db); err != nil {
+	if err := runMigrations(db.Primary); err != nil {
 		log.Fatal("Failed to run migrations", err)
 	}
 
 	// Initialize Redis
-	redisClient, err := cache.NewRedisClient(cfg.RedisHost, cfg.RedisPort)
+	redisClient, err := cache.NewRedisClient(cfg.Redis, cfg.Auth.RefreshTokenTTL)
 	if err != nil {
 		log.Fatal("Failed to initialize Redis", err)
 	}
 
 	// Initialize repositories
-	userRepo := repository.NewUserRepository(db)
-	msgRepo := repository.NewMessageRepository(db)
+	userRepo := repository.NewUserRepository(db.Primary)
+	msgRepo := repository.NewMessageRepository(db.Primary, db.Replica, cfg.Database.QueryTimeout)
+	auditRepo := repository.NewAuditRepository(db.Primary)
+	passkeyRepo := repository.NewPasskeyRepository(db.Primary)
+	accessTokenRepo := repository.NewAccessTokenRepository(db.Primary)
+	webhookRepo := repository.NewWebhookRepository(db.Primary)
+	incomingWebhookRepo := repository.NewIncomingWebhookRepository(db.Primary)
+	mentionRepo := repository.NewMentionRepository(db.Primary)
+	readMarkerRepo := repository.NewReadMarkerRepository(db.Primary)
+
+	// Initialize token signing
+	tokens, err := token.NewManager(cfg.Auth)
+	if err != nil {
+		log.Fatal("Failed to initialize signing keys: ", err)
+	}
+	go tokens.Run()
+	authenticator := auth.NewAuthenticator(tokens, redisClient, accessTokenRepo)
 
 	// Initialize WebSocket hub
-	hub := ws.NewHub(msgRepo)
+	hub := ws.NewHub(msgRepo, cfg.WebSocket, authenticator.Authenticate, cfg.Auth.ExpiryWarning)
 	go hub.Run()
 
+	// Initialize outgoing webhooks
+	webhooks := webhook.NewDispatcher(webhookRepo, cfg.Webhooks)
+	hub.OnMessage(webhooks.MessageCreated)
+	go webhooks.Run()
+
+	// Record mentions and notify the mentioned users
+	mentions := service.NewMentions(mentionRepo, hub)
+	hub.OnMessage(mentions.MessageCreated)
+
+	// Track how far each user has read
+	readMarkers := service.NewReadMarkers(readMarkerRepo, hub)
+	hub.SetReadMarker(readMarkers.MarkRead)
+
 	// Initialize services
-	authService := service.NewAuthService(userRepo, redisClient, cfg.JWTSecret)
+	loginThrottle := service.NewLoginThrottle(redisClient, auditRepo, cfg.Auth.Lockout)
+	var directory service.CredentialVerifier
+	if cfg.Auth.LDAP.Enabled() {
+		verifier, err := ldapauth.NewVerifier(cfg.Auth.LDAP)
+		if err != nil {
+			log.Fatal("Failed to initialize LDAP: ", err)
+		}
+		directory = verifier
+	}
+	authService, err := service.NewAuthService(userRepo, passkeyRepo, accessTokenRepo, redisClient, tokens, hub, loginThrottle, directory, cfg.Auth)
+	if err != nil {
+		log.Fatal("Failed to initialize auth service: ", err)
+	}
+
+	incomingWebhooks := service.NewIncomingWebhooks(incomingWebhookRepo, userRepo, hub, cfg.Auth)
+
+	// Initialize middleware
+	jwtMiddleware := middleware.NewJWTMiddleware(authenticator)
+	cors := middleware.NewCORS(cfg.Server.AllowedOrigins)
+	adminMiddleware := middleware.NewAdmin(cfg.Auth.AdminUsernames)
 
 	// Initialize handlers
+	reloader := config.NewReloader(cfg, os.Args[1:])
 	authHandler := handler.NewAuthHandler(authService)
-	chatHandler := handler.NewChatHandler(hub, cfg.JWTSecret)
-	messageHandler := handler.NewMessageHandler(msgRepo)
+	chatHandler := handler.NewChatHandler(hub, authenticator, cfg.WebSocket, cors)
+	messageHandler := handler.NewMessageHandler(msgRepo, mentions, readMarkers, hub, cfg.Messages)
+	adminHandler := handler.NewAdminHandler(reloader, loginThrottle, auditRepo, webhookRepo)
+	jwksHandler := handler.NewJWKSHandler(tokens)
+	botHandler := handler.NewBotHandler(authService)
+	incomingWebhookHandler := handler.NewIncomingWebhookHandler(incomingWebhooks)
 
-	// Initialize middleware
-	jwtMiddleware := middleware.NewJWTMiddleware(cfg.JWTSecret, redisClient)
+	// Apply reloadable settings now and on every reload
+	applyConfig := func(cfg *config.Config) {
+		if err := logging.SetLevel(cfg.Log.Level); err != nil {
+			log.Printf("error applying log level: %v", err)
+		}
+		cors.SetAllowedOrigins(cfg.Server.AllowedOrigins)
+		adminMiddleware.SetAdmins(cfg.Auth.AdminUsernames)
+		authHandler.SetRegistrationEnabled(cfg.Features.Registration)
+		messageHandler.SetConfig(cfg.Messages)
+		hub.SetConfig(cfg.WebSocket)
+		hub.SetPresence(cfg.Features.Presence)
+		readMarkers.SetReceipts(cfg.Features.ReadReceipts)
+		hub.SetFilterWords(cfg.Filters.Words)
+		hub.Commands().SetConfig(cfg.Commands)
+		webhooks.SetEndpoints(cfg.Webhooks.Endpoints)
+	}
+	applyConfig(cfg)
+	reloader.OnReload(applyConfig)
+	go reloadOnSignal(reloader)
 
 	// Setup router
 	router := mux.NewRouter()
 
 	// Add CORS middleware to all routes
-	router.Use(middleware.CORSMiddleware)
+	router.Use(cors.Middleware)
 
 	// Public routes
 	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	}).Methods("GET")
+	router.HandleFunc("/.well-known/jwks.json", jwksHandler.GetKeys).Methods("GET")
 	router.HandleFunc("/api/auth/register", authHandler.Register).Methods("POST", "OPTIONS")
 	router.HandleFunc("/api/auth/login", authHandler.Login).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/auth/refresh", authHandler.Refresh).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/auth/2fa/verify", authHandler.VerifyMFA).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/auth/webauthn/login/begin", authHandler.BeginPasskeyLogin).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/auth/webauthn/login/finish", authHandler.FinishPasskeyLogin).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/auth/oidc/begin", authHandler.BeginOIDCLogin).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/auth/oidc/finish", authHandler.FinishOIDCLogin).Methods("POST", "OPTIONS")
 	router.HandleFunc("/api/ws", chatHandler.HandleWebSocket)
+	router.HandleFunc("/api/hooks/{token}", incomingWebhookHandler.Receive).Methods("POST")
 
-	// Protected routes
+	// Protected routes, reachable with a login session or a personal access
+	// token
 	protected := router.PathPrefix("/api").Subrouter()
 	protected.Use(jwtMiddleware.Authenticate)
-	protected.HandleFunc("/auth/logout", authHandler.Logout).Methods("POST", "OPTIONS")
-	protected.HandleFunc("/messages/recent", messageHandler.GetRecent).Methods("GET", "OPTIONS")
-	protected.HandleFunc("/messages/before/{id}", messageHandler.GetMessagesBefore).Methods("GET", "OPTIONS")
 
-	// Start server
-	serverAddr := fmt.Sprintf(":%s", cfg.ServerPort)
-	log.Printf("Server starting on %s", serverAddr)
-	if err := http.ListenAndServe(serverAddr, router); err != nil {
-		log.Fatal("Server failed to start:", err)
-	}
-}
+	// Account management requires a login session
+	account := protected.PathPrefix("/auth").Subrouter()
+	account.Use(middleware.RequireSession)
+	account.HandleFunc("/logout", authHandler.Logout).Methods("POST", "OPTIONS")
+	account.HandleFunc("/sessions", authHandler.ListSessions).Methods("GET", "OPTIONS")
+	account.HandleFunc("/sessions", authHandler.RevokeOtherSessions).Methods("DELETE")
+	account.HandleFunc("/sessions/{id}", authHandler.RevokeSession).Methods("DELETE", "OPTIONS")
+	account.HandleFunc("/2fa/enroll", authHandler.EnrollTOTP).Methods("POST", "OPTIONS")
+	account.HandleFunc("/2fa/confirm", authHandler.ConfirmTOTP).Methods("POST", "OPTIONS")
+	account.HandleFunc("/2fa/disable", authHandler.DisableTOTP).Methods("POST", "OPTIONS")
+	account.HandleFunc("/2fa/recovery-codes", authHandler.RegenerateRecoveryCodes).Methods("POST", "OPTIONS")
+	account.HandleFunc("/webauthn/register/begin", authHandler.BeginPasskeyRegistration).Methods("POST", "OPTIONS")
+	account.HandleFunc("/webauthn/register/finish", authHandler.FinishPasskeyRegistration).Methods("POST", "OPTIONS")
+	account.HandleFunc("/webauthn/credentials", authHandler.ListPasskeys).Methods("GET", "OPTIONS")
+	account.HandleFunc("/webauthn/credentials/{id}", authHandler.DeletePasskey).Methods("DELETE", "OPTIONS")
+	account.HandleFunc("/oidc/link/begin", authHandler.BeginOIDCLink).Methods("POST", "OPTIONS")
+	account.HandleFunc("/oidc/link/finish", authHandler.FinishOIDCLink).Methods("POST", "OPTIONS")
+	account.HandleFunc("/tokens", authHandler.ListAccessTokens).Methods("GET", "OPTIONS")
+	account.HandleFunc("/tokens", authHandler.CreateAccessToken).Methods("POST")
+	account.HandleFunc("/tokens/{id}", authHandler.RevokeAccessToken).Methods("DELETE", "OPTIONS")
 
-func initDB(cfg *config.Config) (*sql.DB, error) {
-	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password='%s' dbname=%s sslmode=disable",
-		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName,
-	)
+	// Bots are managed by their owners' login sessions
+	bots := protected.PathPrefix("/bots").Subrouter()
+	bots.Use(middleware.RequireSession)
+	bots.HandleFunc("", botHandler.ListBots).Methods("GET", "OPTIONS")
+	bots.HandleFunc("", botHandler.CreateBot).Methods("POST")
+	bots.HandleFunc("/{id}/tokens", botHandler.ListTokens).Methods("GET", "OPTIONS")
+	bots.HandleFunc("/{id}/tokens", botHandler.CreateToken).Methods("POST")
+	bots.HandleFunc("/{id}/tokens/{tokenID}", botHandler.RevokeToken).Methods("DELETE", "OPTIONS")
 
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		return nil, err
-	}
+	protected.Handle("/messages", middleware.RequireScope(token.ScopeMessagesWrite)(http.HandlerFunc(messageHandler.PostMessage))).Methods("POST", "OPTIONS")
+	messages := protected.PathPrefix("/messages").Subrouter()
+	messages.Use(middleware.RequireScope(token.ScopeMessagesRead))
+	messages.HandleFunc("", messageHandler.GetHistory).Methods("GET")
+	messages.HandleFunc("/{id:[0-9]+}/context", messageHandler.GetContext).Methods("GET", "OPTIONS")
+	messages.HandleFunc("/search", messageHandler.Search).Methods("GET", "OPTIONS")
+	messages.HandleFunc("/read", messageHandler.GetReadState).Methods("GET", "OPTIONS")
+	messages.HandleFunc("/read", messageHandler.MarkRead).Methods("POST")
 
-	db.SetMaxOpenConns(100)
+	mentionRoutes := protected.PathPrefix("/mentions").Subrouter()
+	mentionRoutes.Use(middleware.RequireScope(token.ScopeMessagesRead))
+	mentionRoutes.HandleFunc("", messageHandler.GetMentions).Methods("GET", "OPTIONS")
+	mentionRoutes.HandleFunc("/read", messageHandler.MarkMentionsRead).Methods("POST", "OPTIONS")
 
-	if err := db.Ping(); err != nil {
-		return nil, err
+	// Admin routes
+	admin := protected.PathPrefix("/admin").Subrouter()
+	if cfg.Server.TLS.AdminRequireClientCert {
+		admin.Use(middleware.RequireClientCert)
 	}
+	admin.Use(middleware.RequireScope(token.ScopeAdmin))
+	admin.Use(adminMiddleware.RequireAdmin)
+	admin.HandleFunc("/config/reload", adminHandler.ReloadConfig).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/users/{username}/unlock", adminHandler.UnlockUser).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/ips/{ip}/unlock", adminHandler.UnlockIP).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/audit", adminHandler.GetAuditLog).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/webhooks/deliveries", adminHandler.GetWebhookDeliveries).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/webhooks/dead-letters", adminHandler.GetDeadLetters).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/webhooks/deliveries/{id}/retry", adminHandler.RetryWebhookDelivery).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/hooks", incomingWebhookHandler.List).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/hooks", incomingWebhookHandler.Create).Methods("POST")
+	admin.HandleFunc("/hooks/{id}/rotate", incomingWebhookHandler.Rotate).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/hooks/{id}", incomingWebhookHandler.Delete).Methods("DELETE", "OPTIONS")
 
-	return db, nil
+	// Start server
+	if err := server.ListenAndServe(cfg.Server, router); err != nil {
+		log.Fatal("Server failed to start:", err)
+	}
 }
 
 func runMigrations(db *sql.DB) error {
@@ -120,6 +254,37 @@ func runMigrations(db *sql.DB) error {
 			created_at BIGINT NOT NULL
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_users_username ON users (username)`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64) NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0`,
+		`CREATE TABLE IF NOT EXISTS recovery_codes (
+			id SERIAL PRIMARY KEY,
+			user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			code_hash VARCHAR(64) NOT NULL,
+			used_at BIGINT
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes (user_id)`,
+		`CREATE TABLE IF NOT EXISTS webauthn_credentials (
+			id SERIAL PRIMARY KEY,
+			user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			credential_id BYTEA UNIQUE NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			data JSONB NOT NULL,
+			created_at BIGINT NOT NULL,
+			last_used_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON webauthn_credentials (user_id)`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name VARCHAR(255) NOT NULL DEFAULT ''`,
+		`CREATE TABLE IF NOT EXISTS user_identities (
+			id SERIAL PRIMARY KEY,
+			user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			issuer VARCHAR(255) NOT NULL,
+			subject VARCHAR(255) NOT NULL,
+			created_at BIGINT NOT NULL,
+			UNIQUE (issuer, subject)
+		)`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS bot_owner_id BIGINT REFERENCES users(id) ON DELETE CASCADE`,
 		`CREATE TABLE IF NOT EXISTS messages (
 			id SERIAL PRIMARY KEY,
 			content TEXT NOT NULL,
@@ -129,6 +294,85 @@ func runMigrations(db *sql.DB) error {
 			FOREIGN KEY (user_id) REFERENCES users(id)
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages (created_at)`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS bot BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS search TSVECTOR GENERATED ALWAYS AS (to_tsvector('english', content)) STORED`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_search ON messages USING GIN (search)`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS display_name VARCHAR(255) NOT NULL DEFAULT ''`,
+		// Message times were Unix seconds; they are now kept to the
+		// microsecond. The check makes the conversion run only once.
+		`DO $$
+		BEGIN
+			IF (SELECT data_type FROM information_schema.columns
+				WHERE table_schema = current_schema() AND table_name = 'messages'
+					AND column_name = 'created_at') = 'bigint' THEN
+				ALTER TABLE messages ALTER COLUMN created_at TYPE TIMESTAMPTZ USING to_timestamp(created_at);
+			END IF;
+		END $$`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id SERIAL PRIMARY KEY,
+			event VARCHAR(64) NOT NULL,
+			username VARCHAR(255) NOT NULL DEFAULT '',
+			ip VARCHAR(64) NOT NULL DEFAULT '',
+			actor VARCHAR(255) NOT NULL DEFAULT '',
+			details TEXT NOT NULL DEFAULT '',
+			created_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_event ON audit_log (event, id)`,
+		`CREATE TABLE IF NOT EXISTS access_tokens (
+			id SERIAL PRIMARY KEY,
+			user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			name VARCHAR(255) NOT NULL,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			scopes TEXT[] NOT NULL,
+			created_at BIGINT NOT NULL,
+			expires_at BIGINT NOT NULL DEFAULT 0,
+			last_used_at BIGINT NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_access_tokens_user_id ON access_tokens (user_id)`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id SERIAL PRIMARY KEY,
+			webhook VARCHAR(255) NOT NULL,
+			event VARCHAR(64) NOT NULL,
+			payload TEXT NOT NULL,
+			status VARCHAR(16) NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			response_status INT NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			created_at BIGINT NOT NULL,
+			next_attempt_at BIGINT NOT NULL,
+			delivered_at BIGINT NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at)`,
+		`CREATE TABLE IF NOT EXISTS incoming_webhooks (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			created_by VARCHAR(255) NOT NULL,
+			created_at BIGINT NOT NULL,
+			last_used_at BIGINT NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS mentions (
+			id SERIAL PRIMARY KEY,
+			message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			kind VARCHAR(16) NOT NULL,
+			created_at BIGINT NOT NULL,
+			read_at BIGINT NOT NULL DEFAULT 0,
+			UNIQUE (message_id, user_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_mentions_user_id ON mentions (user_id, id)`,
+		`CREATE TABLE IF NOT EXISTS read_markers (
+			user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			last_read_message_id BIGINT NOT NULL,
+			updated_at BIGINT NOT NULL
+		)`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS directory BOOLEAN NOT NULL DEFAULT FALSE`,
+		// Accounts without a password that are neither bots nor linked to an
+		// identity provider were created from the directory before the flag.
+		`UPDATE users SET directory = TRUE
+			WHERE NOT directory AND password_hash = '' AND NOT is_bot
+			AND id NOT IN (SELECT user_id FROM user_identities)`,
 	}
 
 	for _, migration := range migrations {
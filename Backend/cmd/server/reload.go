@@ -0,0 +1,23 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hdngo/whisper/internal/config"
+)
+
+// reloadOnSignal re-reads the configuration every time the process receives
+// SIGHUP. Errors are logged by the reloader and the old configuration stays
+// in effect.
+func reloadOnSignal(reloader *config.Reloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		log.Printf("Received SIGHUP, reloading configuration")
+		reloader.Reload()
+	}
+}
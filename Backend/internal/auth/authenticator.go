@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hdngo/whisper/internal/cache"
+	"github.com/hdngo/whisper/internal/repository"
+	"github.com/hdngo/whisper/internal/token"
+)
+
+var (
+	ErrInvalidToken   = errors.New("invalid token")
+	ErrSessionInvalid = errors.New("session expired or invalid")
+)
+
+// touchInterval limits how often a session's or personal access token's
+// last-used time is written.
+const touchInterval = time.Minute
+
+// Authenticator validates access tokens for every entry point: HTTP
+// requests, websocket upgrades and in-band websocket re-authentication.
+type Authenticator struct {
+	tokens       *token.Manager
+	redisClient  *cache.RedisClient
+	accessTokens *repository.AccessTokenRepository
+}
+
+func NewAuthenticator(tokens *token.Manager, redisClient *cache.RedisClient, accessTokens *repository.AccessTokenRepository) *Authenticator {
+	return &Authenticator{
+		tokens:       tokens,
+		redisClient:  redisClient,
+		accessTokens: accessTokens,
+	}
+}
+
+// Authenticate verifies the access token and checks that the session it was
+// issued for is still active, so logged-out and revoked tokens are rejected
+// before they expire. ip is recorded as the session's latest address.
+// Personal access tokens are accepted too, with their scopes in the claims.
+func (a *Authenticator) Authenticate(ctx context.Context, accessToken, ip string) (*token.Claims, error) {
+	if strings.HasPrefix(accessToken, token.PersonalPrefix) {
+		return a.authenticatePersonal(ctx, accessToken)
+	}
+
+	claims, err := a.tokens.Parse(accessToken)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	session, err := a.redisClient.GetSession(ctx, claims.SessionID)
+	if errors.Is(err, cache.ErrSessionNotFound) || (err == nil && session.UserID != claims.UserID) {
+		return nil, ErrSessionInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Since(time.Unix(session.LastUsedAt, 0)) > touchInterval || session.IP != ip {
+		if err := a.redisClient.TouchSession(ctx, session.ID, ip); err != nil {
+			log.Printf("error updating session %s: %v", session.ID, err)
+		}
+	}
+
+	return claims, nil
+}
+
+func (a *Authenticator) authenticatePersonal(ctx context.Context, personalToken string) (*token.Claims, error) {
+	accessToken, err := a.accessTokens.GetByHash(ctx, token.Hash(personalToken))
+	if errors.Is(err, repository.ErrAccessTokenNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &token.Claims{
+		UserID:    accessToken.UserID,
+		Username:  accessToken.Username,
+		SessionID: token.PersonalSessionID(accessToken.ID),
+		Scopes:    accessToken.Scopes,
+		Bot:       accessToken.Bot,
+	}
+	if accessToken.ExpiresAt != 0 {
+		expiresAt := time.Unix(accessToken.ExpiresAt, 0)
+		if time.Now().After(expiresAt) {
+			return nil, ErrInvalidToken
+		}
+		claims.ExpiresAt = jwt.NewNumericDate(expiresAt)
+	}
+
+	if time.Since(time.Unix(accessToken.LastUsedAt, 0)) > touchInterval {
+		if err := a.accessTokens.Touch(ctx, accessToken.ID); err != nil {
+			log.Printf("error updating access token %d: %v", accessToken.ID, err)
+		}
+	}
+
+	return claims, nil
+}
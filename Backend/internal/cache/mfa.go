@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrChallengeNotFound is returned for an unknown or expired MFA challenge.
+var ErrChallengeNotFound = errors.New("challenge not found")
+
+func mfaChallengeKey(tokenHash string) string {
+	return fmt.Sprintf("mfa_challenge:%s", tokenHash)
+}
+
+// CreateMFAChallenge records that userID passed the password check and has
+// ttl to present a second factor with the token hashed as tokenHash.
+func (r *RedisClient) CreateMFAChallenge(ctx context.Context, tokenHash string, userID int64, ttl time.Duration) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, mfaChallengeKey(tokenHash), "user_id", userID, "attempts", 0)
+		pipe.Expire(ctx, mfaChallengeKey(tokenHash), ttl)
+		return nil
+	})
+	return err
+}
+
+// claimScript counts an attempt against a challenge only if it still
+// exists, returning its user ID and the attempts made so far.
+var claimScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return nil
+end
+local attempts = redis.call("HINCRBY", KEYS[1], "attempts", 1)
+return {redis.call("HGET", KEYS[1], "user_id"), attempts}
+`)
+
+// ClaimMFAAttempt counts an attempt to answer a challenge and returns the
+// user it belongs to along with the number of attempts including this one.
+func (r *RedisClient) ClaimMFAAttempt(ctx context.Context, tokenHash string) (int64, int64, error) {
+	result, err := claimScript.Run(ctx, r.client, []string{mfaChallengeKey(tokenHash)}).Slice()
+	if err == redis.Nil {
+		return 0, 0, ErrChallengeNotFound
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	userID, err := strconv.ParseInt(result[0].(string), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("corrupt challenge: %v", err)
+	}
+	return userID, result[1].(int64), nil
+}
+
+func (r *RedisClient) DeleteMFAChallenge(ctx context.Context, tokenHash string) error {
+	return r.client.Del(ctx, mfaChallengeKey(tokenHash)).Err()
+}
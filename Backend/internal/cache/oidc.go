@@ -0,0 +1,29 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func oidcLoginKey(state string) string {
+	return fmt.Sprintf("oidc_login:%s", state)
+}
+
+// SaveOIDCLogin stores what is needed to finish a login through the
+// identity provider until it returns or ttl passes.
+func (r *RedisClient) SaveOIDCLogin(ctx context.Context, state string, data []byte, ttl time.Duration) error {
+	return r.client.Set(ctx, oidcLoginKey(state), data, ttl).Err()
+}
+
+// TakeOIDCLogin returns and deletes a pending login, so each authorization
+// response is accepted only once.
+func (r *RedisClient) TakeOIDCLogin(ctx context.Context, state string) ([]byte, error) {
+	data, err := r.client.GetDel(ctx, oidcLoginKey(state)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrChallengeNotFound
+	}
+	return data, err
+}
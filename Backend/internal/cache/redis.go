@@ -2,20 +2,31 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
+	"github.com/hdngo/whisper/internal/config"
+	"github.com/hdngo/whisper/internal/model"
 	"github.com/redis/go-redis/v9"
 )
 
+var (
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
 type RedisClient struct {
-	client *redis.Client
+	client     *redis.Client
+	sessionTTL time.Duration
 }
 
-func NewRedisClient(host, port string) (*RedisClient, error) {
+func NewRedisClient(cfg config.RedisConfig, sessionTTL time.Duration) (*RedisClient, error) {
 	client := redis.NewClient(&redis.Options{
-		Addr: fmt.Sprintf("%s:%s", host, port),
-		DB:   0,
+		Addr:     fmt.Sprintf("%s:%s", cfg.Host, cfg.Port),
+		Password: cfg.Password,
+		DB:       cfg.DB,
 	})
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -25,20 +36,164 @@ func NewRedisClient(host, port string) (*RedisClient, error) {
 		return nil, fmt.Errorf("redis connection failed: %v", err)
 	}
 
-	return &RedisClient{client: client}, nil
+	return &RedisClient{client: client, sessionTTL: sessionTTL}, nil
+}
+
+func sessionKey(sessionID string) string {
+	return fmt.Sprintf("session:%s", sessionID)
+}
+
+func userSessionsKey(userID int64) string {
+	return fmt.Sprintf("user_sessions:%d", userID)
 }
 
-func (r *RedisClient) StoreSession(ctx context.Context, userID int64, token string) error {
-	key := fmt.Sprintf("session:%d", userID)
-	return r.client.Set(ctx, key, token, 24*time.Hour).Err()
+func refreshKey(refreshHash string) string {
+	return fmt.Sprintf("refresh:%s", refreshHash)
 }
 
-func (r *RedisClient) GetSession(ctx context.Context, userID int64) (string, error) {
-	key := fmt.Sprintf("session:%d", userID)
-	return r.client.Get(ctx, key).Result()
+// CreateSession stores a new session together with its first refresh token.
+func (r *RedisClient) CreateSession(ctx context.Context, session *model.Session) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, sessionKey(session.ID),
+			"user_id", session.UserID,
+			"username", session.Username,
+			"refresh", session.RefreshHash,
+			"user_agent", session.UserAgent,
+			"ip", session.IP,
+			"created_at", session.CreatedAt,
+			"last_used_at", session.LastUsedAt,
+		)
+		pipe.Expire(ctx, sessionKey(session.ID), r.sessionTTL)
+		pipe.SAdd(ctx, userSessionsKey(session.UserID), session.ID)
+		pipe.Expire(ctx, userSessionsKey(session.UserID), r.sessionTTL)
+		pipe.Set(ctx, refreshKey(session.RefreshHash), session.ID, r.sessionTTL)
+		return nil
+	})
+	return err
 }
 
-func (r *RedisClient) DeleteSession(ctx context.Context, userID int64) error {
-	key := fmt.Sprintf("session:%d", userID)
-	return r.client.Del(ctx, key).Err()
+func (r *RedisClient) GetSession(ctx context.Context, sessionID string) (*model.Session, error) {
+	return getSession(ctx, r.client, sessionID)
+}
+
+func getSession(ctx context.Context, c redis.Cmdable, sessionID string) (*model.Session, error) {
+	fields, err := c.HGetAll(ctx, sessionKey(sessionID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrSessionNotFound
+	}
+
+	userID, err := strconv.ParseInt(fields["user_id"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt session %s: %v", sessionID, err)
+	}
+
+	createdAt, _ := strconv.ParseInt(fields["created_at"], 10, 64)
+	lastUsedAt, _ := strconv.ParseInt(fields["last_used_at"], 10, 64)
+
+	return &model.Session{
+		ID:          sessionID,
+		UserID:      userID,
+		Username:    fields["username"],
+		RefreshHash: fields["refresh"],
+		UserAgent:   fields["user_agent"],
+		IP:          fields["ip"],
+		CreatedAt:   createdAt,
+		LastUsedAt:  lastUsedAt,
+	}, nil
+}
+
+// GetUserSessions returns every live session of a user, dropping IDs of
+// sessions that have since expired.
+func (r *RedisClient) GetUserSessions(ctx context.Context, userID int64) ([]model.Session, error) {
+	sessionIDs, err := r.client.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]model.Session, 0, len(sessionIDs))
+	for _, id := range sessionIDs {
+		session, err := r.GetSession(ctx, id)
+		if errors.Is(err, ErrSessionNotFound) {
+			r.client.SRem(ctx, userSessionsKey(userID), id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+
+	return sessions, nil
+}
+
+// touchScript updates a session only if it still exists, so a touch racing
+// with a revocation cannot resurrect a partial session.
+var touchScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("HSET", KEYS[1], "last_used_at", ARGV[1], "ip", ARGV[2])
+end
+return 0
+`)
+
+// TouchSession records that the session was just used from ip.
+func (r *RedisClient) TouchSession(ctx context.Context, sessionID string, ip string) error {
+	return touchScript.Run(ctx, r.client, []string{sessionKey(sessionID)}, time.Now().Unix(), ip).Err()
+}
+
+// RotateRefreshToken exchanges the refresh token hashed as oldHash for
+// newHash and extends the session. Rotated tokens are remembered until they
+// would have expired; presenting one again returns the session it belonged
+// to along with ErrRefreshTokenReused so the caller can revoke it.
+func (r *RedisClient) RotateRefreshToken(ctx context.Context, oldHash, newHash string) (*model.Session, error) {
+	sessionID, err := r.client.Get(ctx, refreshKey(oldHash)).Result()
+	if err == redis.Nil {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session *model.Session
+	err = r.client.Watch(ctx, func(tx *redis.Tx) error {
+		session, err = getSession(ctx, tx, sessionID)
+		if err != nil {
+			return err
+		}
+		if session.RefreshHash != oldHash {
+			return ErrRefreshTokenReused
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, sessionKey(sessionID), "refresh", newHash, "last_used_at", time.Now().Unix())
+			pipe.Expire(ctx, sessionKey(sessionID), r.sessionTTL)
+			pipe.Expire(ctx, userSessionsKey(session.UserID), r.sessionTTL)
+			pipe.Set(ctx, refreshKey(newHash), sessionID, r.sessionTTL)
+			return nil
+		})
+		return err
+	}, sessionKey(sessionID))
+
+	// Losing the race to a concurrent rotation of the same token means it
+	// was presented twice.
+	if errors.Is(err, redis.TxFailedErr) {
+		err = ErrRefreshTokenReused
+	}
+	if err != nil {
+		return session, err
+	}
+
+	session.RefreshHash = newHash
+	return session, nil
+}
+
+func (r *RedisClient) DeleteSession(ctx context.Context, session *model.Session) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(session.ID))
+		pipe.SRem(ctx, userSessionsKey(session.UserID), session.ID)
+		return nil
+	})
+	return err
 }
@@ -0,0 +1,29 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func webAuthnCeremonyKey(ceremonyID string) string {
+	return fmt.Sprintf("webauthn_ceremony:%s", ceremonyID)
+}
+
+// SaveWebAuthnCeremony stores the server side state of a WebAuthn ceremony
+// until it is finished or ttl passes.
+func (r *RedisClient) SaveWebAuthnCeremony(ctx context.Context, ceremonyID string, state []byte, ttl time.Duration) error {
+	return r.client.Set(ctx, webAuthnCeremonyKey(ceremonyID), state, ttl).Err()
+}
+
+// TakeWebAuthnCeremony returns and deletes the state of a ceremony, so each
+// challenge can be answered only once.
+func (r *RedisClient) TakeWebAuthnCeremony(ctx context.Context, ceremonyID string) ([]byte, error) {
+	state, err := r.client.GetDel(ctx, webAuthnCeremonyKey(ceremonyID)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrChallengeNotFound
+	}
+	return state, err
+}
@@ -0,0 +1,258 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const redactedValue = "[redacted]"
+
+// binding ties a single configuration field to its environment variable and
+// command line flag. Secret bindings may also be read from a file named by
+// <ENV>_FILE, and are redacted when the configuration is printed.
+type binding struct {
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	get    func(*Config) string
+	set    func(*Config, string) error
+}
+
+var bindings = []binding{
+	stringBinding("SERVER_PORT", "port", "HTTP listen port", false, func(c *Config) *string { return &c.Server.Port }),
+	stringBinding("SERVER_UNIX_SOCKET", "unix-socket", "also serve plain HTTP on this Unix domain socket", false, func(c *Config) *string { return &c.Server.UnixSocket }),
+	listBinding("CORS_ALLOWED_ORIGINS", "cors-allowed-origins", "comma separated list of allowed origins", func(c *Config) *[]string { return &c.Server.AllowedOrigins }),
+	stringBinding("TLS_CERT_FILE", "tls-cert-file", "TLS certificate file; enables HTTPS together with -tls-key-file", false, func(c *Config) *string { return &c.Server.TLS.CertFile }),
+	stringBinding("TLS_KEY_FILE", "tls-key-file", "TLS private key file", false, func(c *Config) *string { return &c.Server.TLS.KeyFile }),
+	stringBinding("TLS_MIN_VERSION", "tls-min-version", "minimum TLS version: 1.0, 1.1, 1.2 or 1.3", false, func(c *Config) *string { return &c.Server.TLS.MinVersion }),
+	listBinding("TLS_CIPHER_SUITES", "tls-cipher-suites", "comma separated list of allowed TLS 1.2 cipher suites", func(c *Config) *[]string { return &c.Server.TLS.CipherSuites }),
+	stringBinding("TLS_CLIENT_CA_FILE", "tls-client-ca-file", "CA bundle used to verify client certificates", false, func(c *Config) *string { return &c.Server.TLS.ClientCAFile }),
+	boolBinding("TLS_ADMIN_REQUIRE_CLIENT_CERT", "tls-admin-require-client-cert", "require a verified client certificate for admin routes", func(c *Config) *bool { return &c.Server.TLS.AdminRequireClientCert }),
+	durationBinding("TLS_RELOAD_INTERVAL", "tls-reload-interval", "how often to check the certificate files for changes", func(c *Config) *time.Duration { return &c.Server.TLS.ReloadInterval }),
+
+	stringBinding("LOG_LEVEL", "log-level", "log level: debug, info, warn or error", false, func(c *Config) *string { return &c.Log.Level }),
+
+	stringBinding("DATABASE_URL", "db-url", "PostgreSQL connection URL, overrides the individual DB_* settings", true, func(c *Config) *string { return &c.Database.URL }),
+	stringBinding("DB_HOST", "db-host", "PostgreSQL host", false, func(c *Config) *string { return &c.Database.Host }),
+	stringBinding("DB_PORT", "db-port", "PostgreSQL port", false, func(c *Config) *string { return &c.Database.Port }),
+	stringBinding("DB_USER", "db-user", "PostgreSQL user", false, func(c *Config) *string { return &c.Database.User }),
+	stringBinding("DB_PASSWORD", "db-password", "PostgreSQL password", true, func(c *Config) *string { return &c.Database.Password }),
+	stringBinding("DB_NAME", "db-name", "PostgreSQL database name", false, func(c *Config) *string { return &c.Database.Name }),
+	stringBinding("DB_SSLMODE", "db-sslmode", "PostgreSQL sslmode: disable, allow, prefer, require, verify-ca or verify-full", false, func(c *Config) *string { return &c.Database.SSLMode }),
+	stringBinding("DB_SSLROOTCERT", "db-sslrootcert", "CA certificate used to verify the PostgreSQL server", false, func(c *Config) *string { return &c.Database.SSLRootCert }),
+	stringBinding("DB_SSLCERT", "db-sslcert", "client certificate presented to PostgreSQL", false, func(c *Config) *string { return &c.Database.SSLCert }),
+	stringBinding("DB_SSLKEY", "db-sslkey", "private key for the client certificate", false, func(c *Config) *string { return &c.Database.SSLKey }),
+	stringBinding("DB_REPLICA_URL", "db-replica-url", "PostgreSQL read replica connection URL", true, func(c *Config) *string { return &c.Database.ReplicaURL }),
+	intBinding("DB_MAX_OPEN_CONNS", "db-max-open-conns", "maximum open database connections", func(c *Config) *int { return &c.Database.MaxOpenConns }),
+	intBinding("DB_MAX_IDLE_CONNS", "db-max-idle-conns", "maximum idle database connections", func(c *Config) *int { return &c.Database.MaxIdleConns }),
+	durationBinding("DB_CONN_MAX_LIFETIME", "db-conn-max-lifetime", "maximum lifetime of a database connection, 0 for unlimited", func(c *Config) *time.Duration { return &c.Database.ConnMaxLifetime }),
+	durationBinding("DB_CONN_MAX_IDLE_TIME", "db-conn-max-idle-time", "maximum idle time of a database connection, 0 for unlimited", func(c *Config) *time.Duration { return &c.Database.ConnMaxIdleTime }),
+	durationBinding("DB_QUERY_TIMEOUT", "db-query-timeout", "timeout for a single database query", func(c *Config) *time.Duration { return &c.Database.QueryTimeout }),
+
+	stringBinding("REDIS_HOST", "redis-host", "Redis host", false, func(c *Config) *string { return &c.Redis.Host }),
+	stringBinding("REDIS_PORT", "redis-port", "Redis port", false, func(c *Config) *string { return &c.Redis.Port }),
+	stringBinding("REDIS_PASSWORD", "redis-password", "Redis password", true, func(c *Config) *string { return &c.Redis.Password }),
+	intBinding("REDIS_DB", "redis-db", "Redis database number", func(c *Config) *int { return &c.Redis.DB }),
+
+	stringBinding("JWT_SECRET", "jwt-secret", "secret used to sign access tokens", true, func(c *Config) *string { return &c.Auth.JWTSecret }),
+	stringBinding("JWT_SIGNING_ALGORITHM", "jwt-signing-algorithm", "access token signing algorithm: HS256, RS256 or EdDSA", false, func(c *Config) *string { return &c.Auth.SigningAlgorithm }),
+	stringBinding("JWT_KEYS_FILE", "jwt-keys-file", "file holding the RS256/EdDSA signing keys", false, func(c *Config) *string { return &c.Auth.KeysFile }),
+	durationBinding("JWT_KEY_ROTATION_INTERVAL", "jwt-key-rotation-interval", "how often a new RS256/EdDSA signing key is generated (0 disables)", func(c *Config) *time.Duration { return &c.Auth.KeyRotationInterval }),
+	durationBinding("ACCESS_TOKEN_TTL", "access-token-ttl", "lifetime of access tokens", func(c *Config) *time.Duration { return &c.Auth.AccessTokenTTL }),
+	durationBinding("REFRESH_TOKEN_TTL", "refresh-token-ttl", "lifetime of an idle session's refresh token", func(c *Config) *time.Duration { return &c.Auth.RefreshTokenTTL }),
+	durationBinding("TOKEN_EXPIRY_WARNING", "token-expiry-warning", "how long before access token expiry websocket clients are warned", func(c *Config) *time.Duration { return &c.Auth.ExpiryWarning }),
+	durationBinding("PERSONAL_TOKEN_MAX_TTL", "personal-token-max-ttl", "longest lifetime of a personal access token (0 allows tokens that never expire)", func(c *Config) *time.Duration { return &c.Auth.PersonalTokenMaxTTL }),
+	intBinding("MIN_USERNAME_LENGTH", "min-username-length", "minimum username length", func(c *Config) *int { return &c.Auth.MinUsernameLength }),
+	intBinding("MIN_PASSWORD_LENGTH", "min-password-length", "minimum password length", func(c *Config) *int { return &c.Auth.MinPasswordLength }),
+	intBinding("LOGIN_MAX_ATTEMPTS", "login-max-attempts", "failed logins before a username is locked out", func(c *Config) *int { return &c.Auth.Lockout.MaxAttempts }),
+	intBinding("LOGIN_IP_MAX_ATTEMPTS", "login-ip-max-attempts", "failed logins before an IP address is locked out", func(c *Config) *int { return &c.Auth.Lockout.IPMaxAttempts }),
+	durationBinding("LOGIN_FAILURE_WINDOW", "login-failure-window", "how long failed logins are remembered", func(c *Config) *time.Duration { return &c.Auth.Lockout.FailureWindow }),
+	durationBinding("LOGIN_LOCKOUT_DURATION", "login-lockout-duration", "how long a lockout lasts", func(c *Config) *time.Duration { return &c.Auth.Lockout.LockoutDuration }),
+	durationBinding("LOGIN_BACKOFF_BASE", "login-backoff-base", "wait after the second failed login, doubled for each further failure", func(c *Config) *time.Duration { return &c.Auth.Lockout.BackoffBase }),
+	durationBinding("LOGIN_BACKOFF_MAX", "login-backoff-max", "longest wait between failed logins", func(c *Config) *time.Duration { return &c.Auth.Lockout.BackoffMax }),
+	stringBinding("TOTP_ISSUER", "totp-issuer", "issuer name shown in authenticator apps", false, func(c *Config) *string { return &c.Auth.TwoFactor.Issuer }),
+	intBinding("TOTP_SKEW", "totp-skew", "number of 30 second steps a TOTP code may be early or late", func(c *Config) *int { return &c.Auth.TwoFactor.Skew }),
+	durationBinding("MFA_CHALLENGE_TTL", "mfa-challenge-ttl", "time allowed to complete the second login step", func(c *Config) *time.Duration { return &c.Auth.TwoFactor.ChallengeTTL }),
+	intBinding("MFA_MAX_ATTEMPTS", "mfa-max-attempts", "wrong codes allowed per login before it must be restarted", func(c *Config) *int { return &c.Auth.TwoFactor.MaxAttempts }),
+	stringBinding("WEBAUTHN_RP_ID", "webauthn-rp-id", "domain passkeys are registered for", false, func(c *Config) *string { return &c.Auth.WebAuthn.RPID }),
+	stringBinding("WEBAUTHN_RP_DISPLAY_NAME", "webauthn-rp-display-name", "name shown when creating a passkey", false, func(c *Config) *string { return &c.Auth.WebAuthn.RPDisplayName }),
+	listBinding("WEBAUTHN_RP_ORIGINS", "webauthn-rp-origins", "comma separated list of origins allowed to use passkeys", func(c *Config) *[]string { return &c.Auth.WebAuthn.RPOrigins }),
+	durationBinding("WEBAUTHN_TIMEOUT", "webauthn-timeout", "time allowed to complete a passkey prompt", func(c *Config) *time.Duration { return &c.Auth.WebAuthn.Timeout }),
+	stringBinding("OIDC_ISSUER", "oidc-issuer", "OpenID Connect issuer URL, enables single sign-on", false, func(c *Config) *string { return &c.Auth.OIDC.Issuer }),
+	stringBinding("OIDC_CLIENT_ID", "oidc-client-id", "client ID registered with the identity provider", false, func(c *Config) *string { return &c.Auth.OIDC.ClientID }),
+	stringBinding("OIDC_CLIENT_SECRET", "oidc-client-secret", "client secret registered with the identity provider", true, func(c *Config) *string { return &c.Auth.OIDC.ClientSecret }),
+	stringBinding("OIDC_REDIRECT_URL", "oidc-redirect-url", "frontend URL the identity provider redirects back to", false, func(c *Config) *string { return &c.Auth.OIDC.RedirectURL }),
+	listBinding("OIDC_SCOPES", "oidc-scopes", "comma separated list of scopes to request", func(c *Config) *[]string { return &c.Auth.OIDC.Scopes }),
+	stringBinding("OIDC_USERNAME_CLAIM", "oidc-username-claim", "ID token claim used as the username", false, func(c *Config) *string { return &c.Auth.OIDC.UsernameClaim }),
+	stringBinding("OIDC_DISPLAY_NAME_CLAIM", "oidc-display-name-claim", "ID token claim used as the display name", false, func(c *Config) *string { return &c.Auth.OIDC.DisplayNameClaim }),
+	boolBinding("OIDC_ALLOW_SIGNUP", "oidc-allow-signup", "create accounts for new users of the identity provider", func(c *Config) *bool { return &c.Auth.OIDC.AllowSignup }),
+	durationBinding("OIDC_LOGIN_TIMEOUT", "oidc-login-timeout", "time allowed to log in at the identity provider", func(c *Config) *time.Duration { return &c.Auth.OIDC.LoginTimeout }),
+	stringBinding("LDAP_URL", "ldap-url", "ldap:// or ldaps:// URL of a directory to check passwords against", false, func(c *Config) *string { return &c.Auth.LDAP.URL }),
+	boolBinding("LDAP_START_TLS", "ldap-start-tls", "upgrade ldap:// connections with StartTLS", func(c *Config) *bool { return &c.Auth.LDAP.StartTLS }),
+	stringBinding("LDAP_CA_FILE", "ldap-ca-file", "CA certificates to verify the directory with instead of the system ones", false, func(c *Config) *string { return &c.Auth.LDAP.CAFile }),
+	stringBinding("LDAP_BIND_DN", "ldap-bind-dn", "DN of the account used to search for users", false, func(c *Config) *string { return &c.Auth.LDAP.BindDN }),
+	stringBinding("LDAP_BIND_PASSWORD", "ldap-bind-password", "password of the search account", true, func(c *Config) *string { return &c.Auth.LDAP.BindPassword }),
+	stringBinding("LDAP_BASE_DN", "ldap-base-dn", "DN to search for users under", false, func(c *Config) *string { return &c.Auth.LDAP.BaseDN }),
+	stringBinding("LDAP_USER_FILTER", "ldap-user-filter", "filter finding a user, with %s for the username", false, func(c *Config) *string { return &c.Auth.LDAP.UserFilter }),
+	stringBinding("LDAP_GROUP_FILTER", "ldap-group-filter", "filter users must also match to log in", false, func(c *Config) *string { return &c.Auth.LDAP.GroupFilter }),
+	stringBinding("LDAP_USERNAME_ATTRIBUTE", "ldap-username-attribute", "attribute holding the username", false, func(c *Config) *string { return &c.Auth.LDAP.UsernameAttribute }),
+	stringBinding("LDAP_DISPLAY_NAME_ATTRIBUTE", "ldap-display-name-attribute", "attribute holding the display name", false, func(c *Config) *string { return &c.Auth.LDAP.DisplayNameAttribute }),
+	durationBinding("LDAP_TIMEOUT", "ldap-timeout", "timeout for directory requests", func(c *Config) *time.Duration { return &c.Auth.LDAP.Timeout }),
+	listBinding("ADMIN_USERNAMES", "admin-usernames", "comma separated list of users with admin access", func(c *Config) *[]string { return &c.Auth.AdminUsernames }),
+
+	intBinding("WS_READ_BUFFER_SIZE", "ws-read-buffer-size", "websocket read buffer size in bytes", func(c *Config) *int { return &c.WebSocket.ReadBufferSize }),
+	intBinding("WS_WRITE_BUFFER_SIZE", "ws-write-buffer-size", "websocket write buffer size in bytes", func(c *Config) *int { return &c.WebSocket.WriteBufferSize }),
+	intBinding("WS_SEND_BUFFER_SIZE", "ws-send-buffer-size", "outgoing messages queued per client", func(c *Config) *int { return &c.WebSocket.SendBufferSize }),
+	int64Binding("WS_MAX_MESSAGE_SIZE", "ws-max-message-size", "maximum inbound websocket message size in bytes", func(c *Config) *int64 { return &c.WebSocket.MaxMessageSize }),
+	durationBinding("WS_WRITE_WAIT", "ws-write-wait", "time allowed to write a message to a peer", func(c *Config) *time.Duration { return &c.WebSocket.WriteWait }),
+	durationBinding("WS_PONG_WAIT", "ws-pong-wait", "time allowed to read the next pong from a peer", func(c *Config) *time.Duration { return &c.WebSocket.PongWait }),
+	intBinding("WS_RATE_LIMIT", "ws-rate-limit", "chat messages a connection may send per rate window, 0 for no limit", func(c *Config) *int { return &c.WebSocket.RateLimit }),
+	durationBinding("WS_RATE_WINDOW", "ws-rate-window", "window for the websocket message rate limit", func(c *Config) *time.Duration { return &c.WebSocket.RateWindow }),
+
+	intBinding("HISTORY_DEFAULT_LIMIT", "history-default-limit", "messages returned when no limit is given", func(c *Config) *int { return &c.Messages.DefaultHistoryLimit }),
+	intBinding("HISTORY_MAX_LIMIT", "history-max-limit", "largest limit a client may request", func(c *Config) *int { return &c.Messages.MaxHistoryLimit }),
+
+	boolBinding("FEATURE_REGISTRATION", "feature-registration", "allow new users to register", func(c *Config) *bool { return &c.Features.Registration }),
+	boolBinding("FEATURE_PRESENCE", "feature-presence", "broadcast join, leave and online user events", func(c *Config) *bool { return &c.Features.Presence }),
+	boolBinding("FEATURE_READ_RECEIPTS", "feature-read-receipts", "broadcast read events when users read messages", func(c *Config) *bool { return &c.Features.ReadReceipts }),
+
+	listBinding("FILTER_WORDS", "filter-words", "comma separated list of words masked in chat messages", func(c *Config) *[]string { return &c.Filters.Words }),
+
+	intBinding("WEBHOOK_MAX_ATTEMPTS", "webhook-max-attempts", "delivery attempts before a webhook delivery is dead-lettered", func(c *Config) *int { return &c.Webhooks.MaxAttempts }),
+	durationBinding("WEBHOOK_BACKOFF_BASE", "webhook-backoff-base", "wait before the first webhook retry, doubled for each further retry", func(c *Config) *time.Duration { return &c.Webhooks.BackoffBase }),
+	durationBinding("WEBHOOK_BACKOFF_MAX", "webhook-backoff-max", "longest wait between webhook retries", func(c *Config) *time.Duration { return &c.Webhooks.BackoffMax }),
+	durationBinding("WEBHOOK_TIMEOUT", "webhook-timeout", "timeout for a webhook request", func(c *Config) *time.Duration { return &c.Webhooks.Timeout }),
+	durationBinding("WEBHOOK_POLL_INTERVAL", "webhook-poll-interval", "how often the webhook queue is checked for due deliveries", func(c *Config) *time.Duration { return &c.Webhooks.PollInterval }),
+
+	durationBinding("COMMAND_TIMEOUT", "command-timeout", "timeout for a request to an external slash command", func(c *Config) *time.Duration { return &c.Commands.Timeout }),
+}
+
+// loadEnv applies every binding whose environment variable is set. For
+// secrets, <ENV>_FILE takes effect when <ENV> itself is unset.
+func (c *Config) loadEnv(lookup func(string) (string, bool)) error {
+	for _, b := range bindings {
+		value, ok := lookup(b.env)
+		if !ok && b.secret {
+			path, hasFile := lookup(b.env + "_FILE")
+			if hasFile {
+				contents, err := os.ReadFile(path)
+				if err != nil {
+					return fmt.Errorf("error reading %s_FILE: %v", b.env, err)
+				}
+				value, ok = strings.TrimRight(string(contents), "\r\n"), true
+			}
+		}
+		if !ok {
+			continue
+		}
+		if err := b.set(c, value); err != nil {
+			return fmt.Errorf("invalid %s: %v", b.env, err)
+		}
+	}
+	return nil
+}
+
+func stringBinding(env, flag, usage string, secret bool, field func(*Config) *string) binding {
+	return binding{
+		env:    env,
+		flag:   flag,
+		usage:  usage,
+		secret: secret,
+		get:    func(c *Config) string { return *field(c) },
+		set: func(c *Config, v string) error {
+			*field(c) = v
+			return nil
+		},
+	}
+}
+
+func listBinding(env, flag, usage string, field func(*Config) *[]string) binding {
+	return binding{
+		env:   env,
+		flag:  flag,
+		usage: usage,
+		get:   func(c *Config) string { return strings.Join(*field(c), ",") },
+		set: func(c *Config, v string) error {
+			var items []string
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			*field(c) = items
+			return nil
+		},
+	}
+}
+
+func intBinding(env, flag, usage string, field func(*Config) *int) binding {
+	return binding{
+		env:   env,
+		flag:  flag,
+		usage: usage,
+		get:   func(c *Config) string { return strconv.Itoa(*field(c)) },
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%q is not an integer", v)
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+func int64Binding(env, flag, usage string, field func(*Config) *int64) binding {
+	return binding{
+		env:   env,
+		flag:  flag,
+		usage: usage,
+		get:   func(c *Config) string { return strconv.FormatInt(*field(c), 10) },
+		set: func(c *Config, v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%q is not an integer", v)
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+func boolBinding(env, flag, usage string, field func(*Config) *bool) binding {
+	return binding{
+		env:   env,
+		flag:  flag,
+		usage: usage,
+		get:   func(c *Config) string { return strconv.FormatBool(*field(c)) },
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%q is not a boolean", v)
+			}
+			*field(c) = b
+			return nil
+		},
+	}
+}
+
+func durationBinding(env, flag, usage string, field func(*Config) *time.Duration) binding {
+	return binding{
+		env:   env,
+		flag:  flag,
+		usage: usage,
+		get:   func(c *Config) string { return field(c).String() },
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%q is not a duration", v)
+			}
+			*field(c) = d
+			return nil
+		},
+	}
+}
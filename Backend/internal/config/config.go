@@ -1,38 +1,503 @@
 package config
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
+// ConfigFileEnv names the environment variable that points at a YAML config
+// file when -config is not given on the command line.
+const ConfigFileEnv = "WHISPER_CONFIG"
+
+// Config is the complete server configuration. Fields tagged reload:"true"
+// (or inside a section tagged that way) take effect on a live reload; all
+// other fields require a restart.
 type Config struct {
-	DBHost     string
-	DBPort     string
-	DBUser     string
-	DBPassword string
-	DBName     string
-	RedisHost  string
-	RedisPort  string
-	JWTSecret  string
-	ServerPort string
-}
-
-func Load() (*Config, error) {
-	if err := godotenv.Load(); err != nil {
+	Server    ServerConfig    `yaml:"server"`
+	Log       LogConfig       `yaml:"log" reload:"true"`
+	Database  DatabaseConfig  `yaml:"database"`
+	Redis     RedisConfig     `yaml:"redis"`
+	Auth      AuthConfig      `yaml:"auth"`
+	WebSocket WebSocketConfig `yaml:"websocket"`
+	Messages  MessagesConfig  `yaml:"messages" reload:"true"`
+	Features  FeaturesConfig  `yaml:"features" reload:"true"`
+	Filters   FiltersConfig   `yaml:"filters" reload:"true"`
+	Webhooks  WebhooksConfig  `yaml:"webhooks"`
+	Commands  CommandsConfig  `yaml:"commands"`
+}
+
+type ServerConfig struct {
+	Port           string    `yaml:"port"`
+	UnixSocket     string    `yaml:"unix_socket"`
+	AllowedOrigins []string  `yaml:"allowed_origins" reload:"true"`
+	TLS            TLSConfig `yaml:"tls"`
+}
+
+// TLSConfig enables HTTPS (and HTTP/2) on the TCP listener when CertFile and
+// KeyFile are set. The certificate is re-read whenever either file changes.
+type TLSConfig struct {
+	CertFile               string        `yaml:"cert_file"`
+	KeyFile                string        `yaml:"key_file"`
+	MinVersion             string        `yaml:"min_version"`
+	CipherSuites           []string      `yaml:"cipher_suites"`
+	ClientCAFile           string        `yaml:"client_ca_file"`
+	AdminRequireClientCert bool          `yaml:"admin_require_client_cert"`
+	ReloadInterval         time.Duration `yaml:"reload_interval"`
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+type LogConfig struct {
+	Level string `yaml:"level"`
+}
+
+// DatabaseConfig describes the PostgreSQL connection. URL, when set, is a
+// complete connection string and takes precedence over the individual
+// host, port, user, password and name fields. ReplicaURL optionally points
+// at a read replica used for history queries.
+type DatabaseConfig struct {
+	URL             string        `yaml:"url"`
+	Host            string        `yaml:"host"`
+	Port            string        `yaml:"port"`
+	User            string        `yaml:"user"`
+	Password        string        `yaml:"password"`
+	Name            string        `yaml:"name"`
+	SSLMode         string        `yaml:"sslmode"`
+	SSLRootCert     string        `yaml:"sslrootcert"`
+	SSLCert         string        `yaml:"sslcert"`
+	SSLKey          string        `yaml:"sslkey"`
+	ReplicaURL      string        `yaml:"replica_url"`
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+	QueryTimeout    time.Duration `yaml:"query_timeout"`
+}
+
+type RedisConfig struct {
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+type AuthConfig struct {
+	JWTSecret           string          `yaml:"jwt_secret"`
+	SigningAlgorithm    string          `yaml:"signing_algorithm"`
+	KeysFile            string          `yaml:"keys_file"`
+	KeyRotationInterval time.Duration   `yaml:"key_rotation_interval"`
+	AccessTokenTTL      time.Duration   `yaml:"access_token_ttl"`
+	RefreshTokenTTL     time.Duration   `yaml:"refresh_token_ttl"`
+	ExpiryWarning       time.Duration   `yaml:"expiry_warning"`
+	PersonalTokenMaxTTL time.Duration   `yaml:"personal_token_max_ttl"`
+	MinUsernameLength   int             `yaml:"min_username_length"`
+	MinPasswordLength   int             `yaml:"min_password_length"`
+	AdminUsernames      []string        `yaml:"admin_usernames" reload:"true"`
+	Lockout             LockoutConfig   `yaml:"lockout"`
+	TwoFactor           TwoFactorConfig `yaml:"two_factor"`
+	WebAuthn            WebAuthnConfig  `yaml:"webauthn"`
+	OIDC                OIDCConfig      `yaml:"oidc"`
+	LDAP                LDAPConfig      `yaml:"ldap"`
+}
+
+// LockoutConfig throttles failed logins. Each failure for a username (or,
+// beyond MaxAttempts, an IP address) doubles the wait before the next
+// attempt, starting at BackoffBase; reaching the attempt limit locks logins
+// out for LockoutDuration. Failures are forgotten after FailureWindow
+// without one.
+type LockoutConfig struct {
+	MaxAttempts     int           `yaml:"max_attempts"`
+	IPMaxAttempts   int           `yaml:"ip_max_attempts"`
+	FailureWindow   time.Duration `yaml:"failure_window"`
+	LockoutDuration time.Duration `yaml:"lockout_duration"`
+	BackoffBase     time.Duration `yaml:"backoff_base"`
+	BackoffMax      time.Duration `yaml:"backoff_max"`
+}
+
+// TwoFactorConfig controls the second login step for users who enabled it.
+// ChallengeTTL and MaxAttempts bound the pending login a correct password
+// starts; Skew is how many 30 second steps a TOTP code may be off by.
+type TwoFactorConfig struct {
+	Issuer       string        `yaml:"issuer"`
+	ChallengeTTL time.Duration `yaml:"challenge_ttl"`
+	MaxAttempts  int           `yaml:"max_attempts"`
+	Skew         int           `yaml:"skew"`
+}
+
+// WebAuthnConfig identifies this server as a WebAuthn relying party for
+// passkey logins. RPID is the domain passkeys are bound to and RPOrigins
+// the exact origins the frontend is served from.
+type WebAuthnConfig struct {
+	RPID          string        `yaml:"rp_id"`
+	RPDisplayName string        `yaml:"rp_display_name"`
+	RPOrigins     []string      `yaml:"rp_origins"`
+	Timeout       time.Duration `yaml:"timeout"`
+}
+
+// OIDCConfig enables single sign-on with an OpenID Connect provider, found
+// through discovery at Issuer. Users logging in for the first time get an
+// account named after UsernameClaim unless AllowSignup is false.
+// LoginTimeout bounds the round trip through the provider.
+type OIDCConfig struct {
+	Issuer           string        `yaml:"issuer"`
+	ClientID         string        `yaml:"client_id"`
+	ClientSecret     string        `yaml:"client_secret"`
+	RedirectURL      string        `yaml:"redirect_url"`
+	Scopes           []string      `yaml:"scopes"`
+	UsernameClaim    string        `yaml:"username_claim"`
+	DisplayNameClaim string        `yaml:"display_name_claim"`
+	AllowSignup      bool          `yaml:"allow_signup"`
+	LoginTimeout     time.Duration `yaml:"login_timeout"`
+}
+
+// Enabled reports whether an identity provider is configured.
+func (o OIDCConfig) Enabled() bool {
+	return o.Issuer != ""
+}
+
+// LDAPConfig checks passwords against an LDAP directory such as Active
+// Directory before local accounts. The user is found by searching BaseDN
+// with UserFilter, where %s is the escaped username, narrowed by
+// GroupFilter if set, and is then bound as with their password. BindDN
+// and BindPassword are the account used for the search.
+type LDAPConfig struct {
+	URL                  string        `yaml:"url"`
+	StartTLS             bool          `yaml:"start_tls"`
+	CAFile               string        `yaml:"ca_file"`
+	BindDN               string        `yaml:"bind_dn"`
+	BindPassword         string        `yaml:"bind_password"`
+	BaseDN               string        `yaml:"base_dn"`
+	UserFilter           string        `yaml:"user_filter"`
+	GroupFilter          string        `yaml:"group_filter"`
+	UsernameAttribute    string        `yaml:"username_attribute"`
+	DisplayNameAttribute string        `yaml:"display_name_attribute"`
+	Timeout              time.Duration `yaml:"timeout"`
+}
+
+// Enabled reports whether a directory is configured.
+func (l LDAPConfig) Enabled() bool {
+	return l.URL != ""
+}
+
+type WebSocketConfig struct {
+	ReadBufferSize  int           `yaml:"read_buffer_size"`
+	WriteBufferSize int           `yaml:"write_buffer_size"`
+	SendBufferSize  int           `yaml:"send_buffer_size"`
+	MaxMessageSize  int64         `yaml:"max_message_size" reload:"true"`
+	WriteWait       time.Duration `yaml:"write_wait"`
+	PongWait        time.Duration `yaml:"pong_wait"`
+	// A connection may send RateLimit chat messages and commands per
+	// RateWindow; further ones are dropped with a warning. The same limit
+	// applies to each user's REST posts and each incoming webhook. 0
+	// disables the limit.
+	RateLimit  int           `yaml:"rate_limit" reload:"true"`
+	RateWindow time.Duration `yaml:"rate_window" reload:"true"`
+}
+
+// PingPeriod is how often the server pings a client. It must be shorter
+// than PongWait so a healthy peer always answers before the deadline.
+func (c WebSocketConfig) PingPeriod() time.Duration {
+	return (c.PongWait * 9) / 10
+}
+
+type MessagesConfig struct {
+	DefaultHistoryLimit int `yaml:"default_history_limit"`
+	MaxHistoryLimit     int `yaml:"max_history_limit"`
+}
+
+type FeaturesConfig struct {
+	Registration bool `yaml:"registration"`
+	Presence     bool `yaml:"presence"`
+	ReadReceipts bool `yaml:"read_receipts"`
+}
+
+// FiltersConfig lists words that are masked out of chat messages.
+type FiltersConfig struct {
+	Words []string `yaml:"words"`
+}
+
+// WebhooksConfig lists the outgoing webhooks fired on chat messages and how
+// failed deliveries are retried: each retry waits twice as long as the one
+// before, starting at BackoffBase, and a delivery still failing after
+// MaxAttempts is moved to the dead-letter list.
+type WebhooksConfig struct {
+	Endpoints    []WebhookConfig `yaml:"endpoints" reload:"true"`
+	MaxAttempts  int             `yaml:"max_attempts"`
+	BackoffBase  time.Duration   `yaml:"backoff_base"`
+	BackoffMax   time.Duration   `yaml:"backoff_max"`
+	Timeout      time.Duration   `yaml:"timeout"`
+	PollInterval time.Duration   `yaml:"poll_interval"`
+}
+
+// WebhookConfig is one outgoing webhook. Its requests are signed with
+// Secret. When Keywords is set, only messages containing one of them,
+// ignoring case, are sent.
+type WebhookConfig struct {
+	Name     string   `yaml:"name"`
+	URL      string   `yaml:"url"`
+	Secret   string   `yaml:"secret"`
+	Keywords []string `yaml:"keywords"`
+}
+
+// CommandsConfig lists the slash commands handled by external HTTP
+// services, alongside the built-in ones.
+type CommandsConfig struct {
+	Endpoints []CommandConfig `yaml:"endpoints" reload:"true"`
+	Timeout   time.Duration   `yaml:"timeout"`
+}
+
+// CommandConfig is a slash command, typed as /Name, that is POSTed to URL.
+// Requests are signed with Secret like outgoing webhooks. Usage and
+// Description are shown by /help.
+type CommandConfig struct {
+	Name        string `yaml:"name"`
+	URL         string `yaml:"url"`
+	Secret      string `yaml:"secret"`
+	Usage       string `yaml:"usage"`
+	Description string `yaml:"description"`
+}
+
+// Default returns the configuration used when nothing else is specified.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:           "6262",
+			AllowedOrigins: []string{"*"},
+			TLS: TLSConfig{
+				MinVersion:     "1.2",
+				ReloadInterval: time.Minute,
+			},
+		},
+		Log: LogConfig{
+			Level: "info",
+		},
+		Database: DatabaseConfig{
+			Host:            "localhost",
+			Port:            "5432",
+			User:            "postgres",
+			Name:            "whisper",
+			SSLMode:         "disable",
+			MaxOpenConns:    100,
+			MaxIdleConns:    10,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+			QueryTimeout:    5 * time.Second,
+		},
+		Redis: RedisConfig{
+			Host: "localhost",
+			Port: "6379",
+		},
+		Auth: AuthConfig{
+			SigningAlgorithm:    "HS256",
+			KeyRotationInterval: 30 * 24 * time.Hour,
+			AccessTokenTTL:      15 * time.Minute,
+			RefreshTokenTTL:     30 * 24 * time.Hour,
+			ExpiryWarning:       time.Minute,
+			PersonalTokenMaxTTL: 365 * 24 * time.Hour,
+			MinUsernameLength:   4,
+			MinPasswordLength:   6,
+			Lockout: LockoutConfig{
+				MaxAttempts:     5,
+				IPMaxAttempts:   50,
+				FailureWindow:   15 * time.Minute,
+				LockoutDuration: 15 * time.Minute,
+				BackoffBase:     time.Second,
+				BackoffMax:      30 * time.Second,
+			},
+			TwoFactor: TwoFactorConfig{
+				Issuer:       "Whisper",
+				ChallengeTTL: 5 * time.Minute,
+				MaxAttempts:  5,
+				Skew:         1,
+			},
+			WebAuthn: WebAuthnConfig{
+				RPID:          "localhost",
+				RPDisplayName: "Whisper",
+				RPOrigins:     []string{"http://localhost", "http://localhost:4200", "http://localhost:6262"},
+				Timeout:       5 * time.Minute,
+			},
+			OIDC: OIDCConfig{
+				Scopes:           []string{"openid", "profile", "email"},
+				UsernameClaim:    "preferred_username",
+				DisplayNameClaim: "name",
+				AllowSignup:      true,
+				LoginTimeout:     10 * time.Minute,
+			},
+			LDAP: LDAPConfig{
+				UserFilter:           "(&(objectClass=person)(uid=%s))",
+				UsernameAttribute:    "uid",
+				DisplayNameAttribute: "displayName",
+				Timeout:              10 * time.Second,
+			},
+		},
+		WebSocket: WebSocketConfig{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			SendBufferSize:  256,
+			MaxMessageSize:  512,
+			WriteWait:       10 * time.Second,
+			PongWait:        60 * time.Second,
+			RateWindow:      10 * time.Second,
+		},
+		Messages: MessagesConfig{
+			DefaultHistoryLimit: 50,
+			MaxHistoryLimit:     100,
+		},
+		Features: FeaturesConfig{
+			Registration: true,
+			Presence:     true,
+			ReadReceipts: true,
+		},
+		Webhooks: WebhooksConfig{
+			MaxAttempts:  8,
+			BackoffBase:  10 * time.Second,
+			BackoffMax:   time.Hour,
+			Timeout:      10 * time.Second,
+			PollInterval: time.Second,
+		},
+		Commands: CommandsConfig{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// Load builds the effective configuration by layering, in order of
+// increasing precedence: built-in defaults, the YAML file named by -config
+// (or WHISPER_CONFIG), environment variables (including a .env file if one
+// exists) and command line flags. The result is validated before it is
+// returned.
+func Load(args []string) (*Config, error) {
+	dotenv, err := godotenv.Read()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return nil, fmt.Errorf("error loading .env file: %v", err)
 	}
 
-	return &Config{
-		DBHost:     os.Getenv("DB_HOST"),
-		DBPort:     os.Getenv("DB_PORT"),
-		DBUser:     os.Getenv("DB_USER"),
-		DBPassword: os.Getenv("DB_PASSWORD"),
-		DBName:     os.Getenv("DB_NAME"),
-		RedisHost:  os.Getenv("REDIS_HOST"),
-		RedisPort:  os.Getenv("REDIS_PORT"),
-		JWTSecret:  os.Getenv("JWT_SECRET"),
-		ServerPort: os.Getenv("SERVER_PORT"),
-	}, nil
+	fs := flag.NewFlagSet("whisper", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(ConfigFileEnv), "path to a YAML configuration file")
+
+	var overrides []func(*Config) error
+	for _, b := range bindings {
+		b := b
+		fs.Func(b.flag, b.usage, func(value string) error {
+			if err := b.set(Default(), value); err != nil {
+				return err
+			}
+			overrides = append(overrides, func(cfg *Config) error {
+				return b.set(cfg, value)
+			})
+			return nil
+		})
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	// The process environment wins over .env. Reading .env on every call
+	// rather than loading it into the environment lets a reload pick up
+	// edits to the file.
+	lookup := func(key string) (string, bool) {
+		if value, ok := os.LookupEnv(key); ok {
+			return value, true
+		}
+		value, ok := dotenv[key]
+		return value, ok
+	}
+
+	if err := cfg.loadEnv(lookup); err != nil {
+		return nil, err
+	}
+
+	for _, apply := range overrides {
+		if err := apply(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening config file: %v", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// Clone returns a deep copy of the configuration.
+func (c *Config) Clone() *Config {
+	clone := *c
+	clone.Server.AllowedOrigins = append([]string(nil), c.Server.AllowedOrigins...)
+	clone.Server.TLS.CipherSuites = append([]string(nil), c.Server.TLS.CipherSuites...)
+	clone.Auth.AdminUsernames = append([]string(nil), c.Auth.AdminUsernames...)
+	clone.Filters.Words = append([]string(nil), c.Filters.Words...)
+	clone.Webhooks.Endpoints = make([]WebhookConfig, len(c.Webhooks.Endpoints))
+	for i, endpoint := range c.Webhooks.Endpoints {
+		endpoint.Keywords = append([]string(nil), endpoint.Keywords...)
+		clone.Webhooks.Endpoints[i] = endpoint
+	}
+	clone.Commands.Endpoints = append([]CommandConfig(nil), c.Commands.Endpoints...)
+	return &clone
+}
+
+// Redacted returns a copy of the configuration with every secret replaced
+// by a placeholder, suitable for logging or printing.
+func (c *Config) Redacted() *Config {
+	redacted := c.Clone()
+	for _, b := range bindings {
+		if b.secret && b.get(redacted) != "" {
+			b.set(redacted, redactedValue)
+		}
+	}
+	for i := range redacted.Webhooks.Endpoints {
+		if redacted.Webhooks.Endpoints[i].Secret != "" {
+			redacted.Webhooks.Endpoints[i].Secret = redactedValue
+		}
+	}
+	for i := range redacted.Commands.Endpoints {
+		if redacted.Commands.Endpoints[i].Secret != "" {
+			redacted.Commands.Endpoints[i].Secret = redactedValue
+		}
+	}
+	return redacted
+}
+
+// WriteYAML writes the configuration as YAML.
+func (c *Config) WriteYAML(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return err
+	}
+	return encoder.Close()
 }
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Change describes a single configuration value that differs between two
+// configurations. Secret values are redacted.
+type Change struct {
+	Key        string `json:"key"`
+	Old        string `json:"old"`
+	New        string `json:"new"`
+	Reloadable bool   `json:"reloadable"`
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%s: %s -> %s", c.Key, c.Old, c.New)
+	if !c.Reloadable {
+		s += " (requires restart)"
+	}
+	return s
+}
+
+// Reloader owns the live configuration and re-reads it on demand from the
+// same sources, with the same arguments, used at startup.
+type Reloader struct {
+	args      []string
+	mutex     sync.Mutex
+	current   *Config
+	listeners []func(*Config)
+}
+
+func NewReloader(cfg *Config, args []string) *Reloader {
+	return &Reloader{
+		args:    args,
+		current: cfg,
+	}
+}
+
+// Current returns the configuration currently in effect. Callers must not
+// modify it.
+func (r *Reloader) Current() *Config {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.current
+}
+
+// OnReload registers fn to be called with the new configuration after every
+// successful reload.
+func (r *Reloader) OnReload(fn func(*Config)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.listeners = append(r.listeners, fn)
+}
+
+// Reload loads the configuration again and applies every reloadable setting
+// that changed. If the new configuration is invalid it is rejected and the
+// current one stays in effect. Changes to settings that cannot be applied
+// live are reported but ignored until the next restart.
+func (r *Reloader) Reload() ([]Change, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	loaded, err := Load(r.args)
+	if err != nil {
+		log.Printf("config reload rejected: %v", err)
+		return nil, err
+	}
+
+	changes := Diff(r.current, loaded)
+
+	next := r.current.Clone()
+	copyReloadable(reflect.ValueOf(next).Elem(), reflect.ValueOf(loaded).Elem(), false)
+	if err := next.Validate(); err != nil {
+		log.Printf("config reload rejected: %v", err)
+		return nil, err
+	}
+
+	if len(changes) == 0 {
+		log.Printf("config reloaded: no changes")
+		return changes, nil
+	}
+	for _, change := range changes {
+		log.Printf("config reloaded: %s", change)
+	}
+
+	r.current = next
+	for _, fn := range r.listeners {
+		fn(next)
+	}
+
+	return changes, nil
+}
+
+// Diff lists every leaf value that differs between old and new.
+func Diff(old, new *Config) []Change {
+	oldValues := flatten(old.Redacted())
+	newValues := flatten(new.Redacted())
+	oldRaw := flatten(old)
+	newRaw := flatten(new)
+
+	var changes []Change
+	for _, key := range oldRaw.keys {
+		if oldRaw.values[key] == newRaw.values[key] {
+			continue
+		}
+		changes = append(changes, Change{
+			Key:        key,
+			Old:        oldValues.values[key],
+			New:        newValues.values[key],
+			Reloadable: oldRaw.reloadable[key],
+		})
+	}
+	return changes
+}
+
+type flatConfig struct {
+	keys       []string
+	values     map[string]string
+	reloadable map[string]bool
+}
+
+func flatten(cfg *Config) flatConfig {
+	flat := flatConfig{
+		values:     make(map[string]string),
+		reloadable: make(map[string]bool),
+	}
+	flat.walk(reflect.ValueOf(cfg).Elem(), "", false)
+	return flat
+}
+
+func (f *flatConfig) walk(v reflect.Value, prefix string, reloadable bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := yamlName(field)
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		fieldReloadable := reloadable || field.Tag.Get("reload") == "true"
+
+		if field.Type.Kind() == reflect.Struct {
+			f.walk(v.Field(i), key, fieldReloadable)
+			continue
+		}
+
+		f.keys = append(f.keys, key)
+		f.values[key] = fmt.Sprint(v.Field(i).Interface())
+		f.reloadable[key] = fieldReloadable
+	}
+}
+
+// copyReloadable copies every reloadable field from src into dst.
+func copyReloadable(dst, src reflect.Value, reloadable bool) {
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fieldReloadable := reloadable || field.Tag.Get("reload") == "true"
+
+		if field.Type.Kind() == reflect.Struct {
+			copyReloadable(dst.Field(i), src.Field(i), fieldReloadable)
+			continue
+		}
+
+		if fieldReloadable {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+func yamlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Validate reports every problem with the configuration at once so that a
+// misconfigured deployment can be fixed in a single pass.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(validPort(c.Server.Port), "server.port: %q is not a valid port", c.Server.Port)
+	check(len(c.Server.AllowedOrigins) > 0, "server.allowed_origins: at least one origin is required")
+	check((c.Server.TLS.CertFile == "") == (c.Server.TLS.KeyFile == ""), "server.tls.cert_file and server.tls.key_file: must be set together")
+	check(TLSVersions[c.Server.TLS.MinVersion] != 0, "server.tls.min_version: %q must be one of 1.0, 1.1, 1.2, 1.3", c.Server.TLS.MinVersion)
+	for _, name := range c.Server.TLS.CipherSuites {
+		check(CipherSuiteID(name) != 0, "server.tls.cipher_suites: unknown or insecure cipher suite %q", name)
+	}
+	check(!c.Server.TLS.AdminRequireClientCert || (c.Server.TLS.Enabled() && c.Server.TLS.ClientCAFile != ""),
+		"server.tls.admin_require_client_cert: requires cert_file, key_file and client_ca_file")
+	check(c.Server.TLS.ReloadInterval > 0, "server.tls.reload_interval: must be positive")
+
+	check(validLogLevel(c.Log.Level), "log.level: %q must be one of debug, info, warn, error", c.Log.Level)
+
+	if c.Database.URL == "" {
+		check(c.Database.Host != "", "database.host: required")
+		check(validPort(c.Database.Port), "database.port: %q is not a valid port", c.Database.Port)
+		check(c.Database.User != "", "database.user: required")
+		check(c.Database.Name != "", "database.name: required")
+	}
+	check(validSSLMode(c.Database.SSLMode), "database.sslmode: %q must be one of disable, allow, prefer, require, verify-ca, verify-full", c.Database.SSLMode)
+	check((c.Database.SSLCert == "") == (c.Database.SSLKey == ""), "database.sslcert and database.sslkey: must be set together")
+	check(c.Database.MaxOpenConns > 0, "database.max_open_conns: must be positive")
+	check(c.Database.MaxIdleConns >= 0 && c.Database.MaxIdleConns <= c.Database.MaxOpenConns,
+		"database.max_idle_conns: must be between 0 and max_open_conns (%d)", c.Database.MaxOpenConns)
+	check(c.Database.ConnMaxLifetime >= 0, "database.conn_max_lifetime: must not be negative")
+	check(c.Database.ConnMaxIdleTime >= 0, "database.conn_max_idle_time: must not be negative")
+	check(c.Database.QueryTimeout > 0, "database.query_timeout: must be positive")
+
+	check(c.Redis.Host != "", "redis.host: required")
+	check(validPort(c.Redis.Port), "redis.port: %q is not a valid port", c.Redis.Port)
+	check(c.Redis.DB >= 0, "redis.db: must not be negative")
+
+	check(validSigningAlgorithm(c.Auth.SigningAlgorithm), "auth.signing_algorithm: %q must be one of HS256, RS256, EdDSA", c.Auth.SigningAlgorithm)
+	if c.Auth.SigningAlgorithm == "HS256" {
+		check(c.Auth.JWTSecret != "", "auth.jwt_secret: required (set JWT_SECRET or JWT_SECRET_FILE)")
+	} else {
+		check(c.Auth.KeysFile != "", "auth.keys_file: required for %s signing", c.Auth.SigningAlgorithm)
+	}
+	check(c.Auth.KeyRotationInterval == 0 || c.Auth.KeyRotationInterval > c.Auth.AccessTokenTTL,
+		"auth.key_rotation_interval: must be 0 or longer than access_token_ttl")
+	check(c.Auth.AccessTokenTTL > 0, "auth.access_token_ttl: must be positive")
+	check(c.Auth.RefreshTokenTTL > c.Auth.AccessTokenTTL, "auth.refresh_token_ttl: must be longer than access_token_ttl")
+	check(c.Auth.ExpiryWarning > 0 && c.Auth.ExpiryWarning < c.Auth.AccessTokenTTL,
+		"auth.expiry_warning: must be positive and shorter than access_token_ttl")
+	check(c.Auth.PersonalTokenMaxTTL >= 0, "auth.personal_token_max_ttl: must not be negative")
+	check(c.Auth.MinUsernameLength > 0, "auth.min_username_length: must be positive")
+	check(c.Auth.MinPasswordLength > 0, "auth.min_password_length: must be positive")
+	check(c.Auth.Lockout.MaxAttempts > 0, "auth.lockout.max_attempts: must be positive")
+	check(c.Auth.Lockout.IPMaxAttempts >= c.Auth.Lockout.MaxAttempts,
+		"auth.lockout.ip_max_attempts: must be at least max_attempts (%d)", c.Auth.Lockout.MaxAttempts)
+	check(c.Auth.Lockout.FailureWindow > 0, "auth.lockout.failure_window: must be positive")
+	check(c.Auth.Lockout.LockoutDuration > 0, "auth.lockout.lockout_duration: must be positive")
+	check(c.Auth.Lockout.BackoffBase >= 0 && c.Auth.Lockout.BackoffBase <= c.Auth.Lockout.BackoffMax,
+		"auth.lockout.backoff_base: must be between 0 and backoff_max")
+	check(c.Auth.TwoFactor.Issuer != "", "auth.two_factor.issuer: required")
+	check(c.Auth.TwoFactor.ChallengeTTL > 0, "auth.two_factor.challenge_ttl: must be positive")
+	check(c.Auth.TwoFactor.MaxAttempts > 0, "auth.two_factor.max_attempts: must be positive")
+	check(c.Auth.WebAuthn.RPID != "", "auth.webauthn.rp_id: required")
+	check(c.Auth.WebAuthn.RPDisplayName != "", "auth.webauthn.rp_display_name: required")
+	check(len(c.Auth.WebAuthn.RPOrigins) > 0, "auth.webauthn.rp_origins: at least one origin is required")
+	check(c.Auth.WebAuthn.Timeout > 0, "auth.webauthn.timeout: must be positive")
+	check(c.Auth.TwoFactor.Skew >= 0 && c.Auth.TwoFactor.Skew <= 10, "auth.two_factor.skew: must be between 0 and 10")
+	if c.Auth.OIDC.Enabled() {
+		check(c.Auth.OIDC.ClientID != "", "auth.oidc.client_id: required with an issuer")
+		check(c.Auth.OIDC.RedirectURL != "", "auth.oidc.redirect_url: required with an issuer")
+		check(slices.Contains(c.Auth.OIDC.Scopes, "openid"), "auth.oidc.scopes: must include openid")
+		check(c.Auth.OIDC.UsernameClaim != "", "auth.oidc.username_claim: required with an issuer")
+		check(c.Auth.OIDC.LoginTimeout > 0, "auth.oidc.login_timeout: must be positive")
+	}
+	if c.Auth.LDAP.Enabled() {
+		ldaps := strings.HasPrefix(c.Auth.LDAP.URL, "ldaps://")
+		check(ldaps || strings.HasPrefix(c.Auth.LDAP.URL, "ldap://"), "auth.ldap.url: %q must start with ldap:// or ldaps://", c.Auth.LDAP.URL)
+		check(!(ldaps && c.Auth.LDAP.StartTLS), "auth.ldap.start_tls: not used with ldaps://")
+		check((c.Auth.LDAP.BindDN == "") == (c.Auth.LDAP.BindPassword == ""), "auth.ldap.bind_dn and auth.ldap.bind_password: must be set together")
+		check(c.Auth.LDAP.BaseDN != "", "auth.ldap.base_dn: required with a url")
+		check(strings.Count(c.Auth.LDAP.UserFilter, "%s") == 1, "auth.ldap.user_filter: must contain %%s once")
+		check(c.Auth.LDAP.UsernameAttribute != "", "auth.ldap.username_attribute: required with a url")
+		check(c.Auth.LDAP.Timeout > 0, "auth.ldap.timeout: must be positive")
+	}
+
+	check(c.WebSocket.ReadBufferSize > 0, "websocket.read_buffer_size: must be positive")
+	check(c.WebSocket.WriteBufferSize > 0, "websocket.write_buffer_size: must be positive")
+	check(c.WebSocket.SendBufferSize > 0, "websocket.send_buffer_size: must be positive")
+	check(c.WebSocket.MaxMessageSize > 0, "websocket.max_message_size: must be positive")
+	check(c.WebSocket.WriteWait > 0, "websocket.write_wait: must be positive")
+	check(c.WebSocket.PongWait > 0, "websocket.pong_wait: must be positive")
+	check(c.WebSocket.RateLimit >= 0, "websocket.rate_limit: must not be negative")
+	check(c.WebSocket.RateLimit == 0 || c.WebSocket.RateWindow > 0, "websocket.rate_window: must be positive when rate_limit is set")
+
+	check(c.Messages.MaxHistoryLimit > 0, "messages.max_history_limit: must be positive")
+	check(c.Messages.DefaultHistoryLimit > 0 && c.Messages.DefaultHistoryLimit <= c.Messages.MaxHistoryLimit,
+		"messages.default_history_limit: must be between 1 and max_history_limit (%d)", c.Messages.MaxHistoryLimit)
+
+	names := make(map[string]bool, len(c.Webhooks.Endpoints))
+	for i, endpoint := range c.Webhooks.Endpoints {
+		check(endpoint.Name != "" && !names[endpoint.Name], "webhooks.endpoints[%d].name: must be set and unique", i)
+		names[endpoint.Name] = true
+		endpointURL, err := url.Parse(endpoint.URL)
+		check(err == nil && (endpointURL.Scheme == "http" || endpointURL.Scheme == "https") && endpointURL.Host != "",
+			"webhooks.endpoints[%d].url: %q must be an http or https URL", i, endpoint.URL)
+		check(endpoint.Secret != "", "webhooks.endpoints[%d].secret: required", i)
+	}
+	check(c.Webhooks.MaxAttempts > 0, "webhooks.max_attempts: must be positive")
+	check(c.Webhooks.BackoffBase > 0 && c.Webhooks.BackoffBase <= c.Webhooks.BackoffMax,
+		"webhooks.backoff_base: must be positive and at most backoff_max")
+	check(c.Webhooks.Timeout > 0, "webhooks.timeout: must be positive")
+	check(c.Webhooks.PollInterval > 0, "webhooks.poll_interval: must be positive")
+
+	commands := make(map[string]bool, len(c.Commands.Endpoints))
+	for i, command := range c.Commands.Endpoints {
+		check(commandName.MatchString(command.Name) && !commands[command.Name],
+			"commands.endpoints[%d].name: %q must be unique, start with a lowercase letter and only contain lowercase letters, digits, - and _", i, command.Name)
+		commands[command.Name] = true
+		commandURL, err := url.Parse(command.URL)
+		check(err == nil && (commandURL.Scheme == "http" || commandURL.Scheme == "https") && commandURL.Host != "",
+			"commands.endpoints[%d].url: %q must be an http or https URL", i, command.URL)
+		check(command.Secret != "", "commands.endpoints[%d].secret: required", i)
+	}
+	check(c.Commands.Timeout > 0, "commands.timeout: must be positive")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// commandName matches the names slash commands may have.
+var commandName = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// TLSVersions maps the accepted server.tls.min_version values to their
+// crypto/tls constants.
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// CipherSuiteID returns the ID of the named secure cipher suite, or 0 if the
+// name is unknown or only in tls.InsecureCipherSuites.
+func CipherSuiteID(name string) uint16 {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID
+		}
+	}
+	return 0
+}
+
+func validLogLevel(level string) bool {
+	switch level {
+	case "debug", "info", "warn", "error":
+		return true
+	}
+	return false
+}
+
+func validSigningAlgorithm(alg string) bool {
+	switch alg {
+	case "HS256", "RS256", "EdDSA":
+		return true
+	}
+	return false
+}
+
+func validSSLMode(mode string) bool {
+	switch mode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		return true
+	}
+	return false
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
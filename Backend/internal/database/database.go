@@ -0,0 +1,139 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/hdngo/whisper/internal/config"
+	_ "github.com/lib/pq"
+)
+
+// DB holds the primary connection pool and, if configured, a read replica
+// pool. Replica is nil when no replica is configured.
+type DB struct {
+	Primary *sql.DB
+	Replica *sql.DB
+}
+
+// Open connects to the primary database and the optional read replica. The
+// primary must be reachable; an unreachable replica is logged and kept, since
+// reads fall back to the primary until it recovers.
+func Open(cfg config.DatabaseConfig) (*DB, error) {
+	dsn, err := PrimaryDSN(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	primary, err := openPool(dsn, cfg)
+	if err != nil {
+		if primary != nil {
+			primary.Close()
+		}
+		return nil, fmt.Errorf("primary database: %v", err)
+	}
+
+	db := &DB{Primary: primary}
+
+	if cfg.ReplicaURL != "" {
+		replicaDSN, err := withTLSParams(cfg.ReplicaURL, cfg)
+		if err != nil {
+			primary.Close()
+			return nil, fmt.Errorf("replica database: %v", err)
+		}
+
+		replica, err := openPool(replicaDSN, cfg)
+		if err != nil {
+			log.Printf("replica database unavailable, reads will use the primary: %v", err)
+		}
+		db.Replica = replica
+	}
+
+	return db, nil
+}
+
+func (db *DB) Close() error {
+	if db.Replica != nil {
+		db.Replica.Close()
+	}
+	return db.Primary.Close()
+}
+
+func openPool(dsn string, cfg config.DatabaseConfig) (*sql.DB, error) {
+	pool, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	pool.SetMaxOpenConns(cfg.MaxOpenConns)
+	pool.SetMaxIdleConns(cfg.MaxIdleConns)
+	pool.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	pool.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.QueryTimeout)
+	defer cancel()
+
+	// The pool is returned even if the ping fails so that callers may keep
+	// it around and let database/sql reconnect later.
+	return pool, pool.PingContext(ctx)
+}
+
+// PrimaryDSN returns the connection string for the primary database, built
+// from the URL if one is configured and from the individual fields
+// otherwise.
+func PrimaryDSN(cfg config.DatabaseConfig) (string, error) {
+	if cfg.URL != "" {
+		return withTLSParams(cfg.URL, cfg)
+	}
+
+	u := &url.URL{
+		Scheme: "postgres",
+		Host:   net.JoinHostPort(cfg.Host, cfg.Port),
+		Path:   "/" + cfg.Name,
+	}
+	if cfg.Password != "" {
+		u.User = url.UserPassword(cfg.User, cfg.Password)
+	} else {
+		u.User = url.User(cfg.User)
+	}
+
+	return withTLSParams(u.String(), cfg)
+}
+
+// withTLSParams adds the configured TLS settings to dsn unless the
+// connection string already specifies them. Both URL and key=value
+// connection strings are supported.
+func withTLSParams(dsn string, cfg config.DatabaseConfig) (string, error) {
+	params := []struct{ key, value string }{
+		{"sslmode", cfg.SSLMode},
+		{"sslrootcert", cfg.SSLRootCert},
+		{"sslcert", cfg.SSLCert},
+		{"sslkey", cfg.SSLKey},
+	}
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", fmt.Errorf("invalid database URL: %v", err)
+		}
+		query := u.Query()
+		for _, p := range params {
+			if p.value != "" && !query.Has(p.key) {
+				query.Set(p.key, p.value)
+			}
+		}
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	for _, p := range params {
+		if p.value != "" && !strings.Contains(dsn, p.key+"=") {
+			dsn += fmt.Sprintf(" %s='%s'", p.key, strings.ReplaceAll(p.value, `'`, `\'`))
+		}
+	}
+	return dsn, nil
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/hdngo/whisper/internal/config"
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/repository"
+	"github.com/hdngo/whisper/internal/service"
+	"github.com/hdngo/whisper/pkg/middleware"
+)
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 500
+)
+
+type AdminHandler struct {
+	reloader    *config.Reloader
+	throttle    *service.LoginThrottle
+	auditRepo   *repository.AuditRepository
+	webhookRepo *repository.WebhookRepository
+}
+
+func NewAdminHandler(reloader *config.Reloader, throttle *service.LoginThrottle, auditRepo *repository.AuditRepository, webhookRepo *repository.WebhookRepository) *AdminHandler {
+	return &AdminHandler{
+		reloader:    reloader,
+		throttle:    throttle,
+		auditRepo:   auditRepo,
+		webhookRepo: webhookRepo,
+	}
+}
+
+func (h *AdminHandler) ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	changes, err := h.reloader.Reload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if changes == nil {
+		changes = []config.Change{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"changes": changes,
+	})
+}
+
+// UnlockUser lifts a login lockout of the username in the path.
+func (h *AdminHandler) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	admin, _ := r.Context().Value(middleware.UsernameKey).(string)
+
+	unlocked, err := h.throttle.UnlockUser(r.Context(), mux.Vars(r)["username"], admin)
+	h.writeUnlock(w, unlocked, err)
+}
+
+// UnlockIP lifts a login lockout of the IP address in the path.
+func (h *AdminHandler) UnlockIP(w http.ResponseWriter, r *http.Request) {
+	admin, _ := r.Context().Value(middleware.UsernameKey).(string)
+
+	unlocked, err := h.throttle.UnlockIP(r.Context(), mux.Vars(r)["ip"], admin)
+	h.writeUnlock(w, unlocked, err)
+}
+
+func (h *AdminHandler) writeUnlock(w http.ResponseWriter, unlocked bool, err error) {
+	if err != nil {
+		http.Error(w, "failed to unlock", http.StatusInternalServerError)
+		return
+	}
+	if !unlocked {
+		http.Error(w, "not locked", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetAuditLog returns recent audit events, optionally filtered by the
+// event query parameter.
+func (h *AdminHandler) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	events, err := h.auditRepo.GetRecent(r.Context(), r.URL.Query().Get("event"), auditLimit(r))
+	if err != nil {
+		http.Error(w, "failed to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// GetWebhookDeliveries returns the delivery log of outgoing webhooks,
+// optionally filtered by the status and webhook query parameters.
+func (h *AdminHandler) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	h.writeDeliveries(w, r, r.URL.Query().Get("status"))
+}
+
+// GetDeadLetters returns the webhook deliveries that failed every attempt.
+func (h *AdminHandler) GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	h.writeDeliveries(w, r, model.DeliveryDead)
+}
+
+func (h *AdminHandler) writeDeliveries(w http.ResponseWriter, r *http.Request, status string) {
+	deliveries, err := h.webhookRepo.GetRecent(r.Context(), status, r.URL.Query().Get("webhook"), auditLimit(r))
+	if err != nil {
+		http.Error(w, "failed to fetch webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// RetryWebhookDelivery moves a dead-lettered delivery back into the queue.
+func (h *AdminHandler) RetryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid delivery id", http.StatusBadRequest)
+		return
+	}
+
+	err = h.webhookRepo.Requeue(r.Context(), id)
+	if errors.Is(err, repository.ErrDeliveryNotFound) {
+		http.Error(w, "dead-lettered delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to retry delivery", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditLimit returns the limit query parameter of a log listing.
+func auditLimit(r *http.Request) int {
+	if parsed, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && parsed > 0 && parsed <= maxAuditLimit {
+		return parsed
+	}
+	return defaultAuditLimit
+}
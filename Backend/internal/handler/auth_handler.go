@@ -2,29 +2,48 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 
+	"github.com/gorilla/mux"
 	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/repository"
 	"github.com/hdngo/whisper/internal/service"
 	"github.com/hdngo/whisper/pkg/middleware"
 )
 
 type AuthHandler struct {
-	authService *service.AuthService
+	authService         *service.AuthService
+	registrationEnabled atomic.Bool
 }
 
 func NewAuthHandler(authService *service.AuthService) *AuthHandler {
-	return &AuthHandler{authService: authService}
+	h := &AuthHandler{authService: authService}
+	h.registrationEnabled.Store(true)
+	return h
+}
+
+// SetRegistrationEnabled toggles whether new accounts may be created.
+func (h *AuthHandler) SetRegistrationEnabled(enabled bool) {
+	h.registrationEnabled.Store(enabled)
 }
 
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
+	if !h.registrationEnabled.Load() {
+		http.Error(w, "registration is disabled", http.StatusForbidden)
+		return
+	}
+
 	var req model.RegisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	resp, err := h.authService.Register(r.Context(), &req)
+	resp, err := h.authService.Register(r.Context(), &req, deviceInfo(r))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
@@ -41,7 +60,12 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := h.authService.Login(r.Context(), &req)
+	resp, err := h.authService.Login(r.Context(), &req, deviceInfo(r))
+	var throttled *service.LoginThrottledError
+	if errors.As(err, &throttled) {
+		writeAuthError(w, err)
+		return
+	}
 	if err != nil {
 		http.Error(w, "invalid credentials", http.StatusUnauthorized)
 		return
@@ -51,17 +75,477 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	var req model.RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.authService.Refresh(r.Context(), req.RefreshToken)
+	if errors.Is(err, service.ErrInvalidRefreshToken) {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
 func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
-	userID, ok := r.Context().Value(middleware.UserIDKey).(float64)
+	userID, sessionID, ok := sessionFromContext(r)
 	if !ok {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	if err := h.authService.Logout(r.Context(), int64(userID)); err != nil {
+	if err := h.authService.Logout(r.Context(), userID, sessionID); err != nil && !errors.Is(err, service.ErrSessionNotFound) {
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
+
+func (h *AuthHandler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	userID, sessionID, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sessions, err := h.authService.ListSessions(r.Context(), userID, sessionID)
+	if err != nil {
+		http.Error(w, "failed to fetch sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func (h *AuthHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err := h.authService.RevokeSession(r.Context(), userID, mux.Vars(r)["id"])
+	if errors.Is(err, service.ErrSessionNotFound) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeOtherSessions logs out every device except the one making the
+// request.
+func (h *AuthHandler) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID, sessionID, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	revoked, err := h.authService.RevokeOtherSessions(r.Context(), userID, sessionID)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"revoked": revoked})
+}
+
+func (h *AuthHandler) VerifyMFA(w http.ResponseWriter, r *http.Request) {
+	var req model.MFAVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.authService.VerifyMFA(r.Context(), &req, deviceInfo(r))
+	if writeAuthError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *AuthHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	enrollment, err := h.authService.EnrollTOTP(r.Context(), userID)
+	if writeAuthError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+func (h *AuthHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, req, ok := h.codeRequest(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := h.authService.ConfirmTOTP(r.Context(), userID, req.Code)
+	if writeAuthError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(model.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+func (h *AuthHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, req, ok := h.codeRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.authService.DisableTOTP(r.Context(), userID, req.Code, middleware.ClientIP(r))
+	if writeAuthError(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AuthHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID, req, ok := h.codeRequest(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := h.authService.RegenerateRecoveryCodes(r.Context(), userID, req.Code, middleware.ClientIP(r))
+	if writeAuthError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(model.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// codeRequest reads the authenticated user and the code they submitted,
+// writing an error response if either is missing.
+func (h *AuthHandler) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ceremony, err := h.authService.BeginPasskeyRegistration(r.Context(), userID)
+	if writeAuthError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ceremony)
+}
+
+func (h *AuthHandler) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req model.WebAuthnFinishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CeremonyID == "" {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	passkey, err := h.authService.FinishPasskeyRegistration(r.Context(), userID, &req)
+	if writeAuthError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(passkey)
+}
+
+func (h *AuthHandler) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	ceremony, err := h.authService.BeginPasskeyLogin(r.Context())
+	if writeAuthError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ceremony)
+}
+
+func (h *AuthHandler) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var req model.WebAuthnFinishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CeremonyID == "" {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.authService.FinishPasskeyLogin(r.Context(), &req, deviceInfo(r))
+	if writeAuthError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *AuthHandler) ListPasskeys(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	passkeys, err := h.authService.ListPasskeys(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(passkeys)
+}
+
+func (h *AuthHandler) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	passkeyID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid passkey id", http.StatusBadRequest)
+		return
+	}
+
+	err = h.authService.DeletePasskey(r.Context(), userID, passkeyID)
+	if errors.Is(err, repository.ErrPasskeyNotFound) {
+		http.Error(w, "passkey not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AuthHandler) BeginOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	authorization, err := h.authService.BeginOIDCLogin(r.Context())
+	if writeAuthError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(authorization)
+}
+
+func (h *AuthHandler) FinishOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	var req model.OIDCCallbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" || req.State == "" {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.authService.FinishOIDCLogin(r.Context(), &req, deviceInfo(r))
+	if writeAuthError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *AuthHandler) BeginOIDCLink(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	authorization, err := h.authService.BeginOIDCLink(r.Context(), userID)
+	if writeAuthError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(authorization)
+}
+
+func (h *AuthHandler) FinishOIDCLink(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req model.OIDCCallbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" || req.State == "" {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if writeAuthError(w, h.authService.FinishOIDCLink(r.Context(), userID, &req)) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AuthHandler) ListAccessTokens(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	accessTokens, err := h.authService.ListAccessTokens(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accessTokens)
+}
+
+func (h *AuthHandler) CreateAccessToken(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req model.CreateAccessTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.authService.CreateAccessToken(r.Context(), userID, &req)
+	var invalid *service.AccessTokenRequestError
+	if errors.As(err, &invalid) {
+		http.Error(w, invalid.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *AuthHandler) RevokeAccessToken(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tokenID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid token id", http.StatusBadRequest)
+		return
+	}
+
+	err = h.authService.RevokeAccessToken(r.Context(), userID, tokenID)
+	if errors.Is(err, service.ErrAccessTokenNotFound) {
+		http.Error(w, "access token not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AuthHandler) codeRequest(w http.ResponseWriter, r *http.Request) (int64, *model.TOTPCodeRequest, bool) {
+	userID, _, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return 0, nil, false
+	}
+
+	var req model.TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return 0, nil, false
+	}
+
+	return userID, &req, true
+}
+
+// writeAuthError writes the response for an error from a login or
+// two-factor operation and reports whether there was one.
+func writeAuthError(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var throttled *service.LoginThrottledError
+	var accountExists *service.OIDCAccountExistsError
+	switch {
+	case errors.As(err, &throttled):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+		http.Error(w, throttled.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, service.ErrInvalidMFAToken), errors.Is(err, service.ErrInvalidCode),
+		errors.Is(err, service.ErrInvalidCeremony), errors.Is(err, service.ErrPasskeyRejected),
+		errors.Is(err, service.ErrInvalidOIDCLogin):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, service.ErrOIDCDisabled):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, service.ErrOIDCSignupDisabled):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.As(err, &accountExists), errors.Is(err, service.ErrOIDCIdentityLinked):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, service.ErrTOTPAlreadyEnabled), errors.Is(err, service.ErrTOTPNotEnabled), errors.Is(err, service.ErrTOTPNotEnrolled):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+	return true
+}
+
+func sessionFromContext(r *http.Request) (int64, string, bool) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		return 0, "", false
+	}
+	sessionID, ok := r.Context().Value(middleware.SessionIDKey).(string)
+	return userID, sessionID, ok
+}
+
+func deviceInfo(r *http.Request) model.DeviceInfo {
+	return model.DeviceInfo{
+		UserAgent: r.UserAgent(),
+		IP:        middleware.ClientIP(r),
+	}
+}
@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/repository"
+	"github.com/hdngo/whisper/internal/service"
+)
+
+// BotHandler lets users create bots and manage their tokens.
+type BotHandler struct {
+	authService *service.AuthService
+}
+
+func NewBotHandler(authService *service.AuthService) *BotHandler {
+	return &BotHandler{authService: authService}
+}
+
+func (h *BotHandler) ListBots(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	bots, err := h.authService.ListBots(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bots)
+}
+
+func (h *BotHandler) CreateBot(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req model.CreateBotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	bot, err := h.authService.CreateBot(r.Context(), userID, &req)
+	var invalid *service.BotRequestError
+	switch {
+	case errors.As(err, &invalid):
+		http.Error(w, invalid.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, service.ErrBotUsernameTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(bot)
+}
+
+func (h *BotHandler) ListTokens(w http.ResponseWriter, r *http.Request) {
+	userID, botID, ok := botFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	accessTokens, err := h.authService.ListBotTokens(r.Context(), userID, botID)
+	if writeBotError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accessTokens)
+}
+
+func (h *BotHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	userID, botID, ok := botFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req model.CreateAccessTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.authService.CreateBotToken(r.Context(), userID, botID, &req)
+	if writeBotError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *BotHandler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	userID, botID, ok := botFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	tokenID, err := strconv.ParseInt(mux.Vars(r)["tokenID"], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid token id", http.StatusBadRequest)
+		return
+	}
+
+	err = h.authService.RevokeBotToken(r.Context(), userID, botID, tokenID)
+	if writeBotError(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func botFromRequest(w http.ResponseWriter, r *http.Request) (int64, int64, bool) {
+	userID, _, ok := sessionFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return 0, 0, false
+	}
+
+	botID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid bot id", http.StatusBadRequest)
+		return 0, 0, false
+	}
+
+	return userID, botID, true
+}
+
+// writeBotError writes the response for an error from a bot token
+// operation and reports whether there was one.
+func writeBotError(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var invalid *service.AccessTokenRequestError
+	switch {
+	case errors.As(err, &invalid):
+		http.Error(w, invalid.Error(), http.StatusBadRequest)
+	case errors.Is(err, repository.ErrBotNotFound):
+		http.Error(w, "bot not found", http.StatusNotFound)
+	case errors.Is(err, service.ErrAccessTokenNotFound):
+		http.Error(w, "access token not found", http.StatusNotFound)
+	default:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+	return true
+}
@@ -1,32 +1,34 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
+	"github.com/hdngo/whisper/internal/auth"
+	"github.com/hdngo/whisper/internal/config"
+	"github.com/hdngo/whisper/internal/token"
 	"github.com/hdngo/whisper/internal/ws"
+	"github.com/hdngo/whisper/pkg/middleware"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // NOTE: Allow all connections by default, change in production
-	},
-	Subprotocols: []string{"access_token"},
-}
-
 type ChatHandler struct {
-	hub       *ws.Hub
-	jwtSecret string
+	hub           *ws.Hub
+	authenticator *auth.Authenticator
+	upgrader      websocket.Upgrader
 }
 
-func NewChatHandler(hub *ws.Hub, jwtSecret string) *ChatHandler {
+func NewChatHandler(hub *ws.Hub, authenticator *auth.Authenticator, cfg config.WebSocketConfig, cors *middleware.CORS) *ChatHandler {
 	return &ChatHandler{
-		hub:       hub,
-		jwtSecret: jwtSecret,
+		hub:           hub,
+		authenticator: authenticator,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  cfg.ReadBufferSize,
+			WriteBufferSize: cfg.WriteBufferSize,
+			CheckOrigin:     cors.CheckOrigin,
+			Subprotocols:    []string{"access_token"},
+		},
 	}
 }
 
@@ -45,29 +47,29 @@ func (h *ChatHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token := protocolParts[1]
-
-	// Parse and validate the token
-	claims := jwt.MapClaims{}
-	parsedToken, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(h.jwtSecret), nil
-	})
-
-	if err != nil || !parsedToken.Valid {
+	// Validate the token and its session
+	ip := middleware.ClientIP(r)
+	claims, err := h.authenticator.Authenticate(r.Context(), protocolParts[1], ip)
+	if errors.Is(err, auth.ErrInvalidToken) {
 		http.Error(w, "invalid token", http.StatusUnauthorized)
 		return
 	}
+	if err != nil {
+		http.Error(w, "session expired or invalid", http.StatusUnauthorized)
+		return
+	}
+	if !claims.Allows(token.ScopeMessagesRead) {
+		http.Error(w, "token lacks the "+token.ScopeMessagesRead+" scope", http.StatusForbidden)
+		return
+	}
 
-	userID := int64(claims["user_id"].(float64))
-	username := claims["username"].(string)
-
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		http.Error(w, "could not upgrade connection", http.StatusInternalServerError)
 		return
 	}
 
-	client := ws.NewClient(h.hub, conn, userID, username)
+	client := ws.NewClient(h.hub, conn, claims, ip)
 	h.hub.Register <- client
 
 	go client.WritePump()
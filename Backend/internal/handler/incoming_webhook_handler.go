@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/repository"
+	"github.com/hdngo/whisper/internal/service"
+	"github.com/hdngo/whisper/internal/ws"
+	"github.com/hdngo/whisper/pkg/middleware"
+)
+
+// maxWebhookBody bounds the payloads accepted by incoming webhooks.
+const maxWebhookBody = 1 << 20
+
+type IncomingWebhookHandler struct {
+	webhooks *service.IncomingWebhooks
+}
+
+func NewIncomingWebhookHandler(webhooks *service.IncomingWebhooks) *IncomingWebhookHandler {
+	return &IncomingWebhookHandler{webhooks: webhooks}
+}
+
+// Receive posts a Slack-style message sent to a webhook URL. Like Slack,
+// it accepts a JSON body or a form with the JSON in its payload field.
+func (h *IncomingWebhookHandler) Receive(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxWebhookBody)
+
+	var msg model.SlackMessage
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		err = json.Unmarshal([]byte(r.PostFormValue("payload")), &msg)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&msg)
+	}
+	if err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	err = h.webhooks.Receive(r.Context(), mux.Vars(r)["token"], &msg)
+	var rateLimited *service.WebhookRateLimitedError
+	switch {
+	case errors.Is(err, service.ErrInvalidWebhookToken):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, service.ErrEmptyWebhookMessage), errors.Is(err, service.ErrWebhookDisplayName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.As(err, &rateLimited):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rateLimited.RetryAfter.Seconds()))))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case errors.Is(err, ws.ErrMessageTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok"))
+}
+
+func (h *IncomingWebhookHandler) List(w http.ResponseWriter, r *http.Request) {
+	hooks, err := h.webhooks.List(r.Context())
+	if err != nil {
+		http.Error(w, "failed to fetch webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+func (h *IncomingWebhookHandler) Create(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := r.Context().Value(middleware.UserIDKey).(int64)
+	admin, _ := r.Context().Value(middleware.UsernameKey).(string)
+
+	var req model.CreateIncomingWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	hook, hookToken, err := h.webhooks.Create(r.Context(), adminID, admin, &req)
+	var invalid *service.IncomingWebhookRequestError
+	switch {
+	case errors.As(err, &invalid):
+		http.Error(w, invalid.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, service.ErrWebhookUsernameTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&model.IncomingWebhookURL{IncomingWebhook: *hook, URL: webhookURL(r, hookToken)})
+}
+
+// Rotate replaces a webhook's URL, returning the new one.
+func (h *IncomingWebhookHandler) Rotate(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+
+	hook, hookToken, err := h.webhooks.Rotate(r.Context(), id)
+	if errors.Is(err, repository.ErrIncomingWebhookNotFound) {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to rotate webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&model.IncomingWebhookURL{IncomingWebhook: *hook, URL: webhookURL(r, hookToken)})
+}
+
+func (h *IncomingWebhookHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.webhooks.Delete(r.Context(), id)
+	if errors.Is(err, repository.ErrIncomingWebhookNotFound) {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func webhookID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid webhook id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// webhookURL is the URL of the webhook with the given token on the server
+// that handled r.
+func webhookURL(r *http.Request, hookToken string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/api/hooks/" + hookToken
+}
@@ -0,0 +1,24 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/hdngo/whisper/internal/token"
+)
+
+type JWKSHandler struct {
+	tokens *token.Manager
+}
+
+func NewJWKSHandler(tokens *token.Manager) *JWKSHandler {
+	return &JWKSHandler{tokens: tokens}
+}
+
+// GetKeys serves the public keys that verify access tokens so that other
+// services can check them without sharing a secret.
+func (h *JWKSHandler) GetKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(h.tokens.JWKS())
+}
@@ -2,65 +2,402 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/hdngo/whisper/internal/config"
+	"github.com/hdngo/whisper/internal/model"
 	"github.com/hdngo/whisper/internal/repository"
+	"github.com/hdngo/whisper/internal/service"
+	"github.com/hdngo/whisper/internal/token"
+	"github.com/hdngo/whisper/internal/ws"
+	"github.com/hdngo/whisper/pkg/middleware"
 )
 
 type MessageHandler struct {
-	msgRepo *repository.MessageRepository
+	msgRepo  *repository.MessageRepository
+	mentions *service.Mentions
+	reads    *service.ReadMarkers
+	hub      *ws.Hub
+	mutex    sync.RWMutex
+	cfg      config.MessagesConfig
 }
 
-func NewMessageHandler(msgRepo *repository.MessageRepository) *MessageHandler {
-	return &MessageHandler{msgRepo: msgRepo}
+func NewMessageHandler(msgRepo *repository.MessageRepository, mentions *service.Mentions, reads *service.ReadMarkers, hub *ws.Hub, cfg config.MessagesConfig) *MessageHandler {
+	return &MessageHandler{msgRepo: msgRepo, mentions: mentions, reads: reads, hub: hub, cfg: cfg}
 }
 
-func (h *MessageHandler) GetRecent(w http.ResponseWriter, r *http.Request) {
-	limitStr := r.URL.Query().Get("limit")
-	limit := 50 // Default limit
+// SetConfig replaces the history limits. It is safe to call while requests
+// are being served.
+func (h *MessageHandler) SetConfig(cfg config.MessagesConfig) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.cfg = cfg
+}
 
-	if limitStr != "" {
-		parseLimit, err := strconv.Atoi(limitStr)
-		if err == nil && parseLimit > 0 && parseLimit <= 100 {
-			limit = parseLimit
-		}
+// GetHistory returns a page of history, oldest first. Without a cursor it
+// starts at the newest messages, or the oldest with direction=after; the
+// next and prev cursors of the response continue from either end.
+func (h *MessageHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
+	limit, ok := h.parseLimit(w, r)
+	if !ok {
+		return
+	}
+	query := &model.HistoryQuery{
+		Cursor:    r.URL.Query().Get("cursor"),
+		Direction: r.URL.Query().Get("direction"),
+		Limit:     limit,
+	}
+	if query.Direction != "" && query.Direction != model.HistoryBefore && query.Direction != model.HistoryAfter {
+		http.Error(w, "direction must be before or after", http.StatusBadRequest)
+		return
 	}
 
-	messages, err := h.msgRepo.GetRecent(r.Context(), limit)
+	page, err := h.msgRepo.History(r.Context(), query)
+	if errors.Is(err, repository.ErrInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "failed to fetch messages", http.StatusInternalServerError)
 		return
 	}
 
+	if state := h.readState(w, r); state != nil {
+		page.LastReadID, page.Unread = &state.LastReadMessageID, &state.Unread
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(messages)
+	json.NewEncoder(w).Encode(page)
 }
 
-func (h *MessageHandler) GetMessagesBefore(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	beforeID, err := strconv.ParseInt(vars["id"], 10, 64)
+// GetContext returns a message with up to before messages preceding it and
+// after messages following it, so clients can open history at a linked
+// message and page in both directions with the returned cursors. Both
+// default to half the default history limit.
+func (h *MessageHandler) GetContext(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
 		http.Error(w, "invalid message ID", http.StatusBadRequest)
 		return
 	}
 
-	limit := 50 // Default limit
-	limitStr := r.URL.Query().Get("limit")
-	if limitStr != "" {
-		parsedLimit, err := strconv.Atoi(limitStr)
-		if err == nil && parsedLimit > 0 && parsedLimit <= 100 {
-			limit = parsedLimit
-		}
+	h.mutex.RLock()
+	cfg := h.cfg
+	h.mutex.RUnlock()
+
+	before, ok := parseCount(r.URL.Query().Get("before"), cfg.DefaultHistoryLimit/2, cfg.MaxHistoryLimit)
+	if !ok {
+		http.Error(w, fmt.Sprintf("before must be between 0 and %d", cfg.MaxHistoryLimit), http.StatusBadRequest)
+		return
+	}
+	after, ok := parseCount(r.URL.Query().Get("after"), cfg.DefaultHistoryLimit/2, cfg.MaxHistoryLimit)
+	if !ok {
+		http.Error(w, fmt.Sprintf("after must be between 0 and %d", cfg.MaxHistoryLimit), http.StatusBadRequest)
+		return
 	}
 
-	messages, err := h.msgRepo.GetMessagesBefore(r.Context(), beforeID, limit)
+	msg, err := h.msgRepo.GetByID(r.Context(), id)
+	if errors.Is(err, repository.ErrMessageNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "failed to fetch messages", http.StatusInternalServerError)
 		return
 	}
 
+	result := &model.MessageContext{Message: *msg, Before: []model.Message{}, After: []model.Message{}}
+	if before > 0 {
+		if result.Before, err = h.msgRepo.GetMessagesBefore(r.Context(), id, before); err != nil {
+			http.Error(w, "failed to fetch messages", http.StatusInternalServerError)
+			return
+		}
+	}
+	if after > 0 {
+		if result.After, err = h.msgRepo.GetMessagesAfter(r.Context(), id, after); err != nil {
+			http.Error(w, "failed to fetch messages", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	first, last := id, id
+	if len(result.Before) > 0 {
+		first = result.Before[0].ID
+	}
+	if len(result.After) > 0 {
+		last = result.After[len(result.After)-1].ID
+	}
+	result.Prev = repository.HistoryCursor(first, model.HistoryBefore)
+	result.Next = repository.HistoryCursor(last, model.HistoryAfter)
+
+	if state := h.readState(w, r); state != nil {
+		result.LastReadID, result.Unread = &state.LastReadMessageID, &state.Unread
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(messages)
+	json.NewEncoder(w).Encode(result)
+}
+
+// parseCount parses an optional count between 0 and most, returning
+// fallback when it is empty.
+func parseCount(value string, fallback, most int) (int, bool) {
+	if value == "" {
+		return fallback, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > most {
+		return 0, false
+	}
+	return n, true
+}
+
+// PostMessage sends a chat message as the caller, the same way as one sent
+// over the websocket. It is how bots post without holding a connection.
+func (h *MessageHandler) PostMessage(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(middleware.ClaimsKey).(*token.Claims)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req model.PostMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		http.Error(w, "message content is required", http.StatusBadRequest)
+		return
+	}
+	if ok, retryAfter := h.hub.AllowPost(claims.UserID); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "sending messages too fast", http.StatusTooManyRequests)
+		return
+	}
+
+	err := h.hub.PostMessage(claims.UserID, claims.Username, req.Content, claims.Bot)
+	if errors.Is(err, ws.ErrMessageTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Search finds messages matching the q parameter, optionally only those by
+// author and sent between from and to. Pages after the first are fetched
+// with the next cursor of the previous one. There is a single chat room, so
+// a room filter is refused rather than ignored.
+func (h *MessageHandler) Search(w http.ResponseWriter, r *http.Request) {
+	limit, ok := h.parseLimit(w, r)
+	if !ok {
+		return
+	}
+
+	params := r.URL.Query()
+	if params.Has("room") {
+		http.Error(w, "search has no room filter", http.StatusBadRequest)
+		return
+	}
+	query := &model.SearchQuery{
+		Text:   strings.TrimSpace(params.Get("q")),
+		Author: params.Get("author"),
+		Cursor: params.Get("cursor"),
+		Limit:  limit,
+	}
+	if query.Text == "" {
+		http.Error(w, "search query is required", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if query.From, err = parseTimeParam(params.Get("from")); err != nil {
+		http.Error(w, "invalid from time", http.StatusBadRequest)
+		return
+	}
+	if query.To, err = parseTimeParam(params.Get("to")); err != nil {
+		http.Error(w, "invalid to time", http.StatusBadRequest)
+		return
+	}
+
+	results, err := h.msgRepo.Search(r.Context(), query)
+	if errors.Is(err, repository.ErrInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to search messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// parseTimeParam parses an optional time given in RFC 3339 or as Unix
+// seconds, returning the zero time when it is empty.
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, errors.New("invalid time")
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// GetReadState returns how far the caller has read and their unread count.
+func (h *MessageHandler) GetReadState(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(middleware.ClaimsKey).(*token.Claims)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	state, err := h.reads.State(r.Context(), claims.UserID)
+	if err != nil {
+		http.Error(w, "failed to fetch read state", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// MarkRead moves the caller's read marker forward, like a read frame on
+// the websocket, and returns the new read state.
+func (h *MessageHandler) MarkRead(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(middleware.ClaimsKey).(*token.Claims)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req model.ReadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageID <= 0 {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	state, err := h.reads.MarkRead(r.Context(), claims.UserID, claims.Username, req.MessageID)
+	if err != nil {
+		http.Error(w, "failed to mark messages read", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// readState looks up the caller's read marker and unread count for a page
+// of history, and also sets them as headers. It returns nil if they cannot
+// be looked up, in which case they are left out.
+func (h *MessageHandler) readState(w http.ResponseWriter, r *http.Request) *model.ReadState {
+	claims, ok := r.Context().Value(middleware.ClaimsKey).(*token.Claims)
+	if !ok {
+		return nil
+	}
+
+	state, err := h.reads.State(r.Context(), claims.UserID)
+	if err != nil {
+		log.Printf("error fetching read state for %s: %v", claims.Username, err)
+		return nil
+	}
+	w.Header().Set("X-Last-Read-ID", strconv.FormatInt(state.LastReadMessageID, 10))
+	w.Header().Set("X-Unread-Count", strconv.Itoa(state.Unread))
+	return state
+}
+
+// GetMentions lists the caller's mentions, newest first. With unread=true
+// only unread ones are listed, and before=<id> pages back from a mention.
+func (h *MessageHandler) GetMentions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(middleware.ClaimsKey).(*token.Claims)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var beforeID int64
+	if before := r.URL.Query().Get("before"); before != "" {
+		var err error
+		beforeID, err = strconv.ParseInt(before, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid mention ID", http.StatusBadRequest)
+			return
+		}
+	}
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+	limit, ok := h.parseLimit(w, r)
+	if !ok {
+		return
+	}
+
+	inbox, err := h.mentions.Inbox(r.Context(), claims.UserID, unreadOnly, beforeID, limit)
+	if err != nil {
+		http.Error(w, "failed to fetch mentions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inbox)
+}
+
+// MarkMentionsRead marks the listed mentions, or all of them, as read and
+// returns the number still unread.
+func (h *MessageHandler) MarkMentionsRead(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(middleware.ClaimsKey).(*token.Claims)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req model.MarkMentionsReadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	unread, err := h.mentions.MarkRead(r.Context(), claims.UserID, req.IDs)
+	if err != nil {
+		http.Error(w, "failed to update mentions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"unread": unread})
+}
+
+// parseLimit reads the limit parameter, the default history limit when it
+// is empty. An invalid limit is answered with 400 and ok is false.
+func (h *MessageHandler) parseLimit(w http.ResponseWriter, r *http.Request) (limit int, ok bool) {
+	h.mutex.RLock()
+	cfg := h.cfg
+	h.mutex.RUnlock()
+
+	limitStr := r.URL.Query().Get("limit")
+	if limitStr == "" {
+		return cfg.DefaultHistoryLimit, true
+	}
+
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit < 1 || limit > cfg.MaxHistoryLimit {
+		http.Error(w, fmt.Sprintf("limit must be between 1 and %d", cfg.MaxHistoryLimit), http.StatusBadRequest)
+		return 0, false
+	}
+	return limit, true
 }
@@ -0,0 +1,147 @@
+// Package ldapauth checks passwords against an LDAP directory.
+package ldapauth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/hdngo/whisper/internal/config"
+	"github.com/hdngo/whisper/internal/model"
+)
+
+// Verifier looks a user up with a search account and then binds as them
+// to check their password.
+type Verifier struct {
+	cfg       config.LDAPConfig
+	tlsConfig *tls.Config
+}
+
+func NewVerifier(cfg config.LDAPConfig) (*Verifier, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: u.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+
+	return &Verifier{cfg: cfg, tlsConfig: tlsConfig}, nil
+}
+
+// Verify reports whether the directory accepts password for username, and
+// if so who they are there. An error means the directory could not be
+// asked. Requests are bounded by the configured timeout rather than ctx.
+func (v *Verifier) Verify(ctx context.Context, username, password string) (*model.DirectoryUser, bool, error) {
+	// An empty password would make the bind below an unauthenticated one,
+	// which many servers accept.
+	if username == "" || password == "" {
+		return nil, false, nil
+	}
+
+	conn, err := v.dial()
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+
+	entry, err := v.findUser(conn, username)
+	if err != nil || entry == nil {
+		return nil, false, err
+	}
+
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	user := &model.DirectoryUser{
+		Username:    entry.GetAttributeValue(v.cfg.UsernameAttribute),
+		DisplayName: entry.GetAttributeValue(v.cfg.DisplayNameAttribute),
+	}
+	if user.Username == "" {
+		user.Username = username
+	}
+	return user, true, nil
+}
+
+func (v *Verifier) dial() (*ldap.Conn, error) {
+	dialer := &net.Dialer{Timeout: v.cfg.Timeout}
+	conn, err := ldap.DialURL(v.cfg.URL, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(v.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(v.cfg.Timeout)
+
+	if v.cfg.StartTLS {
+		if err := conn.StartTLS(v.tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+	}
+
+	if v.cfg.BindDN != "" {
+		if err := conn.Bind(v.cfg.BindDN, v.cfg.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("binding as %s: %w", v.cfg.BindDN, err)
+		}
+	}
+
+	return conn, nil
+}
+
+// findUser returns the single entry matching the user and group filters,
+// or nil if there is none or the username is ambiguous.
+func (v *Verifier) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	filter := fmt.Sprintf(v.cfg.UserFilter, ldap.EscapeFilter(username))
+	if v.cfg.GroupFilter != "" {
+		filter = "(&" + filter + v.cfg.GroupFilter + ")"
+	}
+
+	req := ldap.NewSearchRequest(
+		v.cfg.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		int(v.cfg.Timeout.Seconds()),
+		false,
+		filter,
+		[]string{v.cfg.UsernameAttribute, v.cfg.DisplayNameAttribute},
+		nil,
+	)
+
+	result, err := conn.Search(req)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) || (err == nil && len(result.Entries) > 1) {
+		log.Printf("ldap: more than one entry matches %s, refusing to log in", filter)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) == 0 {
+		return nil, nil
+	}
+
+	return result.Entries[0], nil
+}
@@ -0,0 +1,29 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+var level = new(slog.LevelVar)
+
+// Init routes both slog and the standard log package through a single
+// handler whose level can be changed at runtime with SetLevel. Output from
+// log.Printf is treated as info.
+func Init(lvl string) error {
+	if err := SetLevel(lvl); err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	return nil
+}
+
+func SetLevel(lvl string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(lvl)); err != nil {
+		return fmt.Errorf("invalid log level %q", lvl)
+	}
+	level.Set(l)
+	return nil
+}
@@ -0,0 +1,31 @@
+package model
+
+// AccessToken is a long-lived personal access token for scripts and other
+// API clients. Only a hash of the token itself is stored. ExpiresAt and
+// LastUsedAt are zero for tokens that never expire or were never used.
+type AccessToken struct {
+	ID         int64    `json:"id"`
+	UserID     int64    `json:"-"`
+	Username   string   `json:"-"`
+	Bot        bool     `json:"-"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  int64    `json:"created_at"`
+	ExpiresAt  int64    `json:"expires_at,omitempty"`
+	LastUsedAt int64    `json:"last_used_at,omitempty"`
+}
+
+// CreateAccessTokenRequest asks for a new personal access token. ExpiresAt
+// is a Unix time, or zero for a token that does not expire.
+type CreateAccessTokenRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresAt int64    `json:"expires_at"`
+}
+
+// CreatedAccessToken is returned once when a token is created; the token
+// cannot be retrieved again.
+type CreatedAccessToken struct {
+	AccessToken
+	Token string `json:"token"`
+}
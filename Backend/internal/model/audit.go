@@ -0,0 +1,21 @@
+package model
+
+// Audit event types.
+const (
+	AuditAccountLocked   = "account_locked"
+	AuditAccountUnlocked = "account_unlocked"
+	AuditIPLocked        = "ip_locked"
+	AuditIPUnlocked      = "ip_unlocked"
+)
+
+// AuditEvent records a security-relevant action. Actor is the admin who
+// performed it, or empty for actions taken by the server itself.
+type AuditEvent struct {
+	ID        int64  `json:"id"`
+	Event     string `json:"event"`
+	Username  string `json:"username,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Actor     string `json:"actor,omitempty"`
+	Details   string `json:"details,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
@@ -0,0 +1,29 @@
+package model
+
+// CommandInvocation is POSTed to the URL of an external slash command.
+type CommandInvocation struct {
+	Command  string   `json:"command"`
+	Text     string   `json:"text"`
+	Args     []string `json:"args"`
+	UserID   int64    `json:"user_id"`
+	Username string   `json:"username"`
+}
+
+const (
+	CommandResponseEphemeral = "ephemeral"
+	CommandResponseInChannel = "in_channel"
+)
+
+// CommandResponse is the optional reply of an external slash command. Text
+// is shown only to the user who ran the command unless ResponseType is
+// in_channel, in which case it is posted to the chat as their message.
+type CommandResponse struct {
+	Text         string `json:"text"`
+	ResponseType string `json:"response_type"`
+}
+
+// Topic is the payload of a topic event.
+type Topic struct {
+	Topic    string `json:"topic"`
+	Username string `json:"username,omitempty"`
+}
@@ -0,0 +1,29 @@
+package model
+
+// Directions in which history is paged.
+const (
+	HistoryBefore = "before"
+	HistoryAfter  = "after"
+)
+
+// HistoryQuery fetches a page of chat history. Without a Cursor, paging
+// before starts at the newest message and paging after at the oldest.
+// Direction may be left empty to continue in the cursor's direction.
+type HistoryQuery struct {
+	Cursor    string
+	Direction string
+	Limit     int
+}
+
+// HistoryPage is a page of messages, oldest first whichever way it was
+// paged. Next continues in the direction of the query and is set when
+// HasMore is; Prev pages back the other way from the near end of the page.
+// LastReadID and Unread are the caller's read state.
+type HistoryPage struct {
+	Messages   []Message `json:"messages"`
+	Next       string    `json:"next,omitempty"`
+	Prev       string    `json:"prev,omitempty"`
+	HasMore    bool      `json:"has_more"`
+	LastReadID *int64    `json:"last_read_id,omitempty"`
+	Unread     *int      `json:"unread,omitempty"`
+}
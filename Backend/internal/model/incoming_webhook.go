@@ -0,0 +1,50 @@
+package model
+
+// IncomingWebhook lets other tools post chat messages through a secret URL.
+// Messages are posted as the webhook's bot account. Only a hash of the
+// URL's token is stored.
+type IncomingWebhook struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	UserID     int64  `json:"user_id"`
+	Username   string `json:"username"`
+	CreatedBy  string `json:"created_by"`
+	CreatedAt  int64  `json:"created_at"`
+	LastUsedAt int64  `json:"last_used_at,omitempty"`
+}
+
+// CreateIncomingWebhookRequest asks for a new incoming webhook posting as a
+// new bot named Username.
+type CreateIncomingWebhookRequest struct {
+	Name     string `json:"name"`
+	Username string `json:"username"`
+}
+
+// IncomingWebhookURL is returned when a webhook is created or its token
+// rotated; the URL cannot be retrieved again.
+type IncomingWebhookURL struct {
+	IncomingWebhook
+	URL string `json:"url"`
+}
+
+// SlackMessage is the subset of Slack's incoming webhook payload that is
+// understood. Username, when set, is shown as the message's display name.
+type SlackMessage struct {
+	Text        string            `json:"text"`
+	Username    string            `json:"username"`
+	Attachments []SlackAttachment `json:"attachments"`
+}
+
+type SlackAttachment struct {
+	Fallback  string       `json:"fallback"`
+	Pretext   string       `json:"pretext"`
+	Title     string       `json:"title"`
+	TitleLink string       `json:"title_link"`
+	Text      string       `json:"text"`
+	Fields    []SlackField `json:"fields"`
+}
+
+type SlackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
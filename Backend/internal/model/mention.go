@@ -0,0 +1,32 @@
+package model
+
+// Kinds of mention: of the user by name, of everyone online with @here, or
+// of every user with @channel.
+const (
+	MentionUser    = "user"
+	MentionHere    = "here"
+	MentionChannel = "channel"
+)
+
+// Mention records that a message mentioned a user. It is also the payload
+// of the mention event sent to that user.
+type Mention struct {
+	ID        int64   `json:"id"`
+	Kind      string  `json:"kind"`
+	Read      bool    `json:"read"`
+	CreatedAt int64   `json:"created_at"`
+	Message   Message `json:"message"`
+}
+
+// MentionInbox is a page of a user's mentions, newest first, with the
+// number of mentions they have not read yet.
+type MentionInbox struct {
+	Unread   int       `json:"unread"`
+	Mentions []Mention `json:"mentions"`
+}
+
+// MarkMentionsReadRequest marks the listed mentions as read, or all of
+// them when IDs is empty.
+type MarkMentionsReadRequest struct {
+	IDs []int64 `json:"ids"`
+}
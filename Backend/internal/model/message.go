@@ -1,11 +1,55 @@
 package model
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type Message struct {
-	ID        int64  `json:"id" db:"id"`
-	Content   string `json:"content" db:"content"`
-	UserID    int64  `json:"user_id" db:"user_id"`
-	Username  string `json:"username" db:"username"`
-	CreatedAt int64  `json:"created_at" db:"created_at"`
+	ID       int64  `json:"id" db:"id"`
+	Content  string `json:"content" db:"content"`
+	UserID   int64  `json:"user_id" db:"user_id"`
+	Username string `json:"username" db:"username"`
+	// DisplayName is shown instead of Username when set, as by incoming
+	// webhooks. The author is always Username.
+	DisplayName string    `json:"display_name,omitempty" db:"display_name"`
+	Bot         bool      `json:"bot,omitempty" db:"bot"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
+// MarshalJSON writes created_at in RFC 3339 with up to microseconds, and
+// created_at_unix in seconds for clients that read the old created_at.
+func (m Message) MarshalJSON() ([]byte, error) {
+	type message Message
+	m.CreatedAt = m.CreatedAt.UTC()
+	return json.Marshal(&struct {
+		message
+		CreatedAtUnix int64 `json:"created_at_unix"`
+	}{message(m), m.CreatedAt.Unix()})
+}
+
+// MessageTime returns the current time as stored for a message, which
+// keeps microseconds.
+func MessageTime() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// MessageContext is a message with the messages sent just before and after
+// it, both oldest first. Prev and Next are history cursors paging on from
+// the first and last of them. LastReadID and Unread are the caller's read
+// state.
+type MessageContext struct {
+	Message    Message   `json:"message"`
+	Before     []Message `json:"before"`
+	After      []Message `json:"after"`
+	Prev       string    `json:"prev"`
+	Next       string    `json:"next"`
+	LastReadID *int64    `json:"last_read_id,omitempty"`
+	Unread     *int      `json:"unread,omitempty"`
+}
+
+type PostMessageRequest struct {
+	Content string `json:"content"`
 }
 
 type WSMessage struct {
@@ -18,4 +62,61 @@ const (
 	MessageTypeJoin  = "join"
 	MessageTypeLeave = "leave"
 	MessageTypeUsers = "users"
+
+	// Sent by the server shortly before the connection's access token
+	// expires. The client answers with an auth frame carrying a fresh token.
+	MessageTypeTokenExpiring = "token_expiring"
+	MessageTypeAuth          = "auth"
+	MessageTypeAuthOK        = "auth_ok"
+	MessageTypeAuthError     = "auth_error"
+
+	// A notice from the server to one user or connection, which is never
+	// stored. The payload is a SystemMessage.
+	MessageTypeSystem = "system"
+
+	// Sent by a client to move its user's read marker forward, with a
+	// ReadRequest payload. The server answers every connection of the user
+	// with a read_state event, and everyone with a read event carrying a
+	// ReadReceipt when read receipts are enabled.
+	MessageTypeRead      = "read"
+	MessageTypeReadState = "read_state"
+
+	// Sent to a user mentioned in a chat message. The payload is a Mention.
+	MessageTypeMention = "mention"
+
+	// Sent when the topic is changed with /topic, and on connecting while
+	// one is set.
+	MessageTypeTopic = "topic"
+)
+
+// Kinds of system messages.
+const (
+	// The output of a slash command.
+	SystemKindCommand = "command"
+	// A frame the server refused, such as a chat message from a personal
+	// access token without the messages:write scope.
+	SystemKindError = "error"
+	// A chat message dropped because the connection sent too many.
+	SystemKindRateLimit = "rate_limit"
+	// A notice about moderation of the user's messages.
+	SystemKindModeration = "moderation"
 )
+
+// SystemMessage is the payload of a system event. Command is set for the
+// output of, and errors from, a slash command.
+type SystemMessage struct {
+	Kind    string `json:"kind"`
+	Text    string `json:"text"`
+	Command string `json:"command,omitempty"`
+}
+
+// WSInbound is a control frame sent by a client. Text frames that do not
+// decode as a known control frame are treated as chat messages.
+type WSInbound struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type AuthPayload struct {
+	Token string `json:"token"`
+}
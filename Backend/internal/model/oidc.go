@@ -0,0 +1,13 @@
+package model
+
+// OIDCAuthorization points the browser at the identity provider to log in.
+type OIDCAuthorization struct {
+	AuthorizationURL string `json:"authorization_url"`
+}
+
+// OIDCCallbackRequest carries the parameters the identity provider sent
+// the browser back to the redirect URL with.
+type OIDCCallbackRequest struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+}
@@ -0,0 +1,34 @@
+package model
+
+import (
+	"encoding/json"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Passkey is a WebAuthn credential a user can log in with instead of a
+// password.
+type Passkey struct {
+	ID         int64               `json:"id"`
+	UserID     int64               `json:"-"`
+	Name       string              `json:"name"`
+	Credential webauthn.Credential `json:"-"`
+	CreatedAt  int64               `json:"created_at"`
+	LastUsedAt int64               `json:"last_used_at"`
+}
+
+// WebAuthnCeremony is handed to the browser to start a registration or
+// login. Options are passed to navigator.credentials.create or get, and
+// CeremonyID identifies the ceremony when it is finished.
+type WebAuthnCeremony struct {
+	CeremonyID string      `json:"ceremony_id"`
+	Options    interface{} `json:"options"`
+}
+
+// WebAuthnFinishRequest carries the browser's response to a ceremony.
+// Name labels a newly registered passkey.
+type WebAuthnFinishRequest struct {
+	CeremonyID string          `json:"ceremony_id"`
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential"`
+}
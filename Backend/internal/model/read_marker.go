@@ -0,0 +1,20 @@
+package model
+
+// ReadRequest moves the caller's read marker forward to MessageID.
+type ReadRequest struct {
+	MessageID int64 `json:"message_id"`
+}
+
+// ReadState is how far a user has read, and how many newer messages from
+// other users they have not.
+type ReadState struct {
+	LastReadMessageID int64 `json:"last_read_message_id"`
+	Unread            int   `json:"unread"`
+}
+
+// ReadReceipt tells everyone that a user has read up to MessageID.
+type ReadReceipt struct {
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	MessageID int64  `json:"message_id"`
+}
@@ -0,0 +1,33 @@
+package model
+
+import "time"
+
+// SearchQuery finds chat messages matching Text, a web search style query
+// that supports "quoted phrases", or and -excluded words. Author, From and
+// To (inclusive) narrow the results when set. Cursor continues from a
+// previous page.
+type SearchQuery struct {
+	Text   string
+	Author string
+	From   time.Time
+	To     time.Time
+	Cursor string
+	Limit  int
+}
+
+// SearchResult is a matching message with a snippet of its content in
+// which the matched words are wrapped in <mark> tags. The rest of the
+// snippet is HTML-escaped.
+type SearchResult struct {
+	Message Message `json:"message"`
+	Snippet string  `json:"snippet"`
+	Rank    float32 `json:"rank"`
+}
+
+// SearchResults is a page of results, best match first. Next fetches the
+// following page when HasMore is set.
+type SearchResults struct {
+	Results []SearchResult `json:"results"`
+	Next    string         `json:"next,omitempty"`
+	HasMore bool           `json:"has_more"`
+}
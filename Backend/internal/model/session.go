@@ -0,0 +1,22 @@
+package model
+
+// Session is a logged-in device. Its refresh tokens form a single rotation
+// family: only RefreshHash, the hash of the latest refresh token, may be
+// exchanged for new tokens.
+type Session struct {
+	ID          string `json:"id"`
+	UserID      int64  `json:"user_id"`
+	Username    string `json:"username"`
+	RefreshHash string `json:"-"`
+	UserAgent   string `json:"user_agent"`
+	IP          string `json:"ip"`
+	CreatedAt   int64  `json:"created_at"`
+	LastUsedAt  int64  `json:"last_used_at"`
+	Current     bool   `json:"current"`
+}
+
+// DeviceInfo describes the client a session is created for.
+type DeviceInfo struct {
+	UserAgent string
+	IP        string
+}
@@ -0,0 +1,25 @@
+package model
+
+// MFAVerifyRequest finishes a login that requires a second factor. Code is
+// a TOTP code or a recovery code.
+type MFAVerifyRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+// TOTPEnrollment is the secret a user adds to their authenticator app,
+// both raw and as an otpauth:// URI for QR codes.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TOTPCodeRequest carries a TOTP code or recovery code proving possession
+// of the second factor.
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
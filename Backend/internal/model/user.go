@@ -1,10 +1,22 @@
 package model
 
+// User is a person or, when IsBot is set, a bot owned by the user OwnerID.
+// Bots have no password and act only through personal access tokens.
 type User struct {
-	ID        int64  `json:"id" db:"id"`
-	Username  string `json:"username" db:"username"`
-	Password  string `json:"-" db:"password_hash"`
-	CreatedAt int64  `json:"created_at" db:"created_at"`
+	ID           int64  `json:"id" db:"id"`
+	Username     string `json:"username" db:"username"`
+	DisplayName  string `json:"display_name,omitempty" db:"display_name"`
+	Password     string `json:"-" db:"password_hash"`
+	TOTPSecret   string `json:"-" db:"totp_secret"`
+	TOTPEnabled  bool   `json:"totp_enabled" db:"totp_enabled"`
+	TOTPLastStep int64  `json:"-" db:"totp_last_step"`
+	IsBot        bool   `json:"is_bot" db:"is_bot"`
+	OwnerID      int64  `json:"-" db:"bot_owner_id"`
+	CreatedAt    int64  `json:"created_at" db:"created_at"`
+
+	// Directory is set on accounts created for a directory user, the only
+	// ones a directory login may sign in as.
+	Directory bool `json:"-" db:"directory"`
 }
 
 type RegisterRequest struct {
@@ -17,7 +29,32 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// AuthResponse is returned by a successful login. When the user has
+// two-factor authentication enabled, only MFARequired and MFAToken are set
+// and the login is finished by verifying a code against MFAToken.
 type AuthResponse struct {
-	Token    string `json:"token"`
-	Username string `json:"username"`
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresAt    int64  `json:"expires_at,omitempty"`
+	Username     string `json:"username"`
+	DisplayName  string `json:"display_name,omitempty"`
+	MFARequired  bool   `json:"mfa_required,omitempty"`
+	MFAToken     string `json:"mfa_token,omitempty"`
+}
+
+// DirectoryUser is a user whose password was accepted by an external
+// directory such as LDAP.
+type DirectoryUser struct {
+	Username    string
+	DisplayName string
+}
+
+// CreateBotRequest asks for a new bot account owned by the caller.
+type CreateBotRequest struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
 }
@@ -0,0 +1,37 @@
+package model
+
+import "encoding/json"
+
+// Webhook delivery states. Dead deliveries failed every attempt and make up
+// the dead-letter list.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// WebhookEventMessage is the event sent for every new chat message.
+const WebhookEventMessage = "message.created"
+
+// WebhookDelivery is one event queued for an outgoing webhook, along with
+// the outcome of its latest attempt.
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	Webhook        string          `json:"webhook"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      int64           `json:"created_at"`
+	NextAttemptAt  int64           `json:"next_attempt_at,omitempty"`
+	DeliveredAt    int64           `json:"delivered_at,omitempty"`
+}
+
+// WebhookEvent is the body POSTed to a webhook.
+type WebhookEvent struct {
+	Event     string   `json:"event"`
+	Message   *Message `json:"message"`
+	CreatedAt int64    `json:"created_at"`
+}
@@ -0,0 +1,120 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/lib/pq"
+)
+
+var ErrAccessTokenNotFound = errors.New("access token not found")
+
+type AccessTokenRepository struct {
+	db *sql.DB
+}
+
+func NewAccessTokenRepository(db *sql.DB) *AccessTokenRepository {
+	return &AccessTokenRepository{db: db}
+}
+
+func (r *AccessTokenRepository) Create(ctx context.Context, accessToken *model.AccessToken, tokenHash string) error {
+	query := `
+		INSERT INTO access_tokens (user_id, name, token_hash, scopes, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`
+
+	accessToken.CreatedAt = time.Now().Unix()
+	return r.db.QueryRowContext(
+		ctx,
+		query,
+		accessToken.UserID,
+		accessToken.Name,
+		tokenHash,
+		pq.Array(accessToken.Scopes),
+		accessToken.CreatedAt,
+		accessToken.ExpiresAt,
+	).Scan(&accessToken.ID)
+}
+
+func (r *AccessTokenRepository) GetByUserID(ctx context.Context, userID int64) ([]model.AccessToken, error) {
+	query := `
+		SELECT t.id, t.user_id, u.username, u.is_bot, t.name, t.scopes, t.created_at, t.expires_at, t.last_used_at
+		FROM access_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.user_id = $1
+		ORDER BY t.id`
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accessTokens := []model.AccessToken{}
+	for rows.Next() {
+		accessToken, err := scanAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		accessTokens = append(accessTokens, *accessToken)
+	}
+
+	return accessTokens, rows.Err()
+}
+
+// GetByHash returns the token stored under tokenHash along with its
+// owner's username.
+func (r *AccessTokenRepository) GetByHash(ctx context.Context, tokenHash string) (*model.AccessToken, error) {
+	query := `
+		SELECT t.id, t.user_id, u.username, u.is_bot, t.name, t.scopes, t.created_at, t.expires_at, t.last_used_at
+		FROM access_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1`
+
+	accessToken, err := scanAccessToken(r.db.QueryRowContext(ctx, query, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, ErrAccessTokenNotFound
+	}
+	return accessToken, err
+}
+
+// Touch records that a token was just used.
+func (r *AccessTokenRepository) Touch(ctx context.Context, id int64) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE access_tokens SET last_used_at = $2 WHERE id = $1`, id, time.Now().Unix())
+	return err
+}
+
+func (r *AccessTokenRepository) Delete(ctx context.Context, userID, id int64) error {
+	query := `DELETE FROM access_tokens WHERE id = $1 AND user_id = $2`
+
+	deleted, err := affectedOne(r.db.ExecContext(ctx, query, id, userID))
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrAccessTokenNotFound
+	}
+	return nil
+}
+
+func scanAccessToken(row rowScanner) (*model.AccessToken, error) {
+	var accessToken model.AccessToken
+	err := row.Scan(
+		&accessToken.ID,
+		&accessToken.UserID,
+		&accessToken.Username,
+		&accessToken.Bot,
+		&accessToken.Name,
+		pq.Array(&accessToken.Scopes),
+		&accessToken.CreatedAt,
+		&accessToken.ExpiresAt,
+		&accessToken.LastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &accessToken, nil
+}
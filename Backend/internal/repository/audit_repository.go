@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/hdngo/whisper/internal/model"
+)
+
+type AuditRepository struct {
+	db *sql.DB
+}
+
+func NewAuditRepository(db *sql.DB) *AuditRepository {
+	return &AuditRepository{db: db}
+}
+
+func (r *AuditRepository) Create(ctx context.Context, event *model.AuditEvent) error {
+	query := `
+		INSERT INTO audit_log (event, username, ip, actor, details, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`
+
+	event.CreatedAt = time.Now().Unix()
+	return r.db.QueryRowContext(
+		ctx,
+		query,
+		event.Event,
+		event.Username,
+		event.IP,
+		event.Actor,
+		event.Details,
+		event.CreatedAt,
+	).Scan(&event.ID)
+}
+
+// GetRecent returns the latest events, newest first, optionally only those
+// of one type.
+func (r *AuditRepository) GetRecent(ctx context.Context, event string, limit int) ([]model.AuditEvent, error) {
+	query := `
+		SELECT id, event, username, ip, actor, details, created_at
+		FROM audit_log
+		WHERE $1::text = '' OR event = $1
+		ORDER BY id DESC
+		LIMIT $2`
+
+	rows, err := r.db.QueryContext(ctx, query, event, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []model.AuditEvent{}
+	for rows.Next() {
+		var e model.AuditEvent
+		if err := rows.Scan(&e.ID, &e.Event, &e.Username, &e.IP, &e.Actor, &e.Details, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
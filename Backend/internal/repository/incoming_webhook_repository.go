@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/hdngo/whisper/internal/model"
+)
+
+var ErrIncomingWebhookNotFound = errors.New("incoming webhook not found")
+
+type IncomingWebhookRepository struct {
+	db *sql.DB
+}
+
+func NewIncomingWebhookRepository(db *sql.DB) *IncomingWebhookRepository {
+	return &IncomingWebhookRepository{db: db}
+}
+
+func (r *IncomingWebhookRepository) Create(ctx context.Context, hook *model.IncomingWebhook, tokenHash string) error {
+	query := `
+		INSERT INTO incoming_webhooks (name, user_id, token_hash, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`
+
+	hook.CreatedAt = time.Now().Unix()
+	return r.db.QueryRowContext(
+		ctx,
+		query,
+		hook.Name,
+		hook.UserID,
+		tokenHash,
+		hook.CreatedBy,
+		hook.CreatedAt,
+	).Scan(&hook.ID)
+}
+
+func (r *IncomingWebhookRepository) GetAll(ctx context.Context) ([]model.IncomingWebhook, error) {
+	query := `
+		SELECT h.id, h.name, h.user_id, u.username, h.created_by, h.created_at, h.last_used_at
+		FROM incoming_webhooks h
+		JOIN users u ON u.id = h.user_id
+		ORDER BY h.id`
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []model.IncomingWebhook{}
+	for rows.Next() {
+		hook, err := scanIncomingWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, *hook)
+	}
+
+	return hooks, rows.Err()
+}
+
+func (r *IncomingWebhookRepository) GetByID(ctx context.Context, id int64) (*model.IncomingWebhook, error) {
+	query := `
+		SELECT h.id, h.name, h.user_id, u.username, h.created_by, h.created_at, h.last_used_at
+		FROM incoming_webhooks h
+		JOIN users u ON u.id = h.user_id
+		WHERE h.id = $1`
+
+	hook, err := scanIncomingWebhook(r.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrIncomingWebhookNotFound
+	}
+	return hook, err
+}
+
+// GetByHash returns the webhook whose token hashes to tokenHash.
+func (r *IncomingWebhookRepository) GetByHash(ctx context.Context, tokenHash string) (*model.IncomingWebhook, error) {
+	query := `
+		SELECT h.id, h.name, h.user_id, u.username, h.created_by, h.created_at, h.last_used_at
+		FROM incoming_webhooks h
+		JOIN users u ON u.id = h.user_id
+		WHERE h.token_hash = $1`
+
+	hook, err := scanIncomingWebhook(r.db.QueryRowContext(ctx, query, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, ErrIncomingWebhookNotFound
+	}
+	return hook, err
+}
+
+// SetToken replaces the webhook's token, invalidating its old URL.
+func (r *IncomingWebhookRepository) SetToken(ctx context.Context, id int64, tokenHash string) error {
+	updated, err := affectedOne(r.db.ExecContext(ctx, `UPDATE incoming_webhooks SET token_hash = $2 WHERE id = $1`, id, tokenHash))
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return ErrIncomingWebhookNotFound
+	}
+	return nil
+}
+
+// Touch records that a webhook was just used.
+func (r *IncomingWebhookRepository) Touch(ctx context.Context, id int64) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE incoming_webhooks SET last_used_at = $2 WHERE id = $1`, id, time.Now().Unix())
+	return err
+}
+
+func (r *IncomingWebhookRepository) Delete(ctx context.Context, id int64) error {
+	deleted, err := affectedOne(r.db.ExecContext(ctx, `DELETE FROM incoming_webhooks WHERE id = $1`, id))
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrIncomingWebhookNotFound
+	}
+	return nil
+}
+
+func scanIncomingWebhook(row rowScanner) (*model.IncomingWebhook, error) {
+	var hook model.IncomingWebhook
+	err := row.Scan(
+		&hook.ID,
+		&hook.Name,
+		&hook.UserID,
+		&hook.Username,
+		&hook.CreatedBy,
+		&hook.CreatedAt,
+		&hook.LastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
@@ -0,0 +1,120 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/lib/pq"
+)
+
+type MentionRepository struct {
+	db *sql.DB
+}
+
+func NewMentionRepository(db *sql.DB) *MentionRepository {
+	return &MentionRepository{db: db}
+}
+
+// CreateForUsernames records a mention of msg for each named user other
+// than its sender, and returns the new mentions by recipient. Users already
+// mentioned in msg are skipped.
+func (r *MentionRepository) CreateForUsernames(ctx context.Context, msg *model.Message, kind string, usernames []string) (map[int64]int64, error) {
+	return r.create(ctx, msg, kind, `username = ANY($5)`, pq.Array(usernames))
+}
+
+// CreateForUserIDs is like CreateForUsernames for users given by ID.
+func (r *MentionRepository) CreateForUserIDs(ctx context.Context, msg *model.Message, kind string, userIDs []int64) (map[int64]int64, error) {
+	return r.create(ctx, msg, kind, `id = ANY($5)`, pq.Array(userIDs))
+}
+
+// CreateForEveryone is like CreateForUsernames for every user except bots.
+func (r *MentionRepository) CreateForEveryone(ctx context.Context, msg *model.Message, kind string) (map[int64]int64, error) {
+	return r.create(ctx, msg, kind, `NOT is_bot`)
+}
+
+func (r *MentionRepository) create(ctx context.Context, msg *model.Message, kind, where string, args ...interface{}) (map[int64]int64, error) {
+	query := `
+		INSERT INTO mentions (message_id, user_id, kind, created_at)
+		SELECT $1, id, $2, $3 FROM users
+		WHERE id <> $4 AND ` + where + `
+		ON CONFLICT (message_id, user_id) DO NOTHING
+		RETURNING user_id, id`
+
+	args = append([]interface{}{msg.ID, kind, msg.CreatedAt.Unix(), msg.UserID}, args...)
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	created := make(map[int64]int64)
+	for rows.Next() {
+		var userID, id int64
+		if err := rows.Scan(&userID, &id); err != nil {
+			return nil, err
+		}
+		created[userID] = id
+	}
+	return created, rows.Err()
+}
+
+// GetByUserID returns up to limit of the user's mentions with IDs below
+// beforeID, or the latest when beforeID is 0, newest first.
+func (r *MentionRepository) GetByUserID(ctx context.Context, userID int64, unreadOnly bool, beforeID int64, limit int) ([]model.Mention, error) {
+	query := `
+		SELECT n.id, n.kind, n.read_at <> 0, n.created_at,
+			m.id, m.content, m.user_id, m.username, m.display_name, m.bot, m.created_at
+		FROM mentions n
+		JOIN messages m ON m.id = n.message_id
+		WHERE n.user_id = $1 AND (NOT $2 OR n.read_at = 0) AND ($3 = 0 OR n.id < $3)
+		ORDER BY n.id DESC
+		LIMIT $4`
+
+	rows, err := r.db.QueryContext(ctx, query, userID, unreadOnly, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mentions := []model.Mention{}
+	for rows.Next() {
+		var mention model.Mention
+		if err := rows.Scan(
+			&mention.ID,
+			&mention.Kind,
+			&mention.Read,
+			&mention.CreatedAt,
+			&mention.Message.ID,
+			&mention.Message.Content,
+			&mention.Message.UserID,
+			&mention.Message.Username,
+			&mention.Message.DisplayName,
+			&mention.Message.Bot,
+			&mention.Message.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, mention)
+	}
+
+	return mentions, rows.Err()
+}
+
+func (r *MentionRepository) CountUnread(ctx context.Context, userID int64) (int, error) {
+	var count int
+	err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM mentions WHERE user_id = $1 AND read_at = 0`, userID).Scan(&count)
+	return count, err
+}
+
+// MarkRead marks the user's mentions with the given IDs as read, or all of
+// them when ids is empty.
+func (r *MentionRepository) MarkRead(ctx context.Context, userID int64, ids []int64) error {
+	query := `
+		UPDATE mentions SET read_at = $2
+		WHERE user_id = $1 AND read_at = 0 AND (COALESCE(cardinality($3::bigint[]), 0) = 0 OR id = ANY($3))`
+
+	_, err := r.db.ExecContext(ctx, query, userID, time.Now().Unix(), pq.Array(ids))
+	return err
+}
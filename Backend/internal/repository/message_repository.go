@@ -4,20 +4,51 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"log"
+	"math"
 	"time"
 
 	"github.com/hdngo/whisper/internal/model"
 )
 
+var ErrMessageNotFound = errors.New("message not found")
+
 type MessageRepository struct {
-	db *sql.DB
+	db           *sql.DB
+	replica      *sql.DB
+	queryTimeout time.Duration
+}
+
+// NewMessageRepository creates a repository that writes to db. History
+// reads go to replica when it is non-nil, falling back to db if the replica
+// query fails.
+func NewMessageRepository(db, replica *sql.DB, queryTimeout time.Duration) *MessageRepository {
+	return &MessageRepository{db: db, replica: replica, queryTimeout: queryTimeout}
 }
 
-func NewMessageRepository(db *sql.DB) *MessageRepository {
-	return &MessageRepository{db: db}
+func (r *MessageRepository) queryRead(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if r.replica != nil {
+		rows, err := r.replica.QueryContext(ctx, query, args...)
+		if err == nil {
+			return rows, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.Printf("replica query failed, falling back to primary: %v", err)
+	}
+
+	return r.db.QueryContext(ctx, query, args...)
 }
 
+// Create stores msg, setting its ID. CreatedAt is set to the current time
+// unless the caller already has, as the hub does for the time it
+// broadcast.
 func (r *MessageRepository) Create(ctx context.Context, msg *model.Message) error {
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = model.MessageTime()
+	}
+
 	var err error
 	for attempts := 0; attempts < 3; attempts++ {
 		err = r.createWithTimeout(ctx, msg)
@@ -38,12 +69,12 @@ func (r *MessageRepository) Create(ctx context.Context, msg *model.Message) erro
 }
 
 func (r *MessageRepository) createWithTimeout(ctx context.Context, msg *model.Message) error {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, r.queryTimeout)
 	defer cancel()
 
 	query := `
-        INSERT INTO messages (content, user_id, username, created_at)
-        VALUES ($1, $2, $3, $4)
+        INSERT INTO messages (content, user_id, username, display_name, bot, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
         RETURNING id`
 
 	err := r.db.QueryRowContext(
@@ -52,7 +83,9 @@ func (r *MessageRepository) createWithTimeout(ctx context.Context, msg *model.Me
 		msg.Content,
 		msg.UserID,
 		msg.Username,
-		time.Now().Unix(),
+		msg.DisplayName,
+		msg.Bot,
+		msg.CreatedAt,
 	).Scan(&msg.ID)
 
 	if err != nil {
@@ -65,35 +98,110 @@ func (r *MessageRepository) createWithTimeout(ctx context.Context, msg *model.Me
 	return nil
 }
 
-func (r *MessageRepository) GetRecent(ctx context.Context, limit int) ([]model.Message, error) {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+// historyCursor is the ID of the message at one end of a history page and
+// the direction to page from it.
+type historyCursor struct {
+	ID        int64  `json:"id"`
+	Direction string `json:"d"`
+}
+
+// History returns a page of messages ordered by ID, which unlike the
+// creation time is unique and follows the order messages were stored in.
+func (r *MessageRepository) History(ctx context.Context, q *model.HistoryQuery) (*model.HistoryPage, error) {
+	var from *historyCursor
+	if q.Cursor != "" {
+		from = &historyCursor{}
+		if err := decodeCursor(q.Cursor, from); err != nil {
+			return nil, err
+		}
+		if from.Direction != model.HistoryBefore && from.Direction != model.HistoryAfter {
+			return nil, ErrInvalidCursor
+		}
+	}
+	direction := q.Direction
+	if direction == "" {
+		direction = model.HistoryBefore
+		if from != nil {
+			direction = from.Direction
+		}
+	}
+
+	// One more message than asked for is fetched to tell whether there is
+	// another page.
+	page := &model.HistoryPage{}
+	var err error
+	if direction == model.HistoryAfter {
+		var afterID int64
+		if from != nil {
+			afterID = from.ID
+		}
+		if page.Messages, err = r.GetMessagesAfter(ctx, afterID, q.Limit+1); err != nil {
+			return nil, err
+		}
+		if len(page.Messages) > q.Limit {
+			page.Messages = page.Messages[:q.Limit]
+			page.HasMore = true
+		}
+	} else {
+		beforeID := int64(math.MaxInt64)
+		if from != nil {
+			beforeID = from.ID
+		}
+		if page.Messages, err = r.GetMessagesBefore(ctx, beforeID, q.Limit+1); err != nil {
+			return nil, err
+		}
+		if len(page.Messages) > q.Limit {
+			page.Messages = page.Messages[1:]
+			page.HasMore = true
+		}
+	}
+	if len(page.Messages) == 0 {
+		return page, nil
+	}
+
+	oldest, newest := page.Messages[0].ID, page.Messages[len(page.Messages)-1].ID
+	if direction == model.HistoryAfter {
+		if page.HasMore {
+			page.Next = HistoryCursor(newest, model.HistoryAfter)
+		}
+		page.Prev = HistoryCursor(oldest, model.HistoryBefore)
+	} else {
+		if page.HasMore {
+			page.Next = HistoryCursor(oldest, model.HistoryBefore)
+		}
+		page.Prev = HistoryCursor(newest, model.HistoryAfter)
+	}
+	return page, nil
+}
+
+// HistoryCursor returns a cursor for paging history in direction from the
+// message with the given ID, which is not included.
+func HistoryCursor(id int64, direction string) string {
+	return encodeCursor(&historyCursor{ID: id, Direction: direction})
+}
+
+// GetMessagesBefore returns up to limit messages preceding beforeID,
+// oldest first.
+func (r *MessageRepository) GetMessagesBefore(ctx context.Context, beforeID int64, limit int) ([]model.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.queryTimeout)
 	defer cancel()
 
 	query := `
-		SELECT id, content, user_id, username, created_at
-		FROM messages
-		ORDER BY created_at DESC
-		LIMIT $1`
+        SELECT id, content, user_id, username, display_name, bot, created_at
+        FROM messages
+        WHERE id < $1
+        ORDER BY id DESC
+        LIMIT $2`
 
-	rows, err := r.db.QueryContext(ctx, query, limit)
+	rows, err := r.queryRead(ctx, query, beforeID, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var messages []model.Message
-	for rows.Next() {
-		var msg model.Message
-		if err := rows.Scan(
-			&msg.ID,
-			&msg.Content,
-			&msg.UserID,
-			&msg.Username,
-			&msg.CreatedAt,
-		); err != nil {
-			return nil, err
-		}
-		messages = append(messages, msg)
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
 	}
 
 	// Reverse the slice to get chronological order
@@ -105,24 +213,56 @@ func (r *MessageRepository) GetRecent(ctx context.Context, limit int) ([]model.M
 	return messages, nil
 }
 
-func (r *MessageRepository) GetMessagesBefore(ctx context.Context, beforeID int64, limit int) ([]model.Message, error) {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+// GetMessagesAfter returns up to limit messages following afterID, oldest
+// first. It is the forward counterpart of GetMessagesBefore.
+func (r *MessageRepository) GetMessagesAfter(ctx context.Context, afterID int64, limit int) ([]model.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.queryTimeout)
 	defer cancel()
 
 	query := `
-        SELECT id, content, user_id, username, created_at
+        SELECT id, content, user_id, username, display_name, bot, created_at
         FROM messages
-        WHERE id < $1
-        ORDER BY id DESC
+        WHERE id > $1
+        ORDER BY id
         LIMIT $2`
 
-	rows, err := r.db.QueryContext(ctx, query, beforeID, limit)
+	rows, err := r.queryRead(ctx, query, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMessages(rows)
+}
+
+// GetByID returns a single message, or ErrMessageNotFound.
+func (r *MessageRepository) GetByID(ctx context.Context, id int64) (*model.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.queryTimeout)
+	defer cancel()
+
+	query := `
+        SELECT id, content, user_id, username, display_name, bot, created_at
+        FROM messages
+        WHERE id = $1`
+
+	rows, err := r.queryRead(ctx, query, id)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var messages []model.Message
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, ErrMessageNotFound
+	}
+	return &messages[0], nil
+}
+
+func scanMessages(rows *sql.Rows) ([]model.Message, error) {
+	messages := []model.Message{}
 	for rows.Next() {
 		var msg model.Message
 		if err := rows.Scan(
@@ -130,18 +270,99 @@ func (r *MessageRepository) GetMessagesBefore(ctx context.Context, beforeID int6
 			&msg.Content,
 			&msg.UserID,
 			&msg.Username,
+			&msg.DisplayName,
+			&msg.Bot,
 			&msg.CreatedAt,
 		); err != nil {
 			return nil, err
 		}
 		messages = append(messages, msg)
 	}
+	return messages, rows.Err()
+}
 
-	// Reverse the slice to get chronological order
-	for i := 0; i < len(messages)/2; i++ {
-		j := len(messages) - i - 1
-		messages[i], messages[j] = messages[j], messages[i]
+// searchCursor is the position after the last result of a search page.
+type searchCursor struct {
+	Rank float32 `json:"r"`
+	ID   int64   `json:"id"`
+}
+
+// Search returns messages matching the query, best match first and newest
+// first among equal matches.
+func (r *MessageRepository) Search(ctx context.Context, q *model.SearchQuery) (*model.SearchResults, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.queryTimeout)
+	defer cancel()
+
+	var after *searchCursor
+	if q.Cursor != "" {
+		after = &searchCursor{}
+		if err := decodeCursor(q.Cursor, after); err != nil {
+			return nil, err
+		}
+	}
+	var afterRank, afterID interface{}
+	if after != nil {
+		afterRank, afterID = after.Rank, after.ID
+	}
+	var from, to interface{}
+	if !q.From.IsZero() {
+		from = q.From
+	}
+	if !q.To.IsZero() {
+		to = q.To
 	}
 
-	return messages, nil
+	// Content is escaped before highlighting so that the snippet is safe
+	// to show as HTML.
+	query := `
+		WITH q AS (SELECT websearch_to_tsquery('english', $1) AS query)
+		SELECT m.id, m.content, m.user_id, m.username, m.display_name, m.bot, m.created_at,
+			ts_headline('english',
+				replace(replace(replace(m.content, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'),
+				q.query, 'StartSel=<mark>, StopSel=</mark>, MinWords=10, MaxWords=30, MaxFragments=2'),
+			ts_rank(m.search, q.query) AS rank
+		FROM messages m, q
+		WHERE m.search @@ q.query
+			AND ($2 = '' OR m.username = $2)
+			AND ($3::timestamptz IS NULL OR m.created_at >= $3)
+			AND ($4::timestamptz IS NULL OR m.created_at <= $4)
+			AND ($5::real IS NULL OR (ts_rank(m.search, q.query), m.id) < ($5::real, $6::bigint))
+		ORDER BY rank DESC, m.id DESC
+		LIMIT $7`
+
+	rows, err := r.queryRead(ctx, query, q.Text, q.Author, from, to, afterRank, afterID, q.Limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := &model.SearchResults{Results: []model.SearchResult{}}
+	for rows.Next() {
+		var result model.SearchResult
+		if err := rows.Scan(
+			&result.Message.ID,
+			&result.Message.Content,
+			&result.Message.UserID,
+			&result.Message.Username,
+			&result.Message.DisplayName,
+			&result.Message.Bot,
+			&result.Message.CreatedAt,
+			&result.Snippet,
+			&result.Rank,
+		); err != nil {
+			return nil, err
+		}
+		results.Results = append(results.Results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(results.Results) > q.Limit {
+		results.Results = results.Results[:q.Limit]
+		last := results.Results[q.Limit-1]
+		results.Next = encodeCursor(&searchCursor{Rank: last.Rank, ID: last.Message.ID})
+		results.HasMore = true
+	}
+	return results, nil
 }
@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hdngo/whisper/internal/model"
+)
+
+var ErrPasskeyNotFound = errors.New("passkey not found")
+
+type PasskeyRepository struct {
+	db *sql.DB
+}
+
+func NewPasskeyRepository(db *sql.DB) *PasskeyRepository {
+	return &PasskeyRepository{db: db}
+}
+
+func (r *PasskeyRepository) Create(ctx context.Context, passkey *model.Passkey) error {
+	data, err := json.Marshal(passkey.Credential)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO webauthn_credentials (user_id, credential_id, name, data, created_at, last_used_at)
+		VALUES ($1, $2, $3, $4, $5, $5)
+		RETURNING id`
+
+	passkey.CreatedAt = time.Now().Unix()
+	passkey.LastUsedAt = passkey.CreatedAt
+	return r.db.QueryRowContext(
+		ctx,
+		query,
+		passkey.UserID,
+		passkey.Credential.ID,
+		passkey.Name,
+		data,
+		passkey.CreatedAt,
+	).Scan(&passkey.ID)
+}
+
+func (r *PasskeyRepository) GetByUserID(ctx context.Context, userID int64) ([]model.Passkey, error) {
+	query := `
+		SELECT id, user_id, name, data, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY id`
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []model.Passkey{}
+	for rows.Next() {
+		passkey, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, *passkey)
+	}
+
+	return passkeys, rows.Err()
+}
+
+func (r *PasskeyRepository) GetByCredentialID(ctx context.Context, credentialID []byte) (*model.Passkey, error) {
+	query := `
+		SELECT id, user_id, name, data, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE credential_id = $1`
+
+	passkey, err := scanPasskey(r.db.QueryRowContext(ctx, query, credentialID))
+	if err == sql.ErrNoRows {
+		return nil, ErrPasskeyNotFound
+	}
+	return passkey, err
+}
+
+// UpdateCredential stores the sign counter and flags from a login.
+func (r *PasskeyRepository) UpdateCredential(ctx context.Context, passkey *model.Passkey) error {
+	data, err := json.Marshal(passkey.Credential)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE webauthn_credentials SET data = $2, last_used_at = $3 WHERE id = $1`
+	passkey.LastUsedAt = time.Now().Unix()
+	_, err = r.db.ExecContext(ctx, query, passkey.ID, data, passkey.LastUsedAt)
+	return err
+}
+
+func (r *PasskeyRepository) Delete(ctx context.Context, userID, id int64) error {
+	query := `DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`
+
+	deleted, err := affectedOne(r.db.ExecContext(ctx, query, id, userID))
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPasskey(row rowScanner) (*model.Passkey, error) {
+	var passkey model.Passkey
+	var data []byte
+	if err := row.Scan(&passkey.ID, &passkey.UserID, &passkey.Name, &data, &passkey.CreatedAt, &passkey.LastUsedAt); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &passkey.Credential); err != nil {
+		return nil, err
+	}
+	return &passkey, nil
+}
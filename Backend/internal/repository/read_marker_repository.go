@@ -0,0 +1,44 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/hdngo/whisper/internal/model"
+)
+
+type ReadMarkerRepository struct {
+	db *sql.DB
+}
+
+func NewReadMarkerRepository(db *sql.DB) *ReadMarkerRepository {
+	return &ReadMarkerRepository{db: db}
+}
+
+// Advance moves the user's read marker forward to messageID, but never
+// past the newest message, and reports whether it moved.
+func (r *ReadMarkerRepository) Advance(ctx context.Context, userID, messageID int64) (bool, error) {
+	query := `
+		INSERT INTO read_markers (user_id, last_read_message_id, updated_at)
+		SELECT $1, LEAST($2, COALESCE(MAX(id), 0)), $3 FROM messages
+		ON CONFLICT (user_id) DO UPDATE
+		SET last_read_message_id = EXCLUDED.last_read_message_id, updated_at = EXCLUDED.updated_at
+		WHERE read_markers.last_read_message_id < EXCLUDED.last_read_message_id`
+
+	return affectedOne(r.db.ExecContext(ctx, query, userID, messageID, time.Now().Unix()))
+}
+
+// GetState returns the user's read marker, 0 if they have never read
+// anything, and the number of later messages sent by other users.
+func (r *ReadMarkerRepository) GetState(ctx context.Context, userID int64) (*model.ReadState, error) {
+	query := `
+		SELECT marker.id, (SELECT COUNT(*) FROM messages WHERE id > marker.id AND user_id <> $1)
+		FROM (SELECT COALESCE((SELECT last_read_message_id FROM read_markers WHERE user_id = $1), 0) AS id) marker`
+
+	var state model.ReadState
+	if err := r.db.QueryRowContext(ctx, query, userID).Scan(&state.LastReadMessageID, &state.Unread); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
@@ -9,6 +9,11 @@ import (
 	"github.com/hdngo/whisper/internal/model"
 )
 
+var (
+	ErrIdentityLinked = errors.New("identity is linked to another user")
+	ErrBotNotFound    = errors.New("bot not found")
+)
+
 type UserRepository struct {
 	db *sql.DB
 }
@@ -19,30 +24,52 @@ func NewUserRepository(db *sql.DB) *UserRepository {
 
 func (r *UserRepository) Create(ctx context.Context, user *model.User) error {
 	query := `
-		INSERT INTO users (username, password_hash, created_at)
-		VALUES ($1, $2, $3)
+		INSERT INTO users (username, display_name, password_hash, directory, created_at)
+		VALUES ($1, $2, $3, $4, $5)
 		RETURNING id`
 
 	return r.db.QueryRowContext(
 		ctx,
 		query,
 		user.Username,
+		user.DisplayName,
 		user.Password,
+		user.Directory,
 		time.Now().Unix(),
 	).Scan(&user.ID)
 }
 
 func (r *UserRepository) GetByUsername(ctx context.Context, username string) (*model.User, error) {
-	user := &model.User{}
 	query := `
-		SELECT id, username, password_hash, created_at
+		SELECT id, username, display_name, password_hash, totp_secret, totp_enabled, totp_last_step, is_bot, COALESCE(bot_owner_id, 0), directory, created_at
 		FROM users
 		WHERE username = $1`
 
-	err := r.db.QueryRowContext(ctx, query, username).Scan(
+	return scanUser(r.db.QueryRowContext(ctx, query, username))
+}
+
+func (r *UserRepository) GetByID(ctx context.Context, id int64) (*model.User, error) {
+	query := `
+		SELECT id, username, display_name, password_hash, totp_secret, totp_enabled, totp_last_step, is_bot, COALESCE(bot_owner_id, 0), directory, created_at
+		FROM users
+		WHERE id = $1`
+
+	return scanUser(r.db.QueryRowContext(ctx, query, id))
+}
+
+func scanUser(row *sql.Row) (*model.User, error) {
+	user := &model.User{}
+	err := row.Scan(
 		&user.ID,
 		&user.Username,
+		&user.DisplayName,
 		&user.Password,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.TOTPLastStep,
+		&user.IsBot,
+		&user.OwnerID,
+		&user.Directory,
 		&user.CreatedAt,
 	)
 
@@ -55,3 +82,253 @@ func (r *UserRepository) GetByUsername(ctx context.Context, username string) (*m
 
 	return user, nil
 }
+
+// SetPendingTOTPSecret stores a secret for a user who has not enabled
+// two-factor authentication yet. It does nothing once it is enabled.
+func (r *UserRepository) SetPendingTOTPSecret(ctx context.Context, userID int64, secret string) error {
+	query := `
+		UPDATE users SET totp_secret = $2, totp_last_step = 0
+		WHERE id = $1 AND NOT totp_enabled`
+
+	_, err := r.db.ExecContext(ctx, query, userID, secret)
+	return err
+}
+
+// EnableTOTP turns on two-factor authentication with the given recovery
+// code hashes, recording step as the last TOTP code used.
+func (r *UserRepository) EnableTOTP(ctx context.Context, userID int64, step int64, recoveryHashes []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users SET totp_enabled = TRUE, totp_last_step = $2
+		WHERE id = $1 AND totp_secret <> ''`
+
+	if _, err := tx.ExecContext(ctx, query, userID, step); err != nil {
+		return err
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DisableTOTP turns off two-factor authentication and deletes the secret
+// and recovery codes.
+func (r *UserRepository) DisableTOTP(ctx context.Context, userID int64) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users SET totp_enabled = FALSE, totp_secret = '', totp_last_step = 0
+		WHERE id = $1`
+
+	if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+		return err
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, nil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes discards a user's recovery codes in favour of new
+// ones.
+func (r *UserRepository) ReplaceRecoveryCodes(ctx context.Context, userID int64, recoveryHashes []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int64, recoveryHashes []string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	for _, hash := range recoveryHashes {
+		query := `INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`
+		if _, err := tx.ExecContext(ctx, query, userID, hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UseTOTPStep records step as the last TOTP code used by the user, failing
+// if that code or a later one was already used.
+func (r *UserRepository) UseTOTPStep(ctx context.Context, userID int64, step int64) (bool, error) {
+	query := `
+		UPDATE users SET totp_last_step = $2
+		WHERE id = $1 AND totp_last_step < $2`
+
+	return affectedOne(r.db.ExecContext(ctx, query, userID, step))
+}
+
+// UseRecoveryCode marks an unused recovery code as used and reports whether
+// there was one.
+func (r *UserRepository) UseRecoveryCode(ctx context.Context, userID int64, hash string) (bool, error) {
+	query := `
+		UPDATE recovery_codes SET used_at = $3
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+
+	return affectedOne(r.db.ExecContext(ctx, query, userID, hash, time.Now().Unix()))
+}
+
+// GetByIdentity returns the user linked to the account subject at the
+// OpenID Connect provider issuer.
+func (r *UserRepository) GetByIdentity(ctx context.Context, issuer, subject string) (*model.User, error) {
+	query := `
+		SELECT u.id, u.username, u.display_name, u.password_hash, u.totp_secret, u.totp_enabled, u.totp_last_step, u.is_bot, COALESCE(u.bot_owner_id, 0), u.directory, u.created_at
+		FROM users u
+		JOIN user_identities i ON i.user_id = u.id
+		WHERE i.issuer = $1 AND i.subject = $2`
+
+	return scanUser(r.db.QueryRowContext(ctx, query, issuer, subject))
+}
+
+// CreateWithIdentity creates a user who signed in through an OpenID Connect
+// provider, linked to their account there.
+func (r *UserRepository) CreateWithIdentity(ctx context.Context, user *model.User, issuer, subject string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO users (username, display_name, password_hash, created_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id`
+
+	err = tx.QueryRowContext(ctx, query, user.Username, user.DisplayName, user.Password, user.CreatedAt).Scan(&user.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := linkIdentity(ctx, tx, user.ID, issuer, subject); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// LinkIdentity lets a user sign in with their account subject at the OpenID
+// Connect provider issuer. It fails with ErrIdentityLinked if that account
+// already belongs to another user.
+func (r *UserRepository) LinkIdentity(ctx context.Context, userID int64, issuer, subject string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := linkIdentity(ctx, tx, userID, issuer, subject); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func linkIdentity(ctx context.Context, tx *sql.Tx, userID int64, issuer, subject string) error {
+	query := `
+		INSERT INTO user_identities (user_id, issuer, subject, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (issuer, subject) DO UPDATE SET issuer = EXCLUDED.issuer
+		RETURNING user_id`
+
+	var owner int64
+	if err := tx.QueryRowContext(ctx, query, userID, issuer, subject, time.Now().Unix()).Scan(&owner); err != nil {
+		return err
+	}
+	if owner != userID {
+		return ErrIdentityLinked
+	}
+	return nil
+}
+
+// UpdateDisplayName stores the name shown for a user.
+func (r *UserRepository) UpdateDisplayName(ctx context.Context, userID int64, displayName string) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE users SET display_name = $2 WHERE id = $1`, userID, displayName)
+	return err
+}
+
+// CreateBot creates a bot account owned by user.OwnerID.
+func (r *UserRepository) CreateBot(ctx context.Context, user *model.User) error {
+	query := `
+		INSERT INTO users (username, display_name, password_hash, is_bot, bot_owner_id, created_at)
+		VALUES ($1, $2, '', TRUE, $3, $4)
+		RETURNING id`
+
+	user.IsBot = true
+	user.CreatedAt = time.Now().Unix()
+	return r.db.QueryRowContext(ctx, query, user.Username, user.DisplayName, user.OwnerID, user.CreatedAt).Scan(&user.ID)
+}
+
+// GetBotsByOwner returns the bots owned by a user, oldest first.
+func (r *UserRepository) GetBotsByOwner(ctx context.Context, ownerID int64) ([]model.User, error) {
+	query := `
+		SELECT id, username, display_name, created_at
+		FROM users
+		WHERE is_bot AND bot_owner_id = $1
+		ORDER BY id`
+
+	rows, err := r.db.QueryContext(ctx, query, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bots := []model.User{}
+	for rows.Next() {
+		bot := model.User{IsBot: true, OwnerID: ownerID}
+		if err := rows.Scan(&bot.ID, &bot.Username, &bot.DisplayName, &bot.CreatedAt); err != nil {
+			return nil, err
+		}
+		bots = append(bots, bot)
+	}
+
+	return bots, rows.Err()
+}
+
+// GetBot returns the bot botID if it is owned by ownerID.
+func (r *UserRepository) GetBot(ctx context.Context, ownerID, botID int64) (*model.User, error) {
+	user, err := r.GetByID(ctx, botID)
+	if err != nil {
+		return nil, ErrBotNotFound
+	}
+	if !user.IsBot || user.OwnerID != ownerID {
+		return nil, ErrBotNotFound
+	}
+	return user, nil
+}
+
+func affectedOne(result sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
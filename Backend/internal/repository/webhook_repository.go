@@ -0,0 +1,143 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/hdngo/whisper/internal/model"
+)
+
+var ErrDeliveryNotFound = errors.New("webhook delivery not found")
+
+// WebhookRepository is the durable queue and delivery log of outgoing
+// webhooks.
+type WebhookRepository struct {
+	db *sql.DB
+}
+
+func NewWebhookRepository(db *sql.DB) *WebhookRepository {
+	return &WebhookRepository{db: db}
+}
+
+// Enqueue adds a delivery of payload to the named webhook, due now.
+func (r *WebhookRepository) Enqueue(ctx context.Context, webhook, event string, payload []byte) error {
+	query := `
+		INSERT INTO webhook_deliveries (webhook, event, payload, status, created_at, next_attempt_at)
+		VALUES ($1, $2, $3, $4, $5, $5)`
+
+	_, err := r.db.ExecContext(ctx, query, webhook, event, payload, model.DeliveryPending, time.Now().Unix())
+	return err
+}
+
+// ClaimDue returns up to limit pending deliveries that are due, pushing
+// their next attempt back by lease so that no other worker picks them up
+// while they are being sent.
+func (r *WebhookRepository) ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]model.WebhookDelivery, error) {
+	now := time.Now()
+	query := `
+		UPDATE webhook_deliveries
+		SET next_attempt_at = $2
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $3 AND next_attempt_at <= $1
+			ORDER BY next_attempt_at, id
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + deliveryColumns
+
+	rows, err := r.db.QueryContext(ctx, query, now.Unix(), now.Add(lease).Unix(), model.DeliveryPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+// RecordAttempt stores the outcome of an attempt to send a delivery.
+func (r *WebhookRepository) RecordAttempt(ctx context.Context, delivery *model.WebhookDelivery) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, response_status = $4, last_error = $5, next_attempt_at = $6, delivered_at = $7
+		WHERE id = $1`
+
+	_, err := r.db.ExecContext(
+		ctx,
+		query,
+		delivery.ID,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.ResponseStatus,
+		delivery.LastError,
+		delivery.NextAttemptAt,
+		delivery.DeliveredAt,
+	)
+	return err
+}
+
+// GetRecent returns the latest deliveries, newest first, optionally only
+// those with the given status or to the given webhook.
+func (r *WebhookRepository) GetRecent(ctx context.Context, status, webhook string, limit int) ([]model.WebhookDelivery, error) {
+	query := `
+		SELECT ` + deliveryColumns + `
+		FROM webhook_deliveries
+		WHERE ($1::text = '' OR status = $1) AND ($2::text = '' OR webhook = $2)
+		ORDER BY id DESC
+		LIMIT $3`
+
+	rows, err := r.db.QueryContext(ctx, query, status, webhook, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+// Requeue moves a dead-lettered delivery back into the queue with a fresh
+// set of attempts.
+func (r *WebhookRepository) Requeue(ctx context.Context, id int64) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = 0, next_attempt_at = $3
+		WHERE id = $1 AND status = $4`
+
+	requeued, err := affectedOne(r.db.ExecContext(ctx, query, id, model.DeliveryPending, time.Now().Unix(), model.DeliveryDead))
+	if err != nil {
+		return err
+	}
+	if !requeued {
+		return ErrDeliveryNotFound
+	}
+	return nil
+}
+
+const deliveryColumns = `id, webhook, event, payload, status, attempts, response_status, last_error, created_at, next_attempt_at, delivered_at`
+
+func scanDeliveries(rows *sql.Rows) ([]model.WebhookDelivery, error) {
+	defer rows.Close()
+
+	deliveries := []model.WebhookDelivery{}
+	for rows.Next() {
+		var d model.WebhookDelivery
+		var payload []byte
+		if err := rows.Scan(
+			&d.ID,
+			&d.Webhook,
+			&d.Event,
+			&payload,
+			&d.Status,
+			&d.Attempts,
+			&d.ResponseStatus,
+			&d.LastError,
+			&d.CreatedAt,
+			&d.NextAttemptAt,
+			&d.DeliveredAt,
+		); err != nil {
+			return nil, err
+		}
+		d.Payload = payload
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
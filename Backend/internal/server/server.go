@@ -0,0 +1,93 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/hdngo/whisper/internal/config"
+)
+
+// ListenAndServe serves handler on the configured TCP port, over TLS (with
+// HTTP/2) when a certificate is configured, and additionally as plain HTTP
+// on the Unix domain socket if one is configured. It blocks until a
+// listener fails.
+func ListenAndServe(cfg config.ServerConfig, handler http.Handler) error {
+	errs := make(chan error, 2)
+
+	tcpListener, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.Port))
+	if err != nil {
+		return err
+	}
+
+	tcpServer := &http.Server{Handler: handler}
+
+	if cfg.TLS.Enabled() {
+		certs, err := NewCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			tcpListener.Close()
+			return fmt.Errorf("error loading TLS certificate: %v", err)
+		}
+
+		tcpServer.TLSConfig, err = NewTLSConfig(cfg.TLS, certs)
+		if err != nil {
+			tcpListener.Close()
+			return err
+		}
+
+		done := make(chan struct{})
+		defer close(done)
+		go certs.Watch(cfg.TLS.ReloadInterval, done)
+
+		log.Printf("Server starting on %s (TLS)", tcpListener.Addr())
+		go func() {
+			// ServeTLS enables HTTP/2 via ALPN since TLSNextProto is unset.
+			errs <- tcpServer.ServeTLS(tcpListener, "", "")
+		}()
+	} else {
+		log.Printf("Server starting on %s", tcpListener.Addr())
+		go func() {
+			errs <- tcpServer.Serve(tcpListener)
+		}()
+	}
+
+	if cfg.UnixSocket != "" {
+		unixListener, err := listenUnix(cfg.UnixSocket)
+		if err != nil {
+			tcpServer.Close()
+			return err
+		}
+
+		unixServer := &http.Server{Handler: handler}
+		defer unixServer.Close()
+
+		log.Printf("Server starting on unix:%s", cfg.UnixSocket)
+		go func() {
+			errs <- unixServer.Serve(unixListener)
+		}()
+	}
+
+	err = <-errs
+	tcpServer.Close()
+	return err
+}
+
+// listenUnix listens on path, first removing a socket left behind by a
+// previous run. Any other kind of file at path is left alone.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return net.Listen("unix", path)
+}
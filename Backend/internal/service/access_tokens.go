@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/repository"
+	"github.com/hdngo/whisper/internal/token"
+)
+
+var ErrAccessTokenNotFound = errors.New("access token not found")
+
+// AccessTokenRequestError rejects a request for a new personal access token.
+type AccessTokenRequestError struct {
+	Reason string
+}
+
+func (e *AccessTokenRequestError) Error() string {
+	return e.Reason
+}
+
+// CreateAccessToken issues a personal access token with the requested
+// scopes. The token is returned only this once; just its hash is stored.
+func (s *AuthService) CreateAccessToken(ctx context.Context, userID int64, req *model.CreateAccessTokenRequest) (*model.CreatedAccessToken, error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > 255 {
+		return nil, &AccessTokenRequestError{Reason: "token name must be 1 to 255 characters long"}
+	}
+	if len(req.Scopes) == 0 {
+		return nil, &AccessTokenRequestError{Reason: "at least one scope is required"}
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(token.Scopes, scope) {
+			return nil, &AccessTokenRequestError{Reason: fmt.Sprintf("unknown scope %q, expected one of %s", scope, strings.Join(token.Scopes, ", "))}
+		}
+	}
+
+	now := s.now()
+	maxTTL := s.cfg.PersonalTokenMaxTTL
+	switch {
+	case req.ExpiresAt == 0 && maxTTL > 0:
+		return nil, &AccessTokenRequestError{Reason: fmt.Sprintf("tokens must expire within %s", maxTTL)}
+	case req.ExpiresAt != 0 && !time.Unix(req.ExpiresAt, 0).After(now):
+		return nil, &AccessTokenRequestError{Reason: "expiry must be in the future"}
+	case req.ExpiresAt != 0 && maxTTL > 0 && time.Unix(req.ExpiresAt, 0).After(now.Add(maxTTL)):
+		return nil, &AccessTokenRequestError{Reason: fmt.Sprintf("tokens must expire within %s", maxTTL)}
+	}
+
+	personalToken, err := token.NewPersonal()
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken := model.AccessToken{
+		UserID:    userID,
+		Name:      name,
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+		ExpiresAt: req.ExpiresAt,
+	}
+	if err := s.accessTokenRepo.Create(ctx, &accessToken, token.Hash(personalToken)); err != nil {
+		return nil, err
+	}
+
+	return &model.CreatedAccessToken{AccessToken: accessToken, Token: personalToken}, nil
+}
+
+func (s *AuthService) ListAccessTokens(ctx context.Context, userID int64) ([]model.AccessToken, error) {
+	return s.accessTokenRepo.GetByUserID(ctx, userID)
+}
+
+// RevokeAccessToken deletes one of the user's personal access tokens and
+// disconnects the websocket clients using it.
+func (s *AuthService) RevokeAccessToken(ctx context.Context, userID, tokenID int64) error {
+	err := s.accessTokenRepo.Delete(ctx, userID, tokenID)
+	if errors.Is(err, repository.ErrAccessTokenNotFound) {
+		return ErrAccessTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	s.revoker.DisconnectSessions(token.PersonalSessionID(tokenID))
+	return nil
+}
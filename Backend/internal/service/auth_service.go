@@ -3,40 +3,93 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
+	"sort"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/hdngo/whisper/internal/cache"
+	"github.com/hdngo/whisper/internal/config"
 	"github.com/hdngo/whisper/internal/model"
 	"github.com/hdngo/whisper/internal/repository"
+	"github.com/hdngo/whisper/internal/token"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrSessionNotFound     = errors.New("session not found")
+)
+
+// SessionRevoker is told about revoked sessions so that live connections
+// bound to them can be closed.
+type SessionRevoker interface {
+	DisconnectSessions(sessionIDs ...string)
+}
+
 type AuthService struct {
-	userRepo    *repository.UserRepository
-	redisClient *cache.RedisClient
-	jwtSecret   string
+	userRepo        *repository.UserRepository
+	passkeyRepo     *repository.PasskeyRepository
+	accessTokenRepo *repository.AccessTokenRepository
+	redisClient     *cache.RedisClient
+	tokens          *token.Manager
+	revoker         SessionRevoker
+	throttle        *LoginThrottle
+	directory       CredentialVerifier
+	webAuthn        *webauthn.WebAuthn
+	oidc            *oidcClient
+	cfg             config.AuthConfig
+	now             func() time.Time
+	twoFactor       *twoFactor
 }
 
-func NewAuthService(userRepo *repository.UserRepository, redisClient *cache.RedisClient, jwtSecret string) *AuthService {
-	return &AuthService{
-		userRepo:    userRepo,
-		redisClient: redisClient,
-		jwtSecret:   jwtSecret,
+func NewAuthService(userRepo *repository.UserRepository, passkeyRepo *repository.PasskeyRepository, accessTokenRepo *repository.AccessTokenRepository, redisClient *cache.RedisClient, tokens *token.Manager, revoker SessionRevoker, throttle *LoginThrottle, directory CredentialVerifier, cfg config.AuthConfig) (*AuthService, error) {
+	webAuthn, err := newWebAuthn(cfg.WebAuthn)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: %w", err)
+	}
+
+	var oidcClient *oidcClient
+	if cfg.OIDC.Enabled() {
+		oidcClient = newOIDCClient(cfg.OIDC)
+	}
+
+	s := &AuthService{
+		userRepo:        userRepo,
+		passkeyRepo:     passkeyRepo,
+		accessTokenRepo: accessTokenRepo,
+		redisClient:     redisClient,
+		tokens:          tokens,
+		revoker:         revoker,
+		throttle:        throttle,
+		directory:       directory,
+		webAuthn:        webAuthn,
+		oidc:            oidcClient,
+		cfg:             cfg,
+		now:             time.Now,
 	}
+	s.twoFactor = &twoFactor{
+		users:      userRepo,
+		challenges: redisClient,
+		throttle:   throttle,
+		cfg:        cfg.TwoFactor,
+		now:        func() time.Time { return s.now() },
+	}
+	return s, nil
 }
 
-func (s *AuthService) Register(ctx context.Context, req *model.RegisterRequest) (*model.AuthResponse, error) {
+func (s *AuthService) Register(ctx context.Context, req *model.RegisterRequest, device model.DeviceInfo) (*model.AuthResponse, error) {
 	if _, err := s.userRepo.GetByUsername(ctx, req.Username); err == nil {
 		return nil, errors.New("username already exists")
 	}
 
-	if len(req.Username) < 4 {
-		return nil, errors.New("username must be at least 4 characters long")
+	if len(req.Username) < s.cfg.MinUsernameLength {
+		return nil, fmt.Errorf("username must be at least %d characters long", s.cfg.MinUsernameLength)
 	}
 
-	if len(req.Password) < 6 {
-		return nil, errors.New("password must be at least 6 characters long")
+	if len(req.Password) < s.cfg.MinPasswordLength {
+		return nil, fmt.Errorf("password must be at least %d characters long", s.cfg.MinPasswordLength)
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
@@ -55,61 +108,177 @@ func (s *AuthService) Register(ctx context.Context, req *model.RegisterRequest)
 		return nil, err
 	}
 
-	token, err := s.generateToken(user)
+	return s.createSession(ctx, user, device)
+}
 
-	if err != nil {
+// Login checks the user's password, against the directory if one is
+// configured and then local accounts, and starts a new session, or for
+// users with two-factor authentication a challenge to finish with
+// VerifyMFA.
+// Repeated failures are throttled; see LoginThrottle.
+func (s *AuthService) Login(ctx context.Context, req *model.LoginRequest, device model.DeviceInfo) (*model.AuthResponse, error) {
+	if err := s.throttle.Check(ctx, req.Username, device.IP); err != nil {
 		return nil, err
 	}
 
-	if err := s.redisClient.StoreSession(ctx, user.ID, token); err != nil {
+	user, err := s.verifyPassword(ctx, req.Username, req.Password)
+	if errors.Is(err, errInvalidCredentials) {
+		s.throttle.Fail(ctx, req.Username, device.IP)
+		return nil, err
+	}
+	if err != nil {
 		return nil, err
 	}
 
-	return &model.AuthResponse{
-		Token:    token,
-		Username: user.Username,
-	}, nil
+	if user.TOTPEnabled {
+		return s.startChallenge(ctx, user)
+	}
+
+	s.throttle.Succeed(ctx, user.Username)
+	return s.createSession(ctx, user, device)
 }
 
-func (s *AuthService) Login(ctx context.Context, req *model.LoginRequest) (*model.AuthResponse, error) {
-	user, err := s.userRepo.GetByUsername(ctx, req.Username)
+// Refresh exchanges a refresh token for a new access token and a new refresh
+// token. Each refresh token can be used once; presenting one that has
+// already been exchanged revokes the whole session, since either the client
+// or an attacker holds a stolen copy.
+func (s *AuthService) Refresh(ctx context.Context, refreshToken string) (*model.AuthResponse, error) {
+	newRefreshToken, err := token.NewOpaque()
 	if err != nil {
-		return nil, errors.New("invalid credentials")
+		return nil, err
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		return nil, errors.New("invalid credentials")
+	session, err := s.redisClient.RotateRefreshToken(ctx, token.Hash(refreshToken), token.Hash(newRefreshToken))
+	if errors.Is(err, cache.ErrRefreshTokenReused) {
+		log.Printf("refresh token reuse detected for user %d, revoking session %s", session.UserID, session.ID)
+		if err := s.redisClient.DeleteSession(ctx, session); err != nil {
+			return nil, err
+		}
+		s.revoker.DisconnectSessions(session.ID)
+		return nil, ErrInvalidRefreshToken
 	}
+	if errors.Is(err, cache.ErrSessionNotFound) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.issueTokens(session, newRefreshToken)
+}
 
-	if err := s.redisClient.DeleteSession(ctx, user.ID); err != nil {
+// Logout ends the session the request was made with. Other devices stay
+// logged in.
+func (s *AuthService) Logout(ctx context.Context, userID int64, sessionID string) error {
+	return s.RevokeSession(ctx, userID, sessionID)
+}
+
+// ListSessions returns the user's sessions, most recently used first, with
+// the caller's own session marked as current.
+func (s *AuthService) ListSessions(ctx context.Context, userID int64, currentSessionID string) ([]model.Session, error) {
+	sessions, err := s.redisClient.GetUserSessions(ctx, userID)
+	if err != nil {
 		return nil, err
 	}
 
-	token, err := s.generateToken(user)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSessionID
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt > sessions[j].LastUsedAt
+	})
+
+	return sessions, nil
+}
+
+// RevokeSession ends one of the user's sessions and disconnects its
+// websocket clients.
+func (s *AuthService) RevokeSession(ctx context.Context, userID int64, sessionID string) error {
+	session, err := s.redisClient.GetSession(ctx, sessionID)
+	if errors.Is(err, cache.ErrSessionNotFound) || (err == nil && session.UserID != userID) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.redisClient.DeleteSession(ctx, session); err != nil {
+		return err
+	}
+
+	s.revoker.DisconnectSessions(sessionID)
+	return nil
+}
+
+// RevokeOtherSessions ends every session of the user except the current one
+// and returns how many were revoked.
+func (s *AuthService) RevokeOtherSessions(ctx context.Context, userID int64, currentSessionID string) (int, error) {
+	sessions, err := s.redisClient.GetUserSessions(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	var revoked []string
+	for i := range sessions {
+		if sessions[i].ID == currentSessionID {
+			continue
+		}
+		if err := s.redisClient.DeleteSession(ctx, &sessions[i]); err != nil {
+			return len(revoked), err
+		}
+		revoked = append(revoked, sessions[i].ID)
+	}
+
+	s.revoker.DisconnectSessions(revoked...)
+	return len(revoked), nil
+}
+
+func (s *AuthService) createSession(ctx context.Context, user *model.User, device model.DeviceInfo) (*model.AuthResponse, error) {
+	sessionID, err := token.NewID()
 	if err != nil {
 		return nil, err
 	}
 
-	if err := s.redisClient.StoreSession(ctx, user.ID, token); err != nil {
+	refreshToken, err := token.NewOpaque()
+	if err != nil {
 		return nil, err
 	}
 
-	return &model.AuthResponse{
-		Token:    token,
-		Username: user.Username,
-	}, nil
-}
+	now := time.Now().Unix()
+	session := &model.Session{
+		ID:          sessionID,
+		UserID:      user.ID,
+		Username:    user.Username,
+		RefreshHash: token.Hash(refreshToken),
+		UserAgent:   device.UserAgent,
+		IP:          device.IP,
+		CreatedAt:   now,
+		LastUsedAt:  now,
+	}
 
-func (s *AuthService) Logout(ctx context.Context, userID int64) error {
-	return s.redisClient.DeleteSession(ctx, userID)
+	if err := s.redisClient.CreateSession(ctx, session); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.issueTokens(session, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	resp.DisplayName = user.DisplayName
+	return resp, nil
 }
 
-func (s *AuthService) generateToken(user *model.User) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id":  user.ID,
-		"username": user.Username,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(),
-	})
+func (s *AuthService) issueTokens(session *model.Session, refreshToken string) (*model.AuthResponse, error) {
+	accessToken, expiresAt, err := s.tokens.Issue(session.UserID, session.Username, session.ID)
+	if err != nil {
+		return nil, err
+	}
 
-	return token.SignedString([]byte(s.jwtSecret))
+	return &model.AuthResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiresAt.Unix(),
+		Username:     session.Username,
+	}, nil
 }
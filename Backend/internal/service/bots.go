@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/token"
+)
+
+var ErrBotUsernameTaken = errors.New("username already exists")
+
+// BotRequestError rejects a request for a new bot.
+type BotRequestError struct {
+	Reason string
+}
+
+func (e *BotRequestError) Error() string {
+	return e.Reason
+}
+
+// CreateBot creates a bot account owned by the user. Bots cannot log in;
+// their owner issues them personal access tokens with CreateBotToken.
+func (s *AuthService) CreateBot(ctx context.Context, ownerID int64, req *model.CreateBotRequest) (*model.User, error) {
+	if len(req.Username) < s.cfg.MinUsernameLength {
+		return nil, &BotRequestError{Reason: fmt.Sprintf("username must be at least %d characters long", s.cfg.MinUsernameLength)}
+	}
+	if _, err := s.userRepo.GetByUsername(ctx, req.Username); err == nil {
+		return nil, ErrBotUsernameTaken
+	}
+
+	bot := &model.User{
+		Username:    req.Username,
+		DisplayName: req.DisplayName,
+		OwnerID:     ownerID,
+	}
+	if err := s.userRepo.CreateBot(ctx, bot); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Created bot %s for user %d", bot.Username, ownerID)
+	return bot, nil
+}
+
+func (s *AuthService) ListBots(ctx context.Context, ownerID int64) ([]model.User, error) {
+	return s.userRepo.GetBotsByOwner(ctx, ownerID)
+}
+
+// CreateBotToken issues a personal access token for one of the user's bots.
+// Bots are never admins, so they cannot be given the admin scope.
+func (s *AuthService) CreateBotToken(ctx context.Context, ownerID, botID int64, req *model.CreateAccessTokenRequest) (*model.CreatedAccessToken, error) {
+	if _, err := s.userRepo.GetBot(ctx, ownerID, botID); err != nil {
+		return nil, err
+	}
+	if slices.Contains(req.Scopes, token.ScopeAdmin) {
+		return nil, &AccessTokenRequestError{Reason: "bots cannot be given the " + token.ScopeAdmin + " scope"}
+	}
+
+	return s.CreateAccessToken(ctx, botID, req)
+}
+
+func (s *AuthService) ListBotTokens(ctx context.Context, ownerID, botID int64) ([]model.AccessToken, error) {
+	if _, err := s.userRepo.GetBot(ctx, ownerID, botID); err != nil {
+		return nil, err
+	}
+
+	return s.ListAccessTokens(ctx, botID)
+}
+
+func (s *AuthService) RevokeBotToken(ctx context.Context, ownerID, botID, tokenID int64) error {
+	if _, err := s.userRepo.GetBot(ctx, ownerID, botID); err != nil {
+		return err
+	}
+
+	return s.RevokeAccessToken(ctx, botID, tokenID)
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/hdngo/whisper/internal/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// CredentialVerifier checks passwords against a directory of users kept
+// outside the database, such as LDAP. Verify reports ok = false when the
+// directory does not accept the password, and an error when it cannot be
+// asked.
+type CredentialVerifier interface {
+	Verify(ctx context.Context, username, password string) (user *model.DirectoryUser, ok bool, err error)
+}
+
+// verifyPassword returns the user with the given username and password.
+// The directory, if any, is asked first; local accounts are checked when
+// it rejects the password or is unreachable.
+func (s *AuthService) verifyPassword(ctx context.Context, username, password string) (*model.User, error) {
+	if s.directory != nil {
+		entry, ok, err := s.directory.Verify(ctx, username, password)
+		if err != nil {
+			log.Printf("error checking %s against the directory: %v", username, err)
+		} else if ok {
+			return s.directoryUser(ctx, entry)
+		}
+	}
+
+	user, err := s.userRepo.GetByUsername(ctx, username)
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+
+	// Accounts created through single sign-on or a directory have no
+	// password of their own.
+	if user.Password == "" {
+		return nil, errInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return nil, errInvalidCredentials
+	}
+
+	return user, nil
+}
+
+// directoryUser returns the local account of a directory user, creating
+// it on their first login and keeping the display name up to date. An
+// account of the same name that was not created from the directory, such
+// as a local account with a password, is never signed in as.
+func (s *AuthService) directoryUser(ctx context.Context, entry *model.DirectoryUser) (*model.User, error) {
+	user, err := s.userRepo.GetByUsername(ctx, entry.Username)
+	if err == nil && (!user.Directory || user.Password != "") {
+		log.Printf("directory user %s has the name of an account not created from the directory", entry.Username)
+		return nil, errInvalidCredentials
+	}
+	if err == nil {
+		if entry.DisplayName != "" && entry.DisplayName != user.DisplayName {
+			if err := s.userRepo.UpdateDisplayName(ctx, user.ID, entry.DisplayName); err != nil {
+				return nil, err
+			}
+			user.DisplayName = entry.DisplayName
+		}
+		return user, nil
+	}
+
+	user = &model.User{
+		Username:    entry.Username,
+		DisplayName: entry.DisplayName,
+		Directory:   true,
+		CreatedAt:   time.Now().Unix(),
+	}
+	if err := s.userRepo.Create(ctx, user); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Created user %s from the directory", user.Username)
+	return user, nil
+}
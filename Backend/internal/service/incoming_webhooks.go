@@ -0,0 +1,242 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hdngo/whisper/internal/config"
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/repository"
+	"github.com/hdngo/whisper/internal/token"
+)
+
+var (
+	ErrEmptyWebhookMessage  = errors.New("no text")
+	ErrWebhookDisplayName   = errors.New("username must be at most 255 characters long")
+	ErrInvalidWebhookToken  = errors.New("invalid token")
+	ErrWebhookUsernameTaken = errors.New("username already exists")
+)
+
+// IncomingWebhookRequestError rejects a request for a new incoming webhook.
+type IncomingWebhookRequestError struct {
+	Reason string
+}
+
+func (e *IncomingWebhookRequestError) Error() string {
+	return e.Reason
+}
+
+// WebhookRateLimitedError refuses a message sent to an incoming webhook
+// faster than its bot may post.
+type WebhookRateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *WebhookRateLimitedError) Error() string {
+	return "sending messages too fast"
+}
+
+// MessagePoster broadcasts and stores chat messages. AllowPost counts a
+// message against the user's rate limit.
+type MessagePoster interface {
+	Post(msg *model.Message) error
+	AllowPost(userID int64) (ok bool, retryAfter time.Duration)
+}
+
+// IncomingWebhooks manages incoming webhook URLs and turns the
+// Slack-style payloads posted to them into chat messages.
+type IncomingWebhooks struct {
+	repo     *repository.IncomingWebhookRepository
+	userRepo *repository.UserRepository
+	poster   MessagePoster
+	cfg      config.AuthConfig
+}
+
+func NewIncomingWebhooks(repo *repository.IncomingWebhookRepository, userRepo *repository.UserRepository, poster MessagePoster, cfg config.AuthConfig) *IncomingWebhooks {
+	return &IncomingWebhooks{
+		repo:     repo,
+		userRepo: userRepo,
+		poster:   poster,
+		cfg:      cfg,
+	}
+}
+
+// Create adds an incoming webhook posting as a new bot owned by the admin
+// and returns its token, which is shown only this once.
+func (s *IncomingWebhooks) Create(ctx context.Context, adminID int64, admin string, req *model.CreateIncomingWebhookRequest) (*model.IncomingWebhook, string, error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > 255 {
+		return nil, "", &IncomingWebhookRequestError{Reason: "webhook name must be 1 to 255 characters long"}
+	}
+	if len(req.Username) < s.cfg.MinUsernameLength {
+		return nil, "", &IncomingWebhookRequestError{Reason: fmt.Sprintf("username must be at least %d characters long", s.cfg.MinUsernameLength)}
+	}
+	if _, err := s.userRepo.GetByUsername(ctx, req.Username); err == nil {
+		return nil, "", ErrWebhookUsernameTaken
+	}
+
+	hookToken, err := token.NewOpaque()
+	if err != nil {
+		return nil, "", err
+	}
+
+	bot := &model.User{
+		Username:    req.Username,
+		DisplayName: name,
+		OwnerID:     adminID,
+	}
+	if err := s.userRepo.CreateBot(ctx, bot); err != nil {
+		return nil, "", err
+	}
+
+	hook := &model.IncomingWebhook{
+		Name:      name,
+		UserID:    bot.ID,
+		Username:  bot.Username,
+		CreatedBy: admin,
+	}
+	if err := s.repo.Create(ctx, hook, token.Hash(hookToken)); err != nil {
+		return nil, "", err
+	}
+
+	log.Printf("Created incoming webhook %s posting as %s for %s", hook.Name, hook.Username, admin)
+	return hook, hookToken, nil
+}
+
+func (s *IncomingWebhooks) List(ctx context.Context) ([]model.IncomingWebhook, error) {
+	return s.repo.GetAll(ctx)
+}
+
+// Rotate gives the webhook a new token, so that its old URL stops working.
+func (s *IncomingWebhooks) Rotate(ctx context.Context, id int64) (*model.IncomingWebhook, string, error) {
+	hook, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hookToken, err := token.NewOpaque()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.repo.SetToken(ctx, id, token.Hash(hookToken)); err != nil {
+		return nil, "", err
+	}
+
+	return hook, hookToken, nil
+}
+
+// Delete removes the webhook. Its bot account is kept, since its messages
+// stay in the history.
+func (s *IncomingWebhooks) Delete(ctx context.Context, id int64) error {
+	return s.repo.Delete(ctx, id)
+}
+
+// Receive posts the Slack-style message sent to the webhook with the given
+// token.
+func (s *IncomingWebhooks) Receive(ctx context.Context, hookToken string, msg *model.SlackMessage) error {
+	hook, err := s.repo.GetByHash(ctx, token.Hash(hookToken))
+	if errors.Is(err, repository.ErrIncomingWebhookNotFound) {
+		return ErrInvalidWebhookToken
+	}
+	if err != nil {
+		return err
+	}
+
+	content := slackContent(msg)
+	if content == "" {
+		return ErrEmptyWebhookMessage
+	}
+
+	// The Slack username is only shown; the message is always from the
+	// webhook's bot, so that it cannot pass for another user's.
+	displayName := strings.TrimSpace(msg.Username)
+	if len(displayName) > 255 {
+		return ErrWebhookDisplayName
+	}
+	if ok, retryAfter := s.poster.AllowPost(hook.UserID); !ok {
+		return &WebhookRateLimitedError{RetryAfter: retryAfter}
+	}
+
+	post := &model.Message{
+		UserID:      hook.UserID,
+		Username:    hook.Username,
+		DisplayName: displayName,
+		Content:     content,
+		Bot:         true,
+	}
+	if err := s.poster.Post(post); err != nil {
+		return err
+	}
+
+	if err := s.repo.Touch(ctx, hook.ID); err != nil {
+		log.Printf("error updating incoming webhook %d: %v", hook.ID, err)
+	}
+	return nil
+}
+
+// slackContent renders the text and attachments of a Slack message as
+// plain text, one part per line.
+func slackContent(msg *model.SlackMessage) string {
+	var lines []string
+	add := func(text string) {
+		if text = strings.TrimSpace(slackText(text)); text != "" {
+			lines = append(lines, text)
+		}
+	}
+
+	add(msg.Text)
+	for _, attachment := range msg.Attachments {
+		before := len(lines)
+
+		add(attachment.Pretext)
+		if attachment.TitleLink != "" && attachment.Title != "" {
+			add(attachment.Title + " (" + attachment.TitleLink + ")")
+		} else {
+			add(attachment.Title)
+		}
+		add(attachment.Text)
+		for _, field := range attachment.Fields {
+			if field.Title != "" && field.Value != "" {
+				add(field.Title + ": " + field.Value)
+			} else {
+				add(field.Title + field.Value)
+			}
+		}
+
+		if len(lines) == before {
+			add(attachment.Fallback)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+var slackLink = regexp.MustCompile(`<([^<>|]+)(?:\|([^<>]*))?>`)
+
+// slackText turns Slack's <url|label> links into "label (url)" and undoes
+// its escaping of &, < and >.
+func slackText(text string) string {
+	text = slackLink.ReplaceAllStringFunc(text, func(link string) string {
+		parts := slackLink.FindStringSubmatch(link)
+		target, label := parts[1], parts[2]
+		// Mentions such as <!channel>, <@U123> and <#C123|general>
+		switch {
+		case strings.HasPrefix(target, "#"):
+			return cmp.Or(label, target)
+		case strings.HasPrefix(target, "!"), strings.HasPrefix(target, "@"):
+			return cmp.Or(label, "@"+strings.TrimLeft(target, "!@"))
+		}
+		if label == "" || label == target {
+			return target
+		}
+		return label + " (" + target + ")"
+	})
+
+	return strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(text)
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hdngo/whisper/internal/cache"
+	"github.com/hdngo/whisper/internal/config"
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/repository"
+)
+
+// LoginThrottledError is returned when a login is refused without checking
+// the password because of earlier failures.
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *LoginThrottledError) Error() string {
+	if e.Locked {
+		return "too many failed logins, temporarily locked"
+	}
+	return "too many failed logins, try again later"
+}
+
+// LoginThrottle slows down and eventually locks out repeated failed logins
+// for a username or from an IP address.
+type LoginThrottle struct {
+	redisClient *cache.RedisClient
+	auditRepo   *repository.AuditRepository
+	cfg         config.LockoutConfig
+}
+
+func NewLoginThrottle(redisClient *cache.RedisClient, auditRepo *repository.AuditRepository, cfg config.LockoutConfig) *LoginThrottle {
+	return &LoginThrottle{
+		redisClient: redisClient,
+		auditRepo:   auditRepo,
+		cfg:         cfg,
+	}
+}
+
+func userSubject(username string) string {
+	return "user:" + username
+}
+
+func ipSubject(ip string) string {
+	return "ip:" + ip
+}
+
+// subjects returns what a login is counted against: the username, and the
+// IP address unless there is none. Requests on the Unix socket have none,
+// and counting them together would let anyone lock out every user behind
+// the proxy using it.
+func subjects(username, ip string) []string {
+	if ip == "" {
+		return []string{userSubject(username)}
+	}
+	return []string{userSubject(username), ipSubject(ip)}
+}
+
+// Check returns a *LoginThrottledError if a login for username from ip
+// must wait.
+func (t *LoginThrottle) Check(ctx context.Context, username, ip string) error {
+	var wait time.Duration
+	var locked bool
+	for _, subject := range subjects(username, ip) {
+		backoff, lock, err := t.redisClient.LoginBlock(ctx, subject)
+		if err != nil {
+			return err
+		}
+		if lock > 0 {
+			locked = true
+		}
+		wait = max(wait, backoff, lock)
+	}
+
+	if wait > 0 {
+		return &LoginThrottledError{RetryAfter: wait, Locked: locked}
+	}
+	return nil
+}
+
+// Fail records a failed login, delaying the next attempt and locking out
+// the username or IP address once it reaches its limit.
+func (t *LoginThrottle) Fail(ctx context.Context, username, ip string) {
+	userFailures, err := t.redisClient.RecordLoginFailure(ctx, userSubject(username), t.cfg.FailureWindow)
+	if err != nil {
+		log.Printf("error recording failed login for %s: %v", username, err)
+		return
+	}
+
+	if userFailures >= int64(t.cfg.MaxAttempts) {
+		t.lock(ctx, userSubject(username), &model.AuditEvent{
+			Event:    model.AuditAccountLocked,
+			Username: username,
+			IP:       ip,
+			Details:  fmt.Sprintf("%d failed logins", userFailures),
+		})
+	} else {
+		t.delay(ctx, userSubject(username), userFailures)
+	}
+
+	if ip == "" {
+		return
+	}
+	ipFailures, err := t.redisClient.RecordLoginFailure(ctx, ipSubject(ip), t.cfg.FailureWindow)
+	if err != nil {
+		log.Printf("error recording failed login from %s: %v", ip, err)
+		return
+	}
+
+	// An address gets as many attempts as a single user before it is
+	// slowed down, so that users sharing one are not punished for a typo.
+	if ipFailures >= int64(t.cfg.IPMaxAttempts) {
+		t.lock(ctx, ipSubject(ip), &model.AuditEvent{
+			Event:    model.AuditIPLocked,
+			Username: username,
+			IP:       ip,
+			Details:  fmt.Sprintf("%d failed logins", ipFailures),
+		})
+	} else if ipFailures > int64(t.cfg.MaxAttempts) {
+		t.delay(ctx, ipSubject(ip), ipFailures-int64(t.cfg.MaxAttempts)+1)
+	}
+}
+
+// Succeed forgets the failed logins of username.
+func (t *LoginThrottle) Succeed(ctx context.Context, username string) {
+	if _, err := t.redisClient.ClearLoginFailures(ctx, userSubject(username)); err != nil {
+		log.Printf("error clearing failed logins for %s: %v", username, err)
+	}
+}
+
+// UnlockUser lifts a lockout of username on behalf of admin and reports
+// whether it was locked.
+func (t *LoginThrottle) UnlockUser(ctx context.Context, username, admin string) (bool, error) {
+	return t.unlock(ctx, userSubject(username), &model.AuditEvent{
+		Event:    model.AuditAccountUnlocked,
+		Username: username,
+		Actor:    admin,
+	})
+}
+
+// UnlockIP lifts a lockout of ip on behalf of admin and reports whether it
+// was locked.
+func (t *LoginThrottle) UnlockIP(ctx context.Context, ip, admin string) (bool, error) {
+	return t.unlock(ctx, ipSubject(ip), &model.AuditEvent{
+		Event: model.AuditIPUnlocked,
+		IP:    ip,
+		Actor: admin,
+	})
+}
+
+// delay makes the next attempt wait BackoffBase after the second failure,
+// doubling with every further one up to BackoffMax.
+func (t *LoginThrottle) delay(ctx context.Context, subject string, failures int64) {
+	if failures < 2 || t.cfg.BackoffBase == 0 {
+		return
+	}
+
+	wait := t.cfg.BackoffMax
+	if shift := failures - 2; shift < 32 {
+		wait = min(t.cfg.BackoffBase<<shift, t.cfg.BackoffMax)
+	}
+
+	if err := t.redisClient.DelayLogin(ctx, subject, wait); err != nil {
+		log.Printf("error delaying logins for %s: %v", subject, err)
+	}
+}
+
+func (t *LoginThrottle) lock(ctx context.Context, subject string, event *model.AuditEvent) {
+	if err := t.redisClient.LockLogin(ctx, subject, t.cfg.LockoutDuration); err != nil {
+		log.Printf("error locking logins for %s: %v", subject, err)
+		return
+	}
+
+	log.Printf("Locked out logins for %s after %s", subject, event.Details)
+	if err := t.auditRepo.Create(ctx, event); err != nil {
+		log.Printf("error recording lockout of %s: %v", subject, err)
+	}
+}
+
+func (t *LoginThrottle) unlock(ctx context.Context, subject string, event *model.AuditEvent) (bool, error) {
+	locked, err := t.redisClient.ClearLoginFailures(ctx, subject)
+	if err != nil || !locked {
+		return locked, err
+	}
+
+	log.Printf("%s unlocked logins for %s", event.Actor, subject)
+	if err := t.auditRepo.Create(ctx, event); err != nil {
+		log.Printf("error recording unlock of %s: %v", subject, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/repository"
+)
+
+// MentionNotifier delivers events to the connections of online users.
+type MentionNotifier interface {
+	OnlineUserIDs() []int64
+	SendToUser(userID int64, msgType string, payload interface{})
+}
+
+// mentionPattern matches @name at the start of a message or after a
+// character that cannot be part of a name, so e-mail addresses are not
+// mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@.])@([\w.-]+)`)
+
+// ParseMentions returns the distinct usernames mentioned in content and
+// whether it mentions @here or @channel.
+func ParseMentions(content string) (usernames []string, here, channel bool) {
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		// A trailing dot ends the sentence rather than the name
+		name := strings.TrimRight(match[1], ".")
+		switch {
+		case name == "":
+		case name == model.MentionHere:
+			here = true
+		case name == model.MentionChannel:
+			channel = true
+		case !seen[name]:
+			seen[name] = true
+			usernames = append(usernames, name)
+		}
+	}
+	return usernames, here, channel
+}
+
+// Mentions records who each chat message mentions, notifies them and keeps
+// their inbox of mentions.
+type Mentions struct {
+	repo     *repository.MentionRepository
+	notifier MentionNotifier
+}
+
+func NewMentions(repo *repository.MentionRepository, notifier MentionNotifier) *Mentions {
+	return &Mentions{repo: repo, notifier: notifier}
+}
+
+// MessageCreated records the mentions in a stored message and sends each
+// mentioned user a mention event. A user mentioned both by name and with
+// @here or @channel gets one mention, of the user kind.
+func (s *Mentions) MessageCreated(msg *model.Message) {
+	usernames, here, channel := ParseMentions(msg.Content)
+	if len(usernames) == 0 && !here && !channel {
+		return
+	}
+
+	ctx := context.Background()
+	if len(usernames) > 0 {
+		created, err := s.repo.CreateForUsernames(ctx, msg, model.MentionUser, usernames)
+		s.notify(msg, model.MentionUser, created, err)
+	}
+	if channel {
+		created, err := s.repo.CreateForEveryone(ctx, msg, model.MentionChannel)
+		s.notify(msg, model.MentionChannel, created, err)
+	} else if here {
+		created, err := s.repo.CreateForUserIDs(ctx, msg, model.MentionHere, s.notifier.OnlineUserIDs())
+		s.notify(msg, model.MentionHere, created, err)
+	}
+}
+
+// notify sends a mention event for each mention just created.
+func (s *Mentions) notify(msg *model.Message, kind string, created map[int64]int64, err error) {
+	if err != nil {
+		log.Printf("error recording %s mentions in message %d: %v", kind, msg.ID, err)
+		return
+	}
+
+	for userID, id := range created {
+		s.notifier.SendToUser(userID, model.MessageTypeMention, &model.Mention{
+			ID:        id,
+			Kind:      kind,
+			CreatedAt: msg.CreatedAt.Unix(),
+			Message:   *msg,
+		})
+	}
+}
+
+// Inbox returns a page of the user's mentions, newest first, along with
+// how many are unread.
+func (s *Mentions) Inbox(ctx context.Context, userID int64, unreadOnly bool, beforeID int64, limit int) (*model.MentionInbox, error) {
+	mentions, err := s.repo.GetByUserID(ctx, userID, unreadOnly, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	unread, err := s.repo.CountUnread(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &model.MentionInbox{Unread: unread, Mentions: mentions}, nil
+}
+
+// MarkRead marks mentions as read, all of them when ids is empty, and
+// returns how many remain unread.
+func (s *Mentions) MarkRead(ctx context.Context, userID int64, ids []int64) (int, error) {
+	if err := s.repo.MarkRead(ctx, userID, ids); err != nil {
+		return 0, err
+	}
+	return s.repo.CountUnread(ctx, userID)
+}
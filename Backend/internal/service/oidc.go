@@ -0,0 +1,281 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/hdngo/whisper/internal/cache"
+	"github.com/hdngo/whisper/internal/config"
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/repository"
+	"github.com/hdngo/whisper/internal/token"
+	"golang.org/x/oauth2"
+)
+
+var (
+	ErrOIDCDisabled       = errors.New("single sign-on is not configured")
+	ErrInvalidOIDCLogin   = errors.New("single sign-on expired or failed, try again")
+	ErrOIDCSignupDisabled = errors.New("no account is linked to this identity")
+	ErrOIDCIdentityLinked = errors.New("this identity is linked to another account")
+)
+
+// OIDCAccountExistsError is returned when a first-time single sign-on user
+// would take the name of an existing account, which must instead be linked
+// by signing in to it.
+type OIDCAccountExistsError struct {
+	Username string
+}
+
+func (e *OIDCAccountExistsError) Error() string {
+	return fmt.Sprintf("an account named %q already exists, sign in to it to link your identity", e.Username)
+}
+
+// oidcLogin is kept between sending the browser to the identity provider
+// and its return. UserID is set when linking a signed-in user.
+type oidcLogin struct {
+	UserID   int64  `json:"user_id,omitempty"`
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+}
+
+// oidcClient talks to the identity provider, which is discovered on first
+// use so that the server starts even while the provider is unreachable.
+type oidcClient struct {
+	cfg        config.OIDCConfig
+	httpClient *http.Client
+
+	mu       sync.Mutex
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func newOIDCClient(cfg config.OIDCConfig) *oidcClient {
+	return &oidcClient{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *oidcClient) context(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, c.httpClient)
+}
+
+func (c *oidcClient) discover() (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.oauth2 != nil {
+		return c.oauth2, c.verifier, nil
+	}
+
+	// The provider keeps this context to fetch its signing keys later, so
+	// it must outlive the request.
+	provider, err := oidc.NewProvider(c.context(context.Background()), c.cfg.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discovering %s: %w", c.cfg.Issuer, err)
+	}
+
+	c.oauth2 = &oauth2.Config{
+		ClientID:     c.cfg.ClientID,
+		ClientSecret: c.cfg.ClientSecret,
+		RedirectURL:  c.cfg.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       c.cfg.Scopes,
+	}
+	c.verifier = provider.Verifier(&oidc.Config{ClientID: c.cfg.ClientID})
+	return c.oauth2, c.verifier, nil
+}
+
+// BeginOIDCLogin returns the identity provider URL to send the browser to.
+func (s *AuthService) BeginOIDCLogin(ctx context.Context) (*model.OIDCAuthorization, error) {
+	return s.beginOIDC(ctx, &oidcLogin{})
+}
+
+// BeginOIDCLink is like BeginOIDCLogin, but the identity the user logs in
+// with is linked to their existing account.
+func (s *AuthService) BeginOIDCLink(ctx context.Context, userID int64) (*model.OIDCAuthorization, error) {
+	return s.beginOIDC(ctx, &oidcLogin{UserID: userID})
+}
+
+// FinishOIDCLogin exchanges the code the identity provider returned for an
+// ID token and starts a session for the user linked to it, creating one
+// on first login. The provider is trusted to have checked any second
+// factor, so two-factor authentication is skipped.
+func (s *AuthService) FinishOIDCLogin(ctx context.Context, req *model.OIDCCallbackRequest, device model.DeviceInfo) (*model.AuthResponse, error) {
+	login, idToken, err := s.finishOIDC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if login.UserID != 0 {
+		return nil, ErrInvalidOIDCLogin
+	}
+
+	username, displayName, err := s.oidcNames(idToken)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.GetByIdentity(ctx, idToken.Issuer, idToken.Subject)
+	if err == nil {
+		if displayName != "" && displayName != user.DisplayName {
+			if err := s.userRepo.UpdateDisplayName(ctx, user.ID, displayName); err != nil {
+				return nil, err
+			}
+			user.DisplayName = displayName
+		}
+		return s.createSession(ctx, user, device)
+	}
+
+	if !s.cfg.OIDC.AllowSignup {
+		return nil, ErrOIDCSignupDisabled
+	}
+	if len(username) < s.cfg.MinUsernameLength {
+		log.Printf("oidc %s claim %q of %s is not a valid username", s.cfg.OIDC.UsernameClaim, username, idToken.Subject)
+		return nil, ErrInvalidOIDCLogin
+	}
+	if _, err := s.userRepo.GetByUsername(ctx, username); err == nil {
+		return nil, &OIDCAccountExistsError{Username: username}
+	}
+
+	// Without a password hash the account can only be used through the
+	// identity provider or passkeys.
+	user = &model.User{
+		Username:    username,
+		DisplayName: displayName,
+		CreatedAt:   time.Now().Unix(),
+	}
+	if err := s.userRepo.CreateWithIdentity(ctx, user, idToken.Issuer, idToken.Subject); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Created user %s for %s at %s", user.Username, idToken.Subject, idToken.Issuer)
+	return s.createSession(ctx, user, device)
+}
+
+// FinishOIDCLink links the identity the user logged in with at the
+// identity provider to their account.
+func (s *AuthService) FinishOIDCLink(ctx context.Context, userID int64, req *model.OIDCCallbackRequest) error {
+	login, idToken, err := s.finishOIDC(ctx, req)
+	if err != nil {
+		return err
+	}
+	if login.UserID != userID {
+		return ErrInvalidOIDCLogin
+	}
+
+	err = s.userRepo.LinkIdentity(ctx, userID, idToken.Issuer, idToken.Subject)
+	if errors.Is(err, repository.ErrIdentityLinked) {
+		return ErrOIDCIdentityLinked
+	}
+	return err
+}
+
+func (s *AuthService) beginOIDC(ctx context.Context, login *oidcLogin) (*model.OIDCAuthorization, error) {
+	if s.oidc == nil {
+		return nil, ErrOIDCDisabled
+	}
+
+	oauth2Config, _, err := s.oidc.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := token.NewOpaque()
+	if err != nil {
+		return nil, err
+	}
+	login.Nonce, err = token.NewOpaque()
+	if err != nil {
+		return nil, err
+	}
+	login.Verifier = oauth2.GenerateVerifier()
+
+	data, err := json.Marshal(login)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.redisClient.SaveOIDCLogin(ctx, token.Hash(state), data, s.cfg.OIDC.LoginTimeout); err != nil {
+		return nil, err
+	}
+
+	return &model.OIDCAuthorization{
+		AuthorizationURL: oauth2Config.AuthCodeURL(state,
+			oidc.Nonce(login.Nonce),
+			oauth2.S256ChallengeOption(login.Verifier),
+		),
+	}, nil
+}
+
+func (s *AuthService) finishOIDC(ctx context.Context, req *model.OIDCCallbackRequest) (*oidcLogin, *oidc.IDToken, error) {
+	if s.oidc == nil {
+		return nil, nil, ErrOIDCDisabled
+	}
+
+	data, err := s.redisClient.TakeOIDCLogin(ctx, token.Hash(req.State))
+	if errors.Is(err, cache.ErrChallengeNotFound) {
+		return nil, nil, ErrInvalidOIDCLogin
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var login oidcLogin
+	if err := json.Unmarshal(data, &login); err != nil {
+		return nil, nil, err
+	}
+
+	oauth2Config, verifier, err := s.oidc.discover()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx = s.oidc.context(ctx)
+	tokens, err := oauth2Config.Exchange(ctx, req.Code, oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		log.Printf("oidc code exchange failed: %v", err)
+		return nil, nil, ErrInvalidOIDCLogin
+	}
+
+	rawIDToken, ok := tokens.Extra("id_token").(string)
+	if !ok {
+		log.Printf("oidc token response has no id_token")
+		return nil, nil, ErrInvalidOIDCLogin
+	}
+
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		log.Printf("oidc id token rejected: %v", err)
+		return nil, nil, ErrInvalidOIDCLogin
+	}
+	if idToken.Nonce != login.Nonce {
+		log.Printf("oidc id token nonce mismatch for %s", idToken.Subject)
+		return nil, nil, ErrInvalidOIDCLogin
+	}
+
+	return &login, idToken, nil
+}
+
+// oidcNames maps the configured ID token claims to a username and display
+// name, either of which may be missing. The display name falls back to the
+// username.
+func (s *AuthService) oidcNames(idToken *oidc.IDToken) (string, string, error) {
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return "", "", err
+	}
+
+	username, _ := claims[s.cfg.OIDC.UsernameClaim].(string)
+	displayName, _ := claims[s.cfg.OIDC.DisplayNameClaim].(string)
+	if displayName == "" {
+		displayName = username
+	}
+
+	return username, displayName, nil
+}
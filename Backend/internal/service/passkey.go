@@ -0,0 +1,283 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/hdngo/whisper/internal/cache"
+	"github.com/hdngo/whisper/internal/config"
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/token"
+)
+
+var (
+	ErrInvalidCeremony = errors.New("passkey prompt expired, try again")
+	ErrPasskeyRejected = errors.New("passkey not accepted")
+)
+
+const (
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+)
+
+// webAuthnCeremony is the server side state of a registration or login
+// kept between its begin and finish requests.
+type webAuthnCeremony struct {
+	Kind    string               `json:"kind"`
+	UserID  int64                `json:"user_id,omitempty"`
+	Session webauthn.SessionData `json:"session"`
+}
+
+// passkeyUser adapts a user and their passkeys to webauthn.User.
+type passkeyUser struct {
+	user     *model.User
+	passkeys []model.Passkey
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+	return userHandle(u.user.ID)
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	return u.user.Username
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.passkeys))
+	for i, passkey := range u.passkeys {
+		credentials[i] = passkey.Credential
+	}
+	return credentials
+}
+
+// userHandle is the opaque user ID stored in a passkey, which the browser
+// returns on login to say whose passkey was used.
+func userHandle(userID int64) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(userID))
+	return handle
+}
+
+func newWebAuthn(cfg config.WebAuthnConfig) (*webauthn.WebAuthn, error) {
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: cfg.Timeout, TimeoutUVD: cfg.Timeout}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          cfg.RPID,
+		RPDisplayName: cfg.RPDisplayName,
+		RPOrigins:     cfg.RPOrigins,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        timeout,
+			Registration: timeout,
+		},
+	})
+}
+
+// BeginPasskeyRegistration starts adding a passkey to the user's account.
+func (s *AuthService) BeginPasskeyRegistration(ctx context.Context, userID int64) (*model.WebAuthnCeremony, error) {
+	user, err := s.passkeyUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, len(user.passkeys))
+	for i, passkey := range user.passkeys {
+		exclusions[i] = passkey.Credential.Descriptor()
+	}
+
+	options, session, err := s.webAuthn.BeginRegistration(user,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.saveCeremony(ctx, &webAuthnCeremony{Kind: ceremonyRegistration, UserID: userID, Session: *session}, options)
+}
+
+// FinishPasskeyRegistration verifies the browser's response and saves the
+// new passkey under name.
+func (s *AuthService) FinishPasskeyRegistration(ctx context.Context, userID int64, req *model.WebAuthnFinishRequest) (*model.Passkey, error) {
+	ceremony, err := s.takeCeremony(ctx, req.CeremonyID, ceremonyRegistration)
+	if err != nil {
+		return nil, err
+	}
+	if ceremony.UserID != userID {
+		return nil, ErrInvalidCeremony
+	}
+
+	user, err := s.passkeyUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(req.Credential)
+	if err != nil {
+		return nil, rejectPasskey(err)
+	}
+
+	credential, err := s.webAuthn.CreateCredential(user, ceremony.Session, parsed)
+	if err != nil {
+		return nil, rejectPasskey(err)
+	}
+
+	passkey := &model.Passkey{
+		UserID:     userID,
+		Name:       req.Name,
+		Credential: *credential,
+	}
+	if passkey.Name == "" {
+		passkey.Name = "Passkey"
+	}
+
+	if err := s.passkeyRepo.Create(ctx, passkey); err != nil {
+		return nil, err
+	}
+
+	return passkey, nil
+}
+
+// BeginPasskeyLogin starts a passwordless login. No username is needed:
+// the browser offers the passkeys it holds for this site.
+func (s *AuthService) BeginPasskeyLogin(ctx context.Context) (*model.WebAuthnCeremony, error) {
+	options, session, err := s.webAuthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.saveCeremony(ctx, &webAuthnCeremony{Kind: ceremonyLogin, Session: *session}, options)
+}
+
+// FinishPasskeyLogin verifies the browser's signature and starts a session
+// for the passkey's owner. Passkeys require user verification, so they
+// stand in for both the password and the second factor.
+func (s *AuthService) FinishPasskeyLogin(ctx context.Context, req *model.WebAuthnFinishRequest, device model.DeviceInfo) (*model.AuthResponse, error) {
+	ceremony, err := s.takeCeremony(ctx, req.CeremonyID, ceremonyLogin)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(req.Credential)
+	if err != nil {
+		return nil, rejectPasskey(err)
+	}
+
+	var used *model.Passkey
+	var owner *passkeyUser
+	findUser := func(rawID, handle []byte) (webauthn.User, error) {
+		passkey, err := s.passkeyRepo.GetByCredentialID(ctx, rawID)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(handle, userHandle(passkey.UserID)) {
+			return nil, errors.New("user handle does not match passkey")
+		}
+
+		owner, err = s.passkeyUser(ctx, passkey.UserID)
+		used = passkey
+		return owner, err
+	}
+
+	credential, err := s.webAuthn.ValidateDiscoverableLogin(findUser, ceremony.Session, parsed)
+	if err != nil {
+		return nil, rejectPasskey(err)
+	}
+
+	if credential.Authenticator.CloneWarning {
+		log.Printf("passkey %d of user %d reported a stale sign counter, possibly cloned", used.ID, used.UserID)
+		return nil, ErrPasskeyRejected
+	}
+
+	used.Credential = *credential
+	if err := s.passkeyRepo.UpdateCredential(ctx, used); err != nil {
+		return nil, err
+	}
+
+	return s.createSession(ctx, owner.user, device)
+}
+
+func (s *AuthService) ListPasskeys(ctx context.Context, userID int64) ([]model.Passkey, error) {
+	return s.passkeyRepo.GetByUserID(ctx, userID)
+}
+
+func (s *AuthService) DeletePasskey(ctx context.Context, userID, passkeyID int64) error {
+	return s.passkeyRepo.Delete(ctx, userID, passkeyID)
+}
+
+func (s *AuthService) passkeyUser(ctx context.Context, userID int64) (*passkeyUser, error) {
+	user, err := s.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys, err := s.passkeyRepo.GetByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &passkeyUser{user: user, passkeys: passkeys}, nil
+}
+
+func (s *AuthService) saveCeremony(ctx context.Context, ceremony *webAuthnCeremony, options interface{}) (*model.WebAuthnCeremony, error) {
+	ceremonyID, err := token.NewOpaque()
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := json.Marshal(ceremony)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := time.Until(ceremony.Session.Expires)
+	if err := s.redisClient.SaveWebAuthnCeremony(ctx, token.Hash(ceremonyID), state, ttl); err != nil {
+		return nil, err
+	}
+
+	return &model.WebAuthnCeremony{CeremonyID: ceremonyID, Options: options}, nil
+}
+
+func (s *AuthService) takeCeremony(ctx context.Context, ceremonyID, kind string) (*webAuthnCeremony, error) {
+	state, err := s.redisClient.TakeWebAuthnCeremony(ctx, token.Hash(ceremonyID))
+	if errors.Is(err, cache.ErrChallengeNotFound) {
+		return nil, ErrInvalidCeremony
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ceremony webAuthnCeremony
+	if err := json.Unmarshal(state, &ceremony); err != nil {
+		return nil, err
+	}
+	if ceremony.Kind != kind {
+		return nil, ErrInvalidCeremony
+	}
+
+	return &ceremony, nil
+}
+
+// rejectPasskey logs why a WebAuthn response failed verification and
+// returns the generic error shown to the client.
+func rejectPasskey(err error) error {
+	var protocolErr *protocol.Error
+	if errors.As(err, &protocolErr) {
+		log.Printf("passkey rejected: %s: %s", protocolErr.Details, protocolErr.DevInfo)
+	} else {
+		log.Printf("passkey rejected: %v", err)
+	}
+	return ErrPasskeyRejected
+}
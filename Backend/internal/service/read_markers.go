@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/repository"
+)
+
+// ReadNotifier delivers events to one user's connections or to everyone.
+type ReadNotifier interface {
+	SendToUser(userID int64, msgType string, payload interface{})
+	BroadcastEvent(msgType string, payload interface{})
+}
+
+// ReadMarkers tracks how far each user has read the chat.
+type ReadMarkers struct {
+	repo     *repository.ReadMarkerRepository
+	notifier ReadNotifier
+
+	mutex    sync.RWMutex
+	receipts bool
+}
+
+func NewReadMarkers(repo *repository.ReadMarkerRepository, notifier ReadNotifier) *ReadMarkers {
+	return &ReadMarkers{repo: repo, notifier: notifier, receipts: true}
+}
+
+// SetReceipts enables or disables broadcasting read receipts.
+func (s *ReadMarkers) SetReceipts(enabled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.receipts = enabled
+}
+
+func (s *ReadMarkers) receiptsEnabled() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.receipts
+}
+
+// State returns how far the user has read and how many messages they have
+// not.
+func (s *ReadMarkers) State(ctx context.Context, userID int64) (*model.ReadState, error) {
+	return s.repo.GetState(ctx, userID)
+}
+
+// MarkRead moves the user's read marker forward to messageID. Their
+// connections are sent the new state so that every device shows the same
+// unread count, and everyone gets a read receipt when enabled. Moving the
+// marker backwards is ignored.
+func (s *ReadMarkers) MarkRead(ctx context.Context, userID int64, username string, messageID int64) (*model.ReadState, error) {
+	moved, err := s.repo.Advance(ctx, userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	state, err := s.repo.GetState(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !moved {
+		return state, nil
+	}
+
+	s.notifier.SendToUser(userID, model.MessageTypeReadState, state)
+	if state.LastReadMessageID > 0 && s.receiptsEnabled() {
+		s.notifier.BroadcastEvent(model.MessageTypeRead, &model.ReadReceipt{
+			UserID:    userID,
+			Username:  username,
+			MessageID: state.LastReadMessageID,
+		})
+	}
+	return state, nil
+}
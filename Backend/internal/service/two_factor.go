@@ -0,0 +1,316 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/hdngo/whisper/internal/cache"
+	"github.com/hdngo/whisper/internal/config"
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/token"
+	"github.com/hdngo/whisper/internal/totp"
+)
+
+var (
+	ErrInvalidMFAToken    = errors.New("login expired, sign in again")
+	ErrInvalidCode        = errors.New("invalid code")
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrTOTPNotEnrolled    = errors.New("start enrollment first")
+)
+
+const recoveryCodeCount = 10
+
+// TOTPStore keeps users' TOTP secrets and recovery codes.
+// repository.UserRepository implements it.
+type TOTPStore interface {
+	GetByID(ctx context.Context, id int64) (*model.User, error)
+	SetPendingTOTPSecret(ctx context.Context, userID int64, secret string) error
+	EnableTOTP(ctx context.Context, userID int64, step int64, recoveryHashes []string) error
+	DisableTOTP(ctx context.Context, userID int64) error
+	ReplaceRecoveryCodes(ctx context.Context, userID int64, recoveryHashes []string) error
+	UseTOTPStep(ctx context.Context, userID int64, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, userID int64, hash string) (bool, error)
+}
+
+// MFAChallengeStore keeps the logins waiting for a second factor.
+// cache.RedisClient implements it.
+type MFAChallengeStore interface {
+	CreateMFAChallenge(ctx context.Context, tokenHash string, userID int64, ttl time.Duration) error
+	ClaimMFAAttempt(ctx context.Context, tokenHash string) (int64, int64, error)
+	DeleteMFAChallenge(ctx context.Context, tokenHash string) error
+}
+
+// LoginLimiter throttles wrong guesses. LoginThrottle implements it.
+type LoginLimiter interface {
+	Check(ctx context.Context, username, ip string) error
+	Fail(ctx context.Context, username, ip string)
+	Succeed(ctx context.Context, username string)
+}
+
+// twoFactor is the TOTP second factor behind AuthService's two-factor
+// methods. now is its clock, so that codes can be checked against a fixed
+// time.
+type twoFactor struct {
+	users      TOTPStore
+	challenges MFAChallengeStore
+	throttle   LoginLimiter
+	cfg        config.TwoFactorConfig
+	now        func() time.Time
+}
+
+// startChallenge answers a correct password for a user with two-factor
+// authentication by handing out a short-lived token to present with the
+// second factor instead of a session.
+func (s *AuthService) startChallenge(ctx context.Context, user *model.User) (*model.AuthResponse, error) {
+	mfaToken, err := s.twoFactor.start(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.AuthResponse{
+		Username:    user.Username,
+		MFARequired: true,
+		MFAToken:    mfaToken,
+	}, nil
+}
+
+// VerifyMFA finishes a login started with a correct password by checking a
+// TOTP or recovery code. A challenge allows a limited number of attempts,
+// and wrong codes count as failed logins.
+func (s *AuthService) VerifyMFA(ctx context.Context, req *model.MFAVerifyRequest, device model.DeviceInfo) (*model.AuthResponse, error) {
+	user, err := s.twoFactor.verify(ctx, req.MFAToken, req.Code, device.IP)
+	if err != nil {
+		return nil, err
+	}
+	return s.createSession(ctx, user, device)
+}
+
+// EnrollTOTP generates a new TOTP secret for the user. It takes effect once
+// confirmed with a code from the authenticator app.
+func (s *AuthService) EnrollTOTP(ctx context.Context, userID int64) (*model.TOTPEnrollment, error) {
+	return s.twoFactor.enroll(ctx, userID)
+}
+
+// ConfirmTOTP enables two-factor authentication once the user proves their
+// app produces valid codes, and returns their recovery codes. They are
+// only ever shown here and by RegenerateRecoveryCodes.
+func (s *AuthService) ConfirmTOTP(ctx context.Context, userID int64, code string) ([]string, error) {
+	return s.twoFactor.confirm(ctx, userID, code)
+}
+
+// DisableTOTP turns off two-factor authentication after checking a current
+// TOTP or recovery code.
+func (s *AuthService) DisableTOTP(ctx context.Context, userID int64, code, ip string) error {
+	return s.twoFactor.disable(ctx, userID, code, ip)
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes after checking
+// a current TOTP or recovery code.
+func (s *AuthService) RegenerateRecoveryCodes(ctx context.Context, userID int64, code, ip string) ([]string, error) {
+	return s.twoFactor.regenerateRecoveryCodes(ctx, userID, code, ip)
+}
+
+// start creates a challenge for the user and returns its token.
+func (t *twoFactor) start(ctx context.Context, userID int64) (string, error) {
+	mfaToken, err := token.NewOpaque()
+	if err != nil {
+		return "", err
+	}
+
+	if err := t.challenges.CreateMFAChallenge(ctx, token.Hash(mfaToken), userID, t.cfg.ChallengeTTL); err != nil {
+		return "", err
+	}
+	return mfaToken, nil
+}
+
+// verify checks code against the challenge with the given token and
+// returns the user who may now be logged in.
+func (t *twoFactor) verify(ctx context.Context, mfaToken, code, ip string) (*model.User, error) {
+	tokenHash := token.Hash(mfaToken)
+
+	userID, attempts, err := t.challenges.ClaimMFAAttempt(ctx, tokenHash)
+	if errors.Is(err, cache.ErrChallengeNotFound) {
+		return nil, ErrInvalidMFAToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if attempts > int64(t.cfg.MaxAttempts) {
+		t.challenges.DeleteMFAChallenge(ctx, tokenHash)
+		return nil, ErrInvalidMFAToken
+	}
+
+	user, err := t.users.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.verifySecondFactor(ctx, user, code, ip); err != nil {
+		return nil, err
+	}
+
+	if err := t.challenges.DeleteMFAChallenge(ctx, tokenHash); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (t *twoFactor) enroll(ctx context.Context, userID int64) (*model.TOTPEnrollment, error) {
+	user, err := t.users.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.users.SetPendingTOTPSecret(ctx, userID, secret); err != nil {
+		return nil, err
+	}
+
+	return &model.TOTPEnrollment{
+		Secret: secret,
+		URI:    totp.URI(t.cfg.Issuer, user.Username, secret),
+	}, nil
+}
+
+func (t *twoFactor) confirm(ctx context.Context, userID int64, code string) ([]string, error) {
+	user, err := t.users.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTOTPNotEnrolled
+	}
+
+	step, ok := totp.Validate(user.TOTPSecret, code, t.now(), t.cfg.Skew)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.users.EnableTOTP(ctx, userID, step, hashes); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (t *twoFactor) disable(ctx context.Context, userID int64, code, ip string) error {
+	user, err := t.users.GetByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return ErrTOTPNotEnabled
+	}
+
+	if err := t.verifySecondFactor(ctx, user, code, ip); err != nil {
+		return err
+	}
+
+	return t.users.DisableTOTP(ctx, userID)
+}
+
+func (t *twoFactor) regenerateRecoveryCodes(ctx context.Context, userID int64, code, ip string) ([]string, error) {
+	user, err := t.users.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TOTPEnabled {
+		return nil, ErrTOTPNotEnabled
+	}
+
+	if err := t.verifySecondFactor(ctx, user, code, ip); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.users.ReplaceRecoveryCodes(ctx, userID, hashes); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// verifySecondFactor accepts a TOTP code not used before or an unused
+// recovery code, throttling wrong guesses like failed logins.
+func (t *twoFactor) verifySecondFactor(ctx context.Context, user *model.User, code, ip string) error {
+	if err := t.throttle.Check(ctx, user.Username, ip); err != nil {
+		return err
+	}
+
+	ok, err := t.checkSecondFactor(ctx, user, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		t.throttle.Fail(ctx, user.Username, ip)
+		return ErrInvalidCode
+	}
+
+	t.throttle.Succeed(ctx, user.Username)
+	return nil
+}
+
+func (t *twoFactor) checkSecondFactor(ctx context.Context, user *model.User, code string) (bool, error) {
+	if step, ok := totp.Validate(user.TOTPSecret, code, t.now(), t.cfg.Skew); ok {
+		return t.users.UseTOTPStep(ctx, user.ID, step)
+	}
+
+	normalized := normalizeRecoveryCode(code)
+	if normalized == "" {
+		return false, nil
+	}
+	return t.users.UseRecoveryCode(ctx, user.ID, token.Hash(normalized))
+}
+
+// newRecoveryCodes returns fresh recovery codes formatted for display
+// along with the hashes to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		raw := base32.StdEncoding.EncodeToString(b)
+		codes[i] = raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+		hashes[i] = token.Hash(raw)
+	}
+
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode undoes the formatting users may type a recovery
+// code with.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return code
+}
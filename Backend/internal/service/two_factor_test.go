@@ -0,0 +1,252 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hdngo/whisper/internal/cache"
+	"github.com/hdngo/whisper/internal/config"
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/totp"
+)
+
+// fakeTOTPStore keeps users and recovery code hashes in memory, with the
+// same rules as the users table.
+type fakeTOTPStore struct {
+	users    map[int64]*model.User
+	recovery map[int64]map[string]bool
+}
+
+func (f *fakeTOTPStore) GetByID(ctx context.Context, id int64) (*model.User, error) {
+	user, ok := f.users[id]
+	if !ok {
+		return nil, errors.New("user not found")
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (f *fakeTOTPStore) SetPendingTOTPSecret(ctx context.Context, userID int64, secret string) error {
+	if user := f.users[userID]; !user.TOTPEnabled {
+		user.TOTPSecret = secret
+		user.TOTPLastStep = 0
+	}
+	return nil
+}
+
+func (f *fakeTOTPStore) EnableTOTP(ctx context.Context, userID int64, step int64, recoveryHashes []string) error {
+	user := f.users[userID]
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	return f.ReplaceRecoveryCodes(ctx, userID, recoveryHashes)
+}
+
+func (f *fakeTOTPStore) DisableTOTP(ctx context.Context, userID int64) error {
+	user := f.users[userID]
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	return f.ReplaceRecoveryCodes(ctx, userID, nil)
+}
+
+func (f *fakeTOTPStore) ReplaceRecoveryCodes(ctx context.Context, userID int64, recoveryHashes []string) error {
+	f.recovery[userID] = make(map[string]bool)
+	for _, hash := range recoveryHashes {
+		f.recovery[userID][hash] = true
+	}
+	return nil
+}
+
+func (f *fakeTOTPStore) UseTOTPStep(ctx context.Context, userID int64, step int64) (bool, error) {
+	user := f.users[userID]
+	if user.TOTPLastStep >= step {
+		return false, nil
+	}
+	user.TOTPLastStep = step
+	return true, nil
+}
+
+func (f *fakeTOTPStore) UseRecoveryCode(ctx context.Context, userID int64, hash string) (bool, error) {
+	if !f.recovery[userID][hash] {
+		return false, nil
+	}
+	delete(f.recovery[userID], hash)
+	return true, nil
+}
+
+type fakeChallenge struct {
+	userID   int64
+	attempts int64
+}
+
+type fakeChallenges map[string]*fakeChallenge
+
+func (f fakeChallenges) CreateMFAChallenge(ctx context.Context, tokenHash string, userID int64, ttl time.Duration) error {
+	f[tokenHash] = &fakeChallenge{userID: userID}
+	return nil
+}
+
+func (f fakeChallenges) ClaimMFAAttempt(ctx context.Context, tokenHash string) (int64, int64, error) {
+	challenge, ok := f[tokenHash]
+	if !ok {
+		return 0, 0, cache.ErrChallengeNotFound
+	}
+	challenge.attempts++
+	return challenge.userID, challenge.attempts, nil
+}
+
+func (f fakeChallenges) DeleteMFAChallenge(ctx context.Context, tokenHash string) error {
+	delete(f, tokenHash)
+	return nil
+}
+
+// fakeLimiter counts failures and never throttles.
+type fakeLimiter struct {
+	failures int
+}
+
+func (f *fakeLimiter) Check(ctx context.Context, username, ip string) error { return nil }
+func (f *fakeLimiter) Fail(ctx context.Context, username, ip string)        { f.failures++ }
+func (f *fakeLimiter) Succeed(ctx context.Context, username string)         {}
+
+const testUserID = 7
+
+// newTestTwoFactor returns a twoFactor for one user whose clock reads
+// *now.
+func newTestTwoFactor(now *time.Time) (*twoFactor, *fakeTOTPStore, *fakeLimiter) {
+	store := &fakeTOTPStore{
+		users:    map[int64]*model.User{testUserID: {ID: testUserID, Username: "alice"}},
+		recovery: make(map[int64]map[string]bool),
+	}
+	limiter := &fakeLimiter{}
+	tf := &twoFactor{
+		users:      store,
+		challenges: fakeChallenges{},
+		throttle:   limiter,
+		cfg:        config.TwoFactorConfig{Issuer: "Whisper", ChallengeTTL: 5 * time.Minute, MaxAttempts: 3, Skew: 1},
+		now:        func() time.Time { return *now },
+	}
+	return tf, store, limiter
+}
+
+func codeAt(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	code, err := totp.Code(secret, totp.Step(at))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestTwoFactorEnrollConfirmVerify(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	tf, store, limiter := newTestTwoFactor(&now)
+
+	enrollment, err := tf.enroll(ctx, testUserID)
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	confirmCode := codeAt(t, enrollment.Secret, now)
+	wrongCode := string('0'+(confirmCode[0]-'0'+1)%10) + confirmCode[1:]
+	if _, err := tf.confirm(ctx, testUserID, wrongCode); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("confirm with a wrong code: err = %v, want ErrInvalidCode", err)
+	}
+
+	recoveryCodes, err := tf.confirm(ctx, testUserID, confirmCode)
+	if err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(recoveryCodes), recoveryCodeCount)
+	}
+	if !store.users[testUserID].TOTPEnabled {
+		t.Fatal("two-factor authentication not enabled")
+	}
+
+	// The code used to confirm cannot be used again to log in
+	mfaToken, err := tf.start(ctx, testUserID)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if _, err := tf.verify(ctx, mfaToken, confirmCode, "127.0.0.1"); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("verify with the confirmation code: err = %v, want ErrInvalidCode", err)
+	}
+
+	now = now.Add(30 * time.Second)
+	loginCode := codeAt(t, enrollment.Secret, now)
+	user, err := tf.verify(ctx, mfaToken, loginCode, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if user.ID != testUserID {
+		t.Fatalf("verify returned user %d, want %d", user.ID, testUserID)
+	}
+
+	// The challenge is used up
+	if _, err := tf.verify(ctx, mfaToken, loginCode, "127.0.0.1"); !errors.Is(err, ErrInvalidMFAToken) {
+		t.Fatalf("verify with a used challenge: err = %v, want ErrInvalidMFAToken", err)
+	}
+
+	// A new login cannot reuse the code, even within the skew window
+	mfaToken, _ = tf.start(ctx, testUserID)
+	now = now.Add(10 * time.Second)
+	if _, err := tf.verify(ctx, mfaToken, loginCode, "127.0.0.1"); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("verify with a reused code: err = %v, want ErrInvalidCode", err)
+	}
+
+	// Recovery codes work once
+	if _, err := tf.verify(ctx, mfaToken, recoveryCodes[0], "127.0.0.1"); err != nil {
+		t.Fatalf("verify with a recovery code: %v", err)
+	}
+	mfaToken, _ = tf.start(ctx, testUserID)
+	if _, err := tf.verify(ctx, mfaToken, recoveryCodes[0], "127.0.0.1"); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("verify with a used recovery code: err = %v, want ErrInvalidCode", err)
+	}
+
+	if limiter.failures != 3 {
+		t.Errorf("recorded %d failures, want 3", limiter.failures)
+	}
+}
+
+func TestTwoFactorSkewWindow(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	tf, _, _ := newTestTwoFactor(&now)
+
+	enrollment, _ := tf.enroll(ctx, testUserID)
+	if _, err := tf.confirm(ctx, testUserID, codeAt(t, enrollment.Secret, now)); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+
+	// A code from one step ahead is accepted with a skew of 1, but not
+	// from two steps ahead
+	now = now.Add(30 * time.Second)
+	mfaToken, _ := tf.start(ctx, testUserID)
+	if _, err := tf.verify(ctx, mfaToken, codeAt(t, enrollment.Secret, now.Add(60*time.Second)), "127.0.0.1"); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("code two steps ahead: err = %v, want ErrInvalidCode", err)
+	}
+	if _, err := tf.verify(ctx, mfaToken, codeAt(t, enrollment.Secret, now.Add(30*time.Second)), "127.0.0.1"); err != nil {
+		t.Fatalf("code one step ahead: %v", err)
+	}
+}
+
+func TestTwoFactorChallengeAttempts(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	tf, _, _ := newTestTwoFactor(&now)
+
+	enrollment, _ := tf.enroll(ctx, testUserID)
+	tf.confirm(ctx, testUserID, codeAt(t, enrollment.Secret, now))
+	now = now.Add(30 * time.Second)
+
+	mfaToken, _ := tf.start(ctx, testUserID)
+	for i := 0; i < tf.cfg.MaxAttempts; i++ {
+		tf.verify(ctx, mfaToken, "bad code", "127.0.0.1")
+	}
+	if _, err := tf.verify(ctx, mfaToken, codeAt(t, enrollment.Secret, now), "127.0.0.1"); !errors.Is(err, ErrInvalidMFAToken) {
+		t.Fatalf("verify after too many attempts: err = %v, want ErrInvalidMFAToken", err)
+	}
+}
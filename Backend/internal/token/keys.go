@@ -0,0 +1,257 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key is an asymmetric access token signing key. A key signs new tokens
+// until it is retired and verifies them until the tokens it signed have
+// expired.
+type Key struct {
+	ID        string
+	Algorithm string
+	CreatedAt time.Time
+	RetiredAt time.Time
+	private   crypto.Signer
+}
+
+// GenerateKey creates a key for alg, which is RS256 or EdDSA.
+func GenerateKey(alg string) (*Key, error) {
+	var private crypto.Signer
+	switch alg {
+	case "RS256":
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		private = key
+	case "EdDSA":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		private = key
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+
+	id, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{
+		ID:        id,
+		Algorithm: alg,
+		CreatedAt: time.Now(),
+		private:   private,
+	}, nil
+}
+
+// Public returns the public half of the key.
+func (k *Key) Public() crypto.PublicKey {
+	return k.private.Public()
+}
+
+// Retired reports whether the key has stopped signing new tokens.
+func (k *Key) Retired() bool {
+	return !k.RetiredAt.IsZero()
+}
+
+// Verifies reports whether tokens signed with the key can still be valid at
+// now, given that tokens live for at most ttl.
+func (k *Key) Verifies(now time.Time, ttl time.Duration) bool {
+	return !k.Retired() || now.Before(k.RetiredAt.Add(ttl))
+}
+
+func (k *Key) signingMethod() jwt.SigningMethod {
+	if k.Algorithm == "RS256" {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+// keyRecord is the on-disk form of a Key.
+type keyRecord struct {
+	ID         string `json:"kid"`
+	Algorithm  string `json:"alg"`
+	CreatedAt  int64  `json:"created_at"`
+	RetiredAt  int64  `json:"retired_at,omitempty"`
+	PrivateKey string `json:"private_key"`
+}
+
+type keyFile struct {
+	Keys []keyRecord `json:"keys"`
+}
+
+// LoadKeys reads the keys stored in path.
+func LoadKeys(path string) ([]*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+
+	keys := make([]*Key, 0, len(file.Keys))
+	for _, record := range file.Keys {
+		block, _ := pem.Decode([]byte(record.PrivateKey))
+		if block == nil {
+			return nil, fmt.Errorf("key %s: invalid PEM data", record.ID)
+		}
+
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", record.ID, err)
+		}
+
+		private, ok := parsed.(crypto.Signer)
+		if !ok || !matchesAlgorithm(private, record.Algorithm) {
+			return nil, fmt.Errorf("key %s: not a valid %s key", record.ID, record.Algorithm)
+		}
+
+		key := &Key{
+			ID:        record.ID,
+			Algorithm: record.Algorithm,
+			CreatedAt: time.Unix(record.CreatedAt, 0),
+			private:   private,
+		}
+		if record.RetiredAt != 0 {
+			key.RetiredAt = time.Unix(record.RetiredAt, 0)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// SaveKeys atomically replaces the contents of path with keys. The file is
+// only readable by its owner since it holds private keys.
+func SaveKeys(path string, keys []*Key) error {
+	file := keyFile{Keys: make([]keyRecord, 0, len(keys))}
+	for _, key := range keys {
+		der, err := x509.MarshalPKCS8PrivateKey(key.private)
+		if err != nil {
+			return fmt.Errorf("key %s: %v", key.ID, err)
+		}
+
+		record := keyRecord{
+			ID:         key.ID,
+			Algorithm:  key.Algorithm,
+			CreatedAt:  key.CreatedAt.Unix(),
+			PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		}
+		if key.Retired() {
+			record.RetiredAt = key.RetiredAt.Unix()
+		}
+		file.Keys = append(file.Keys, record)
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// FindKey returns the key with the given ID.
+func FindKey(keys []*Key, id string) (*Key, error) {
+	for _, key := range keys {
+		if key.ID == id {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no key with ID %s", id)
+}
+
+// SigningKey returns the newest active key for alg, or nil if there is none.
+func SigningKey(keys []*Key, alg string) *Key {
+	var signing *Key
+	for _, key := range keys {
+		if key.Retired() || key.Algorithm != alg {
+			continue
+		}
+		if signing == nil || key.CreatedAt.After(signing.CreatedAt) {
+			signing = key
+		}
+	}
+	return signing
+}
+
+// Rotate returns a copy of keys with a new key for alg added, every other
+// active key retired and keys that no longer verify any unexpired token
+// dropped.
+func Rotate(keys []*Key, alg string, ttl time.Duration) ([]*Key, *Key, error) {
+	key, err := GenerateKey(alg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rotated := make([]*Key, 0, len(keys)+1)
+	for _, old := range keys {
+		retired := *old
+		if !retired.Retired() {
+			retired.RetiredAt = key.CreatedAt
+		}
+		if retired.Verifies(key.CreatedAt, ttl) {
+			rotated = append(rotated, &retired)
+		}
+	}
+
+	return append(rotated, key), key, nil
+}
+
+// Prune returns the keys that still verify unexpired tokens at now.
+func Prune(keys []*Key, now time.Time, ttl time.Duration) []*Key {
+	kept := make([]*Key, 0, len(keys))
+	for _, key := range keys {
+		if key.Verifies(now, ttl) {
+			kept = append(kept, key)
+		}
+	}
+	return kept
+}
+
+func matchesAlgorithm(private crypto.Signer, alg string) bool {
+	switch private.(type) {
+	case *rsa.PrivateKey:
+		return alg == "RS256"
+	case ed25519.PrivateKey:
+		return alg == "EdDSA"
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package token
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// KeyStore holds the signing keys kept in a key file. It picks up changes
+// made to the file by other instances or the keys command, and rotates the
+// signing key on schedule.
+type KeyStore struct {
+	path             string
+	alg              string
+	rotationInterval time.Duration
+	ttl              time.Duration
+
+	mutex   sync.RWMutex
+	keys    []*Key
+	modTime time.Time
+}
+
+// OpenKeyStore loads the keys in path. If the file does not exist or holds
+// no active key for alg, a new key is generated and saved. Tokens live for
+// at most ttl, which is how long retired keys keep verifying.
+func OpenKeyStore(path, alg string, rotationInterval, ttl time.Duration) (*KeyStore, error) {
+	s := &KeyStore{
+		path:             path,
+		alg:              alg,
+		rotationInterval: rotationInterval,
+		ttl:              ttl,
+	}
+
+	if err := s.reload(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if err := s.rotateIfDue(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// SigningKey returns the key new tokens are signed with.
+func (s *KeyStore) SigningKey() *Key {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return SigningKey(s.keys, s.alg)
+}
+
+// Key returns the key with the given ID if it may still verify tokens. An
+// unknown ID makes the store check the key file first, since another
+// instance may have just rotated.
+func (s *KeyStore) Key(id string) (*Key, bool) {
+	if key, ok := s.find(id); ok {
+		return key, true
+	}
+
+	if err := s.reload(); err != nil {
+		log.Printf("error reloading signing keys: %v", err)
+		return nil, false
+	}
+	return s.find(id)
+}
+
+// Keys returns every key that may still verify tokens.
+func (s *KeyStore) Keys() []*Key {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return Prune(s.keys, time.Now(), s.ttl)
+}
+
+// Watch reloads the key file when it changes and rotates the signing key
+// when it is due, checking every interval until done is closed.
+func (s *KeyStore) Watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.reload(); err != nil {
+				log.Printf("error reloading signing keys: %v", err)
+				continue
+			}
+			if err := s.rotateIfDue(); err != nil {
+				log.Printf("error rotating signing key: %v", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *KeyStore) find(id string) (*Key, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, key := range s.keys {
+		if key.ID == id {
+			return key, key.Verifies(time.Now(), s.ttl)
+		}
+	}
+	return nil, false
+}
+
+// reload reads the key file if it changed since it was last read.
+func (s *KeyStore) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.RLock()
+	unchanged := info.ModTime().Equal(s.modTime)
+	s.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	keys, err := LoadKeys(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = keys
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// rotateIfDue generates a new signing key when there is none or the current
+// one is older than the rotation interval.
+func (s *KeyStore) rotateIfDue() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	signing := SigningKey(s.keys, s.alg)
+	if signing != nil && (s.rotationInterval == 0 || time.Since(signing.CreatedAt) < s.rotationInterval) {
+		return nil
+	}
+
+	keys, key, err := Rotate(s.keys, s.alg, s.ttl)
+	if err != nil {
+		return err
+	}
+
+	if err := SaveKeys(s.path, keys); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	s.keys = keys
+
+	log.Printf("Generated %s signing key %s", s.alg, key.ID)
+	return nil
+}
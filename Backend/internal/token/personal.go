@@ -0,0 +1,46 @@
+package token
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Scopes limit what a personal access token may be used for. Access tokens
+// from a login session are not limited.
+const (
+	ScopeMessagesRead  = "messages:read"
+	ScopeMessagesWrite = "messages:write"
+	ScopeAdmin         = "admin"
+)
+
+// Scopes lists every scope a personal access token can be granted.
+var Scopes = []string{ScopeMessagesRead, ScopeMessagesWrite, ScopeAdmin}
+
+// PersonalPrefix starts every personal access token, telling them apart
+// from JWTs and making leaked ones easy to scan for.
+const PersonalPrefix = "whp_"
+
+// NewPersonal returns a new personal access token.
+func NewPersonal() (string, error) {
+	opaque, err := NewOpaque()
+	if err != nil {
+		return "", err
+	}
+	return PersonalPrefix + opaque, nil
+}
+
+// PersonalSessionID is the session ID in the claims of a personal access
+// token, under which its websocket connections can be disconnected.
+func PersonalSessionID(tokenID int64) string {
+	return fmt.Sprintf("pat:%d", tokenID)
+}
+
+// Personal reports whether the claims belong to a personal access token.
+func (c *Claims) Personal() bool {
+	return c.Scopes != nil
+}
+
+// Allows reports whether the token may be used for scope.
+func (c *Claims) Allows(scope string) bool {
+	return !c.Personal() || slices.Contains(c.Scopes, scope)
+}
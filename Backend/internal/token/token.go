@@ -0,0 +1,186 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hdngo/whisper/internal/config"
+)
+
+// Claims are the claims carried by an access token. SessionID ties the token
+// to the server-side session it was issued for. Personal access tokens are
+// described by the same claims, with the scopes they were granted and
+// whether they belong to a bot.
+type Claims struct {
+	UserID    int64    `json:"user_id"`
+	Username  string   `json:"username"`
+	SessionID string   `json:"sid"`
+	Scopes    []string `json:"-"`
+	Bot       bool     `json:"-"`
+	jwt.RegisteredClaims
+}
+
+// Expiry returns the expiry time of the token, or the zero time if it has
+// none.
+func (c *Claims) Expiry() time.Time {
+	if c.ExpiresAt == nil {
+		return time.Time{}
+	}
+	return c.ExpiresAt.Time
+}
+
+// keyCheckInterval is how often the key file is checked for changes and
+// due rotations.
+const keyCheckInterval = time.Minute
+
+// Manager issues and verifies access tokens, either with a shared HS256
+// secret or with the RS256/EdDSA keys in a KeyStore.
+type Manager struct {
+	secret    []byte
+	keys      *KeyStore
+	accessTTL time.Duration
+}
+
+// NewManager creates a Manager for the configured signing algorithm,
+// opening the key file for asymmetric algorithms.
+func NewManager(cfg config.AuthConfig) (*Manager, error) {
+	m := &Manager{
+		secret:    []byte(cfg.JWTSecret),
+		accessTTL: cfg.AccessTokenTTL,
+	}
+
+	if cfg.SigningAlgorithm != jwt.SigningMethodHS256.Alg() {
+		keys, err := OpenKeyStore(cfg.KeysFile, cfg.SigningAlgorithm, cfg.KeyRotationInterval, cfg.AccessTokenTTL)
+		if err != nil {
+			return nil, err
+		}
+		m.keys = keys
+	}
+
+	return m, nil
+}
+
+// Run keeps the signing keys up to date. It returns immediately when
+// signing with a shared secret.
+func (m *Manager) Run() {
+	if m.keys == nil {
+		return
+	}
+	m.keys.Watch(keyCheckInterval, nil)
+}
+
+// Issue signs a new access token for the given session.
+func (m *Manager) Issue(userID int64, username, sessionID string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(m.accessTTL)
+
+	claims := &Claims{
+		UserID:    userID,
+		Username:  username,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	var signed string
+	var err error
+	if m.keys == nil {
+		signed, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(m.secret)
+	} else {
+		key := m.keys.SigningKey()
+		if key == nil {
+			return "", time.Time{}, errors.New("no active signing key")
+		}
+		token := jwt.NewWithClaims(key.signingMethod(), claims)
+		token.Header["kid"] = key.ID
+		signed, err = token.SignedString(key.private)
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return signed, expiresAt, nil
+}
+
+// Parse verifies the signature and expiry of an access token and returns
+// its claims. It does not check whether the session is still active.
+func (m *Manager) Parse(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, m.verificationKey,
+		jwt.WithValidMethods(m.validMethods()), jwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	if claims.SessionID == "" {
+		return nil, errors.New("invalid token claims")
+	}
+
+	return claims, nil
+}
+
+// JWKS returns the public keys that currently verify tokens. It is empty
+// when signing with a shared secret, which cannot be published.
+func (m *Manager) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	if m.keys == nil {
+		return set
+	}
+
+	for _, key := range m.keys.Keys() {
+		set.Keys = append(set.Keys, NewJWK(key))
+	}
+	return set
+}
+
+func (m *Manager) validMethods() []string {
+	if m.keys == nil {
+		return []string{jwt.SigningMethodHS256.Alg()}
+	}
+	return []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+}
+
+func (m *Manager) verificationKey(token *jwt.Token) (interface{}, error) {
+	if m.keys == nil {
+		return m.secret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := m.keys.Key(kid)
+	if !ok || key.Algorithm != token.Method.Alg() {
+		return nil, errors.New("unknown signing key")
+	}
+	return key.Public(), nil
+}
+
+// NewOpaque returns a random URL-safe token suitable for refresh tokens and
+// other bearer secrets that are only ever compared by hash.
+func NewOpaque() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewID returns a random identifier for sessions and token families.
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Hash returns the hex SHA-256 digest under which an opaque token is stored.
+func Hash(opaque string) string {
+	sum := sha256.Sum256([]byte(opaque))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,112 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key from RFC 6238, "12345678901234567890".
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+// The RFC 6238 SHA1 test vectors, truncated to the last 6 of their 8
+// digits.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCodeRFC6238(t *testing.T) {
+	for _, v := range rfcVectors {
+		code, err := Code(rfcSecret, Step(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code at %d: %v", v.unix, err)
+		}
+		if code != v.code {
+			t.Errorf("Code at %d = %s, want %s", v.unix, code, v.code)
+		}
+	}
+}
+
+func TestValidateRFC6238(t *testing.T) {
+	for _, v := range rfcVectors {
+		at := time.Unix(v.unix, 0)
+		step, ok := Validate(rfcSecret, v.code, at, 0)
+		if !ok || step != Step(at) {
+			t.Errorf("Validate(%s) at %d = %d, %v; want %d, true", v.code, v.unix, step, ok, Step(at))
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	// 1111111109 is 29 seconds into its step, so 1111111111 is in the
+	// next one.
+	at := time.Unix(1111111111, 0)
+	current := Step(at)
+
+	tests := []struct {
+		name   string
+		offset int64
+		skew   int
+		ok     bool
+	}{
+		{"current step", 0, 0, true},
+		{"previous step without skew", -1, 0, false},
+		{"next step without skew", 1, 0, false},
+		{"previous step at skew 1", -1, 1, true},
+		{"next step at skew 1", 1, 1, true},
+		{"two steps back at skew 1", -2, 1, false},
+		{"two steps ahead at skew 1", 2, 1, false},
+		{"two steps back at skew 2", -2, 2, true},
+	}
+	for _, tt := range tests {
+		code, err := Code(rfcSecret, current+tt.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok := Validate(rfcSecret, code, at, tt.skew)
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v, want %v", tt.name, ok, tt.ok)
+		}
+		if ok && step != current+tt.offset {
+			t.Errorf("%s: step = %d, want %d", tt.name, step, current+tt.offset)
+		}
+	}
+}
+
+func TestValidateStepBoundary(t *testing.T) {
+	// The last second of a step and the first of the next have different
+	// codes.
+	last := time.Unix(59, 0)
+	first := time.Unix(60, 0)
+	code, _ := Code(rfcSecret, Step(last))
+
+	if _, ok := Validate(rfcSecret, code, first, 0); ok {
+		t.Error("code accepted in the next step without skew")
+	}
+	if _, ok := Validate(rfcSecret, code, first, 1); !ok {
+		t.Error("code rejected in the next step with skew 1")
+	}
+}
+
+func TestValidateFormat(t *testing.T) {
+	at := time.Unix(59, 0)
+	if _, ok := Validate(rfcSecret, "287 082", at, 0); !ok {
+		t.Error("code with a space rejected")
+	}
+	for _, code := range []string{"", "28708", "2870820", "abcdef"} {
+		if _, ok := Validate(rfcSecret, code, at, 1); ok {
+			t.Errorf("Validate(%q) accepted", code)
+		}
+	}
+	if _, ok := Validate("not base32!", "287082", at, 0); ok {
+		t.Error("invalid secret accepted")
+	}
+}
@@ -0,0 +1,230 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hdngo/whisper/internal/config"
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/repository"
+)
+
+// Headers sent with every delivery. The signature is "sha256=" followed by
+// the hex HMAC-SHA256, keyed with the webhook's secret, of the timestamp
+// header, a "." and the body.
+const (
+	HeaderEvent     = "X-Whisper-Event"
+	HeaderDelivery  = "X-Whisper-Delivery"
+	HeaderTimestamp = "X-Whisper-Timestamp"
+	HeaderSignature = "X-Whisper-Signature"
+)
+
+// claimBatch is how many due deliveries are sent per poll.
+const claimBatch = 20
+
+// Dispatcher queues chat messages for the configured webhooks and sends
+// them from the queue, retrying failures with exponential backoff.
+type Dispatcher struct {
+	repo   *repository.WebhookRepository
+	cfg    config.WebhooksConfig
+	client *http.Client
+
+	mutex     sync.RWMutex
+	endpoints []config.WebhookConfig
+}
+
+func NewDispatcher(repo *repository.WebhookRepository, cfg config.WebhooksConfig) *Dispatcher {
+	d := &Dispatcher{
+		repo:   repo,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+	d.SetEndpoints(cfg.Endpoints)
+	return d
+}
+
+// SetEndpoints replaces the configured webhooks. Queued deliveries to a
+// webhook that is no longer configured are dead-lettered.
+func (d *Dispatcher) SetEndpoints(endpoints []config.WebhookConfig) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.endpoints = endpoints
+}
+
+func (d *Dispatcher) endpoint(name string) (config.WebhookConfig, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	for _, endpoint := range d.endpoints {
+		if endpoint.Name == name {
+			return endpoint, true
+		}
+	}
+	return config.WebhookConfig{}, false
+}
+
+// MessageCreated queues a delivery of msg to every webhook it matches.
+func (d *Dispatcher) MessageCreated(msg *model.Message) {
+	d.mutex.RLock()
+	endpoints := d.endpoints
+	d.mutex.RUnlock()
+
+	var payload []byte
+	for _, endpoint := range endpoints {
+		if !matches(endpoint, msg.Content) {
+			continue
+		}
+
+		if payload == nil {
+			var err error
+			payload, err = json.Marshal(&model.WebhookEvent{
+				Event:     model.WebhookEventMessage,
+				Message:   msg,
+				CreatedAt: time.Now().Unix(),
+			})
+			if err != nil {
+				log.Printf("error marshalling webhook event: %v", err)
+				return
+			}
+		}
+
+		if err := d.repo.Enqueue(context.Background(), endpoint.Name, model.WebhookEventMessage, payload); err != nil {
+			log.Printf("error queueing delivery to webhook %s: %v", endpoint.Name, err)
+		}
+	}
+}
+
+func matches(endpoint config.WebhookConfig, content string) bool {
+	if len(endpoint.Keywords) == 0 {
+		return true
+	}
+
+	content = strings.ToLower(content)
+	for _, keyword := range endpoint.Keywords {
+		if strings.Contains(content, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run sends due deliveries from the queue. It does not return.
+func (d *Dispatcher) Run() {
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		d.sendDue(context.Background())
+	}
+}
+
+func (d *Dispatcher) sendDue(ctx context.Context) {
+	// A claimed delivery is not retried by anyone else until the request
+	// has had time to finish.
+	deliveries, err := d.repo.ClaimDue(ctx, claimBatch, 2*d.cfg.Timeout)
+	if err != nil {
+		log.Printf("error claiming webhook deliveries: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := range deliveries {
+		wg.Add(1)
+		go func(delivery *model.WebhookDelivery) {
+			defer wg.Done()
+			d.attempt(ctx, delivery)
+		}(&deliveries[i])
+	}
+	wg.Wait()
+}
+
+// attempt sends a delivery once and records the outcome, scheduling a retry
+// or dead-lettering it on failure.
+func (d *Dispatcher) attempt(ctx context.Context, delivery *model.WebhookDelivery) {
+	delivery.Attempts++
+	delivery.ResponseStatus = 0
+	delivery.LastError = ""
+
+	endpoint, ok := d.endpoint(delivery.Webhook)
+	if !ok {
+		delivery.Status = model.DeliveryDead
+		delivery.LastError = "webhook is no longer configured"
+	} else if status, err := d.send(ctx, endpoint, delivery); err == nil {
+		delivery.Status = model.DeliveryDelivered
+		delivery.ResponseStatus = status
+		delivery.DeliveredAt = time.Now().Unix()
+	} else {
+		delivery.ResponseStatus = status
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= d.cfg.MaxAttempts {
+			delivery.Status = model.DeliveryDead
+		} else {
+			delivery.NextAttemptAt = time.Now().Add(d.backoff(delivery.Attempts)).Unix()
+		}
+	}
+
+	if delivery.Status == model.DeliveryDead {
+		log.Printf("webhook %s delivery %d dead-lettered after %d attempts: %s", delivery.Webhook, delivery.ID, delivery.Attempts, delivery.LastError)
+	}
+	if err := d.repo.RecordAttempt(context.Background(), delivery); err != nil {
+		log.Printf("error recording webhook delivery %d: %v", delivery.ID, err)
+	}
+}
+
+// backoff is the wait after the given number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.cfg.BackoffBase
+	for i := 1; i < attempts && wait < d.cfg.BackoffMax; i++ {
+		wait *= 2
+	}
+	return min(wait, d.cfg.BackoffMax)
+}
+
+// send POSTs the signed delivery and returns the response status, with an
+// error unless it was a 2xx.
+func (d *Dispatcher) send(ctx context.Context, endpoint config.WebhookConfig, delivery *model.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "whisper-webhooks")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(endpoint.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the signature header value for a body sent at timestamp.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,134 @@
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hdngo/whisper/internal/token"
+)
+
+const shrug = `¯\_(ツ)_/¯`
+
+// registerBuiltinCommands adds the commands every server has.
+func (h *Hub) registerBuiltinCommands() {
+	h.commands.Register(&Command{
+		Name:        "help",
+		Usage:       "[command]",
+		Description: "list the commands, or show how to use one",
+		Run:         h.helpCommand,
+	})
+	h.commands.Register(&Command{
+		Name:        "me",
+		Usage:       "<action>",
+		Description: "post an action, e.g. /me waves",
+		MinArgs:     1,
+		Post:        true,
+		Run: func(call *CommandCall) error {
+			return call.Post("* " + call.Username + " " + call.Text)
+		},
+	})
+	h.commands.Register(&Command{
+		Name:        "shrug",
+		Usage:       "[message]",
+		Description: "post a message followed by " + shrug,
+		Post:        true,
+		Run: func(call *CommandCall) error {
+			return call.Post(strings.TrimSpace(call.Text + " " + shrug))
+		},
+	})
+	h.commands.Register(&Command{
+		Name:        "topic",
+		Usage:       "[topic]",
+		Description: "show the topic, or change it for everyone",
+		Run:         h.topicCommand,
+	})
+	h.commands.Register(&Command{
+		Name:        "who",
+		Description: "list who is online",
+		Run: func(call *CommandCall) error {
+			users := h.onlineUsers()
+			call.Reply(fmt.Sprintf("%d online: %s", len(users), strings.Join(users, ", ")))
+			return nil
+		},
+	})
+	h.commands.Register(&Command{
+		Name:        "mute",
+		Usage:       "[username]",
+		Description: "hide a user's messages on this connection, or list the muted users",
+		Run:         muteCommand,
+	})
+	h.commands.Register(&Command{
+		Name:        "unmute",
+		Usage:       "<username>",
+		Description: "show a muted user's messages again",
+		MinArgs:     1,
+		Run: func(call *CommandCall) error {
+			if !call.client.setMuted(call.Args[0], false) {
+				return fmt.Errorf("%s is not muted", call.Args[0])
+			}
+			call.Reply("Unmuted " + call.Args[0])
+			return nil
+		},
+	})
+}
+
+func (h *Hub) helpCommand(call *CommandCall) error {
+	if len(call.Args) > 0 {
+		name := strings.TrimPrefix(strings.ToLower(call.Args[0]), "/")
+		cmd := h.commands.Lookup(name)
+		if cmd == nil {
+			return fmt.Errorf("unknown command /%s", name)
+		}
+		call.Reply(cmd.Synopsis() + " - " + cmd.Description)
+		return nil
+	}
+
+	lines := []string{"Commands:"}
+	for _, cmd := range h.commands.List() {
+		lines = append(lines, cmd.Synopsis()+" - "+cmd.Description)
+	}
+	call.Reply(strings.Join(lines, "\n"))
+	return nil
+}
+
+func (h *Hub) topicCommand(call *CommandCall) error {
+	if call.Text == "" {
+		if topic := h.Topic(); topic != "" {
+			call.Reply("The topic is: " + topic)
+		} else {
+			call.Reply("No topic is set")
+		}
+		return nil
+	}
+
+	if !call.client.canPost {
+		return errors.New("token lacks the " + token.ScopeMessagesWrite + " scope")
+	}
+	if int64(len(call.Text)) > h.config().MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	h.SetTopic(h.filterContent(call.Text), call.Username)
+	return nil
+}
+
+func muteCommand(call *CommandCall) error {
+	if len(call.Args) == 0 {
+		if muted := call.client.mutedUsers(); len(muted) > 0 {
+			call.Reply("Muted: " + strings.Join(muted, ", "))
+		} else {
+			call.Reply("Nobody is muted")
+		}
+		return nil
+	}
+
+	username := call.Args[0]
+	if username == call.Username {
+		return errors.New("you cannot mute yourself")
+	}
+	if !call.client.setMuted(username, true) {
+		return fmt.Errorf("%s is already muted", username)
+	}
+	call.Reply("Muted " + username + " until you reconnect")
+	return nil
+}
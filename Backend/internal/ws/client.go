@@ -1,53 +1,115 @@
 package ws
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/hdngo/whisper/internal/config"
 	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/token"
 )
 
+// Application close codes sent to clients when the server ends a connection.
 const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
+	// CloseTokenExpired means the access token expired without being
+	// renewed in-band.
+	CloseTokenExpired = 4001
+	// CloseSessionRevoked means the session the connection belongs to was
+	// logged out or revoked.
+	CloseSessionRevoked = 4003
 )
 
 type Client struct {
-	hub      *Hub
-	conn     *websocket.Conn
-	send     chan []byte
-	userID   int64
-	username string
+	hub       *Hub
+	conn      *websocket.Conn
+	send      chan []byte
+	userID    int64
+	username  string
+	sessionID string
+	ip        string
+	canPost   bool
+	bot       bool
+	expiresAt time.Time
+	reauth    chan authResult
+	kick      chan int
+
+	// cfg holds the settings when the client connected. Those that can be
+	// reloaded are read from the hub instead.
+	cfg config.WebSocketConfig
+
+	// ctx is cancelled when the connection closes, so that work done for
+	// it, such as calling an external command, does not outlive it.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// sendMutex guards sends on send against it being closed, which only
+	// closeSend does.
+	sendMutex sync.Mutex
+	closed    bool
+
+	// Usernames whose chat messages are not sent to this connection
+	mutesMutex sync.RWMutex
+	mutes      map[string]bool
+
+	// Messages sent in the current rate limit window, only used by ReadPump
+	sent      int
+	windowEnd time.Time
 }
 
-func NewClient(hub *Hub, conn *websocket.Conn, userID int64, username string) *Client {
+// authResult carries the outcome of an in-band auth frame from ReadPump to
+// WritePump, which owns the connection's expiry timers and all writes.
+type authResult struct {
+	claims *token.Claims
+	err    error
+}
+
+func NewClient(hub *Hub, conn *websocket.Conn, claims *token.Claims, ip string) *Client {
+	cfg := hub.config()
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Client{
-		hub:      hub,
-		conn:     conn,
-		send:     make(chan []byte, 256),
-		userID:   userID,
-		username: username,
+		hub:       hub,
+		conn:      conn,
+		send:      make(chan []byte, cfg.SendBufferSize),
+		userID:    claims.UserID,
+		username:  claims.Username,
+		sessionID: claims.SessionID,
+		ip:        ip,
+		canPost:   claims.Allows(token.ScopeMessagesWrite),
+		bot:       claims.Bot,
+		expiresAt: claims.Expiry(),
+		cfg:       cfg,
+		reauth:    make(chan authResult, 1),
+		kick:      make(chan int, 1),
+		mutes:     make(map[string]bool),
+		ctx:       ctx,
+		cancel:    cancel,
 	}
 }
 
 func (c *Client) ReadPump() {
 	defer func() {
 		c.hub.Unregister <- c
+		c.cancel()
 		c.conn.Close()
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
 		return nil
 	})
 
 	for {
+		// The limit is reloadable, so it is read again for every message
+		c.conn.SetReadLimit(c.hub.config().MaxMessageSize)
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
@@ -56,39 +118,225 @@ func (c *Client) ReadPump() {
 			break
 		}
 
-		content := string(message)
+		var frame model.WSInbound
+		if json.Unmarshal(message, &frame) == nil {
+			switch frame.Type {
+			case model.MessageTypeAuth:
+				c.handleAuth(frame.Payload)
+				continue
+			case model.MessageTypeRead:
+				c.handleRead(frame.Payload)
+				continue
+			}
+		}
 
-		wsMsg := &model.WSMessage{
-			Type: model.MessageTypeChat,
-			Payload: map[string]interface{}{
-				"content":    content,
-				"user_id":    c.userID,
-				"username":   c.username,
-				"created_at": time.Now().Unix(),
-			},
+		if !c.allowMessage() {
+			continue
 		}
 
-		msgBytes, err := json.Marshal(wsMsg)
-		if err != nil {
-			log.Printf("error marshalling message: %v", err)
+		content := string(message)
+		if name, text, ok := ParseCommand(content); ok {
+			c.runCommand(name, text)
+			continue
+		}
+
+		if !c.canPost {
+			c.notify(model.SystemKindError, "token lacks the "+token.ScopeMessagesWrite+" scope")
 			continue
 		}
 
-		c.hub.Broadcast <- msgBytes
+		// A doubled slash sends a message starting with a slash
+		if strings.HasPrefix(content, "//") {
+			content = content[1:]
+		}
+		err = c.hub.PostMessage(c.userID, c.username, content, c.bot)
+		if errors.Is(err, ErrMessageTooLarge) {
+			c.notify(model.SystemKindError, "message too large")
+		} else if err != nil {
+			log.Printf("error posting message: %v", err)
+			c.notify(model.SystemKindError, "failed to send message")
+		} else if c.hub.filterContent(content) != content {
+			c.notify(model.SystemKindModeration, "Some words in your message were masked")
+		}
+	}
+}
+
+// handleAuth validates a fresh access token sent in-band. The token must
+// belong to the same session the connection was opened with.
+func (c *Client) handleAuth(payload json.RawMessage) {
+	var result authResult
+
+	var auth model.AuthPayload
+	if err := json.Unmarshal(payload, &auth); err != nil {
+		result.err = errors.New("invalid auth payload")
+	} else if claims, err := c.hub.authenticate(context.Background(), auth.Token, c.ip); err != nil {
+		result.err = err
+	} else if claims.UserID != c.userID || claims.SessionID != c.sessionID {
+		result.err = errors.New("token belongs to a different session")
+	} else {
+		result.claims = claims
+	}
+
+	// Drop the result if one is already pending rather than block reads.
+	select {
+	case c.reauth <- result:
+	default:
+	}
+}
+
+// handleRead moves the user's read marker forward. The new state reaches
+// the client as a read_state event.
+func (c *Client) handleRead(payload json.RawMessage) {
+	markRead := c.hub.readMarker()
+	if markRead == nil {
+		c.notify(model.SystemKindError, "read markers are not available")
+		return
+	}
+
+	var read model.ReadRequest
+	if err := json.Unmarshal(payload, &read); err != nil || read.MessageID <= 0 {
+		c.notify(model.SystemKindError, "invalid read payload")
+		return
+	}
+
+	if _, err := markRead(context.Background(), c.userID, c.username, read.MessageID); err != nil {
+		log.Printf("error marking messages read for %s: %v", c.username, err)
+		c.notify(model.SystemKindError, "failed to mark messages read")
+	}
+}
+
+// notify sends a system message to this connection only.
+func (c *Client) notify(kind, text string) {
+	c.hub.SendToClient(c, model.MessageTypeSystem, &model.SystemMessage{Kind: kind, Text: text})
+}
+
+// queue adds a message to the send buffer. It reports false, dropping the
+// message, if the buffer is full or the client has been closed.
+func (c *Client) queue(message []byte) bool {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.send <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeSend closes the send buffer, which ends WritePump. It is safe to
+// call more than once and concurrently with queue.
+func (c *Client) closeSend() {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
 	}
 }
 
+// allowMessage counts a chat message or command against the connection's
+// rate limit. The first message over the limit in a window is answered
+// with a warning; the rest are dropped silently.
+func (c *Client) allowMessage() bool {
+	cfg := c.hub.config()
+	if cfg.RateLimit == 0 {
+		return true
+	}
+
+	now := time.Now()
+	if now.After(c.windowEnd) {
+		c.windowEnd = now.Add(cfg.RateWindow)
+		c.sent = 0
+	}
+	c.sent++
+
+	if c.sent == cfg.RateLimit+1 {
+		wait := c.windowEnd.Sub(now).Round(time.Second)
+		c.notify(model.SystemKindRateLimit, fmt.Sprintf("You are sending messages too fast, wait %s", max(wait, time.Second)))
+	}
+	return c.sent <= cfg.RateLimit
+}
+
+// setMuted mutes or unmutes username, reporting whether that changed
+// anything.
+func (c *Client) setMuted(username string, muted bool) bool {
+	c.mutesMutex.Lock()
+	defer c.mutesMutex.Unlock()
+	if c.mutes[username] == muted {
+		return false
+	}
+	if muted {
+		c.mutes[username] = true
+	} else {
+		delete(c.mutes, username)
+	}
+	return true
+}
+
+func (c *Client) isMuted(username string) bool {
+	c.mutesMutex.RLock()
+	defer c.mutesMutex.RUnlock()
+	return c.mutes[username]
+}
+
+func (c *Client) mutedUsers() []string {
+	c.mutesMutex.RLock()
+	defer c.mutesMutex.RUnlock()
+	users := make([]string, 0, len(c.mutes))
+	for username := range c.mutes {
+		users = append(users, username)
+	}
+	slices.Sort(users)
+	return users
+}
+
 func (c *Client) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.cfg.PingPeriod())
+	warnTimer := time.NewTimer(0)
+	expiryTimer := time.NewTimer(0)
+	c.scheduleExpiry(warnTimer, expiryTimer)
 	defer func() {
 		ticker.Stop()
+		warnTimer.Stop()
+		expiryTimer.Stop()
+		c.cancel()
 		c.conn.Close()
 	}()
 
 	for {
 		select {
+		case <-warnTimer.C:
+			if err := c.writeJSON(model.MessageTypeTokenExpiring, map[string]int64{"expires_at": c.expiresAt.Unix()}); err != nil {
+				return
+			}
+
+		case <-expiryTimer.C:
+			c.writeClose(CloseTokenExpired)
+			return
+
+		case code := <-c.kick:
+			c.writeClose(code)
+			return
+
+		case result := <-c.reauth:
+			if result.err != nil {
+				if err := c.writeJSON(model.MessageTypeAuthError, map[string]string{"error": result.err.Error()}); err != nil {
+					return
+				}
+				continue
+			}
+
+			c.expiresAt = result.claims.Expiry()
+			c.scheduleExpiry(warnTimer, expiryTimer)
+			if err := c.writeJSON(model.MessageTypeAuthOK, map[string]int64{"expires_at": c.expiresAt.Unix()}); err != nil {
+				return
+			}
+
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
 			if !ok {
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
@@ -105,10 +353,52 @@ func (c *Client) WritePump() {
 			}
 
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
 		}
 	}
 }
+
+// scheduleExpiry sets the timers for the expiry warning and close of the
+// current token. Personal access tokens that never expire stop both.
+func (c *Client) scheduleExpiry(warnTimer, expiryTimer *time.Timer) {
+	warnTimer.Stop()
+	expiryTimer.Stop()
+	if c.expiresAt.IsZero() {
+		return
+	}
+
+	warnTimer.Reset(time.Until(c.expiresAt.Add(-c.hub.expiryWarning)))
+	expiryTimer.Reset(time.Until(c.expiresAt))
+}
+
+// writeJSON writes a server event directly to the connection. It must only
+// be called from WritePump.
+func (c *Client) writeJSON(msgType string, payload interface{}) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
+	return c.conn.WriteJSON(&model.WSMessage{
+		Type:    msgType,
+		Payload: payload,
+	})
+}
+
+var closeReasons = map[int]string{
+	CloseTokenExpired:   "token expired",
+	CloseSessionRevoked: "session revoked",
+}
+
+// Close asks WritePump to send a close frame with the given code and end
+// the connection.
+func (c *Client) Close(code int) {
+	select {
+	case c.kick <- code:
+	default:
+	}
+}
+
+func (c *Client) writeClose(code int) {
+	c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
+	c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, closeReasons[code]))
+}
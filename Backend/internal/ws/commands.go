@@ -0,0 +1,331 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/hdngo/whisper/internal/config"
+	"github.com/hdngo/whisper/internal/model"
+	"github.com/hdngo/whisper/internal/token"
+	"github.com/hdngo/whisper/internal/webhook"
+)
+
+// Command is a slash command typed into the chat as /Name followed by its
+// arguments. Run is called on the invoking connection's read goroutine,
+// unless the command is Async.
+type Command struct {
+	Name        string
+	Usage       string
+	Description string
+	// MinArgs is the number of arguments below which the usage is shown
+	// instead of running the command.
+	MinArgs int
+	// Post marks commands that send chat messages or events to everyone,
+	// which tokens without the messages:write scope may not run.
+	Post bool
+	// Async commands run on their own goroutine, so that a slow one does
+	// not stop the connection from reading frames meanwhile.
+	Async bool
+	Run   func(call *CommandCall) error
+}
+
+// CommandCall is one invocation of a command. Text is everything typed
+// after the command name and Args is Text split into words, keeping
+// double-quoted phrases together.
+type CommandCall struct {
+	Name     string
+	Text     string
+	Args     []string
+	UserID   int64
+	Username string
+
+	client *Client
+}
+
+// Reply sends text to the invoking connection only.
+func (call *CommandCall) Reply(text string) {
+	call.client.commandMessage(model.SystemKindCommand, call.Name, text)
+}
+
+// Post sends content to the chat as a message from the invoking user.
+func (call *CommandCall) Post(content string) error {
+	return call.client.hub.PostMessage(call.UserID, call.Username, content, call.client.bot)
+}
+
+// Commands is the registry of slash commands: those registered in code,
+// and the external ones configured under commands.endpoints, which are
+// POSTed to an HTTP service.
+type Commands struct {
+	mutex    sync.RWMutex
+	builtin  map[string]*Command
+	external map[string]*Command
+	client   *http.Client
+}
+
+func NewCommands() *Commands {
+	return &Commands{
+		builtin:  make(map[string]*Command),
+		external: make(map[string]*Command),
+		client:   &http.Client{Timeout: config.Default().Commands.Timeout},
+	}
+}
+
+// Register adds a command, replacing any registered earlier with the same
+// name.
+func (r *Commands) Register(cmd *Command) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.builtin[cmd.Name] = cmd
+}
+
+// SetConfig replaces the external commands. Names taken by a registered
+// command are ignored.
+func (r *Commands) SetConfig(cfg config.CommandsConfig) {
+	external := make(map[string]*Command, len(cfg.Endpoints))
+	for _, endpoint := range cfg.Endpoints {
+		external[endpoint.Name] = r.externalCommand(endpoint)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for name := range external {
+		if r.builtin[name] != nil {
+			log.Printf("external command /%s ignored, it is a built-in command", name)
+			delete(external, name)
+		}
+	}
+	r.external = external
+	r.client = &http.Client{Timeout: cfg.Timeout}
+}
+
+// Lookup returns the command with the given name, or nil.
+func (r *Commands) Lookup(name string) *Command {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if cmd := r.builtin[name]; cmd != nil {
+		return cmd
+	}
+	return r.external[name]
+}
+
+// List returns every command, sorted by name.
+func (r *Commands) List() []*Command {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	cmds := make([]*Command, 0, len(r.builtin)+len(r.external))
+	for _, cmd := range r.builtin {
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range r.external {
+		cmds = append(cmds, cmd)
+	}
+	slices.SortFunc(cmds, func(a, b *Command) int { return strings.Compare(a.Name, b.Name) })
+	return cmds
+}
+
+func (r *Commands) httpClient() *http.Client {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.client
+}
+
+// ParseCommand splits a chat message into a command name and the text
+// after it. Only messages starting with a slash directly followed by a
+// letter are commands; anything else, such as a path or "/ ", is chat.
+func ParseCommand(message string) (name, text string, ok bool) {
+	if !strings.HasPrefix(message, "/") {
+		return "", "", false
+	}
+	if r, _ := utf8.DecodeRuneInString(message[1:]); !unicode.IsLetter(r) {
+		return "", "", false
+	}
+
+	rest := message[1:]
+	end := strings.IndexFunc(rest, unicode.IsSpace)
+	if end < 0 {
+		end = len(rest)
+	}
+	return strings.ToLower(rest[:end]), strings.TrimSpace(rest[end:]), true
+}
+
+// SplitArgs splits text into words, keeping double-quoted phrases
+// together.
+func SplitArgs(text string) []string {
+	var args []string
+	var arg strings.Builder
+	quoted, inArg := false, false
+
+	for _, r := range text {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case unicode.IsSpace(r) && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
+
+// Synopsis is how a command is typed, e.g. "/mute <username>".
+func (cmd *Command) Synopsis() string {
+	if cmd.Usage == "" {
+		return "/" + cmd.Name
+	}
+	return "/" + cmd.Name + " " + cmd.Usage
+}
+
+// runCommand runs a slash command typed by the client. Problems are sent
+// back to the client as system messages of the error kind.
+func (c *Client) runCommand(name, text string) {
+	cmd := c.hub.commands.Lookup(name)
+	if cmd == nil {
+		c.commandMessage(model.SystemKindError, name, fmt.Sprintf("unknown command /%s, type /help for a list", name))
+		return
+	}
+	if cmd.Post && !c.canPost {
+		c.commandMessage(model.SystemKindError, name, "token lacks the "+token.ScopeMessagesWrite+" scope")
+		return
+	}
+
+	call := &CommandCall{
+		Name:     cmd.Name,
+		Text:     text,
+		Args:     SplitArgs(text),
+		UserID:   c.userID,
+		Username: c.username,
+		client:   c,
+	}
+	if len(call.Args) < cmd.MinArgs {
+		c.commandMessage(model.SystemKindError, name, "usage: "+cmd.Synopsis())
+		return
+	}
+
+	if cmd.Async {
+		go c.finishCommand(cmd, call)
+		return
+	}
+	c.finishCommand(cmd, call)
+}
+
+// finishCommand runs a command and sends its error, if any, back to the
+// client.
+func (c *Client) finishCommand(cmd *Command, call *CommandCall) {
+	if err := cmd.Run(call); err != nil {
+		c.commandMessage(model.SystemKindError, call.Name, err.Error())
+	}
+}
+
+func (c *Client) commandMessage(kind, command, text string) {
+	c.hub.SendToClient(c, model.MessageTypeSystem, &model.SystemMessage{
+		Kind:    kind,
+		Text:    text,
+		Command: command,
+	})
+}
+
+// errCommandUnavailable is shown when an external command fails.
+var errCommandUnavailable = errors.New("the command failed, try again later")
+
+// externalCommand returns a command that POSTs each call, signed, to the
+// endpoint and shows or posts the text it answers with.
+func (r *Commands) externalCommand(endpoint config.CommandConfig) *Command {
+	return &Command{
+		Name:        endpoint.Name,
+		Usage:       endpoint.Usage,
+		Description: endpoint.Description,
+		Post:        true,
+		Async:       true,
+		Run: func(call *CommandCall) error {
+			resp, err := r.invoke(endpoint, call)
+			if call.client.ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				log.Printf("command /%s failed: %v", endpoint.Name, err)
+				return errCommandUnavailable
+			}
+
+			if resp.Text == "" {
+				return nil
+			}
+			if resp.ResponseType == model.CommandResponseInChannel {
+				return call.Post(resp.Text)
+			}
+			call.Reply(resp.Text)
+			return nil
+		},
+	}
+}
+
+func (r *Commands) invoke(endpoint config.CommandConfig, call *CommandCall) (*model.CommandResponse, error) {
+	body, err := json.Marshal(&model.CommandInvocation{
+		Command:  call.Name,
+		Text:     call.Text,
+		Args:     call.Args,
+		UserID:   call.UserID,
+		Username: call.Username,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The call is abandoned if the client goes away while it is running.
+	req, err := http.NewRequestWithContext(call.client.ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "whisper-commands")
+	req.Header.Set(webhook.HeaderTimestamp, timestamp)
+	req.Header.Set(webhook.HeaderSignature, webhook.Sign(endpoint.Secret, timestamp, body))
+
+	res, err := r.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("command endpoint responded %s", res.Status)
+	}
+
+	// An empty body means there is nothing to show.
+	var resp model.CommandResponse
+	data, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return &resp, nil
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("decoding command response: %w", err)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,38 @@
+package ws
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// WordFilter masks configured words in message content, matching whole
+// words without regard to case.
+type WordFilter struct {
+	pattern *regexp.Regexp
+}
+
+func NewWordFilter(words []string) *WordFilter {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return &WordFilter{}
+	}
+
+	return &WordFilter{
+		pattern: regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`),
+	}
+}
+
+func (f *WordFilter) Apply(content string) string {
+	if f.pattern == nil {
+		return content
+	}
+	return f.pattern.ReplaceAllStringFunc(content, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	})
+}
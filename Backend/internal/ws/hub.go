@@ -3,31 +3,245 @@ package ws
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"log/slog"
+	"slices"
 	"sync"
+	"time"
 
+	"github.com/hdngo/whisper/internal/config"
 	"github.com/hdngo/whisper/internal/model"
 	"github.com/hdngo/whisper/internal/repository"
+	"github.com/hdngo/whisper/internal/token"
 )
 
+// Authenticator validates an access token presented in-band by a connected
+// client, including that its session is still active.
+type Authenticator func(ctx context.Context, accessToken, ip string) (*token.Claims, error)
+
+// ReadMarker moves a user's read marker forward when a client sends a read
+// frame.
+type ReadMarker func(ctx context.Context, userID int64, username string, messageID int64) (*model.ReadState, error)
+
 type Hub struct {
 	clients    sync.Map
 	Broadcast  chan []byte
 	Register   chan *Client
 	Unregister chan *Client
+	direct     chan *directMessage
 	msgRepo    *repository.MessageRepository
 	mutex      sync.RWMutex
-	done       chan struct{}
+
+	authenticate  Authenticator
+	markRead      ReadMarker
+	expiryWarning time.Duration
+
+	done chan struct{}
+
+	settingsMutex sync.RWMutex
+	cfg           config.WebSocketConfig
+	presence      bool
+	filter        *WordFilter
+	listeners     []func(*model.Message)
+
+	commands *Commands
+
+	// Chat messages each user posted over the REST API in the current
+	// rate limit window
+	postRateMutex sync.Mutex
+	postWindowEnd time.Time
+	postCounts    map[int64]int
+
+	topicMutex sync.RWMutex
+	topic      string
+}
+
+// directMessage is an event for a single connection, or for every
+// connection of a user when client is nil.
+type directMessage struct {
+	client  *Client
+	userID  int64
+	message []byte
+}
+
+func NewHub(msgRepo *repository.MessageRepository, cfg config.WebSocketConfig, authenticate Authenticator, expiryWarning time.Duration) *Hub {
+	h := &Hub{
+		Broadcast:     make(chan []byte),
+		Register:      make(chan *Client),
+		Unregister:    make(chan *Client),
+		direct:        make(chan *directMessage),
+		msgRepo:       msgRepo,
+		done:          make(chan struct{}),
+		authenticate:  authenticate,
+		expiryWarning: expiryWarning,
+		cfg:           cfg,
+		presence:      true,
+		filter:        NewWordFilter(nil),
+		commands:      NewCommands(),
+		postCounts:    make(map[int64]int),
+	}
+	h.registerBuiltinCommands()
+	return h
+}
+
+// Commands returns the slash command registry.
+func (h *Hub) Commands() *Commands {
+	return h.commands
+}
+
+// Topic returns the chat topic set with /topic, if any. It is kept in
+// memory only.
+func (h *Hub) Topic() string {
+	h.topicMutex.RLock()
+	defer h.topicMutex.RUnlock()
+	return h.topic
+}
+
+// SetTopic changes the topic and tells every client who changed it.
+func (h *Hub) SetTopic(topic, username string) {
+	h.topicMutex.Lock()
+	h.topic = topic
+	h.topicMutex.Unlock()
+
+	msgBytes, err := json.Marshal(&model.WSMessage{
+		Type:    model.MessageTypeTopic,
+		Payload: &model.Topic{Topic: topic, Username: username},
+	})
+	if err != nil {
+		log.Printf("error marshalling topic: %v", err)
+		return
+	}
+	go h.broadcast(msgBytes)
+}
+
+// SetReadMarker sets the function handling read frames. Until it is set,
+// read frames are refused.
+func (h *Hub) SetReadMarker(markRead ReadMarker) {
+	h.settingsMutex.Lock()
+	defer h.settingsMutex.Unlock()
+	h.markRead = markRead
+}
+
+func (h *Hub) readMarker() ReadMarker {
+	h.settingsMutex.RLock()
+	defer h.settingsMutex.RUnlock()
+	return h.markRead
+}
+
+// SetConfig replaces the websocket settings. Buffer sizes and timeouts
+// apply to new connections; the maximum message size and rate limit apply
+// to every connection from its next message.
+func (h *Hub) SetConfig(cfg config.WebSocketConfig) {
+	h.settingsMutex.Lock()
+	defer h.settingsMutex.Unlock()
+	h.cfg = cfg
+}
+
+// SetPresence enables or disables join, leave and online user broadcasts.
+func (h *Hub) SetPresence(enabled bool) {
+	h.settingsMutex.Lock()
+	defer h.settingsMutex.Unlock()
+	h.presence = enabled
+}
+
+// SetFilterWords replaces the words masked in chat messages.
+func (h *Hub) SetFilterWords(words []string) {
+	filter := NewWordFilter(words)
+
+	h.settingsMutex.Lock()
+	defer h.settingsMutex.Unlock()
+	h.filter = filter
+}
+
+// OnMessage registers fn to be called with every chat message once it has
+// been stored.
+func (h *Hub) OnMessage(fn func(*model.Message)) {
+	h.settingsMutex.Lock()
+	defer h.settingsMutex.Unlock()
+	h.listeners = append(h.listeners, fn)
+}
+
+func (h *Hub) config() config.WebSocketConfig {
+	h.settingsMutex.RLock()
+	defer h.settingsMutex.RUnlock()
+	return h.cfg
+}
+
+func (h *Hub) presenceEnabled() bool {
+	h.settingsMutex.RLock()
+	defer h.settingsMutex.RUnlock()
+	return h.presence
+}
+
+func (h *Hub) filterContent(content string) string {
+	h.settingsMutex.RLock()
+	filter := h.filter
+	h.settingsMutex.RUnlock()
+	return filter.Apply(content)
+}
+
+// ErrMessageTooLarge is returned for messages longer than the websocket
+// message size limit.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// PostMessage filters content and broadcasts it as a chat message from the
+// user, to be stored like any other. Messages from bots are marked as such.
+func (h *Hub) PostMessage(userID int64, username, content string, bot bool) error {
+	return h.Post(&model.Message{UserID: userID, Username: username, Content: content, Bot: bot})
+}
+
+// Post is PostMessage for a message that may also carry a display name.
+// Its ID and time are assigned by the hub and the store.
+func (h *Hub) Post(msg *model.Message) error {
+	if int64(len(msg.Content)) > h.config().MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+
+	// The message is stored before it is broadcast, so that clients get
+	// its ID, and the stored and broadcast times are the same.
+	msg.Content = h.filterContent(msg.Content)
+	msg.CreatedAt = model.MessageTime()
+	if err := h.msgRepo.Create(context.Background(), msg); err != nil {
+		return err
+	}
+
+	msgBytes, err := json.Marshal(&model.WSMessage{
+		Type:    model.MessageTypeChat,
+		Payload: msg,
+	})
+	if err != nil {
+		return err
+	}
+
+	h.Broadcast <- msgBytes
+	go h.notifyListeners(msg)
+	return nil
 }
 
-func NewHub(msgRepo *repository.MessageRepository) *Hub {
-	return &Hub{
-		Broadcast:  make(chan []byte),
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
-		msgRepo:    msgRepo,
-		done:       make(chan struct{}),
+// AllowPost counts a chat message posted over the REST API against the
+// user's rate limit, which is websocket.rate_limit like for a connection.
+// When the message is refused, retryAfter is the time until the window
+// ends.
+func (h *Hub) AllowPost(userID int64) (ok bool, retryAfter time.Duration) {
+	cfg := h.config()
+	if cfg.RateLimit == 0 {
+		return true, 0
+	}
+
+	h.postRateMutex.Lock()
+	defer h.postRateMutex.Unlock()
+
+	now := time.Now()
+	if now.After(h.postWindowEnd) {
+		h.postWindowEnd = now.Add(cfg.RateWindow)
+		clear(h.postCounts)
 	}
+	h.postCounts[userID]++
+	if h.postCounts[userID] > cfg.RateLimit {
+		return false, h.postWindowEnd.Sub(now)
+	}
+	return true, 0
 }
 
 func (h *Hub) Run() {
@@ -45,6 +259,8 @@ func (h *Hub) Run() {
 			h.handleUnregister(client)
 		case message := <-h.Broadcast:
 			h.handleBroadcast(message)
+		case msg := <-h.direct:
+			h.handleDirect(msg)
 		case <-h.done:
 			return
 		}
@@ -64,11 +280,97 @@ func (h *Hub) Close() {
 	})
 }
 
+// BroadcastEvent sends an event to every connection. Unlike chat messages
+// it is not stored.
+func (h *Hub) BroadcastEvent(msgType string, payload interface{}) {
+	msgBytes, err := json.Marshal(&model.WSMessage{
+		Type:    msgType,
+		Payload: payload,
+	})
+	if err != nil {
+		log.Printf("error marshalling message: %v", err)
+		return
+	}
+	go h.broadcast(msgBytes)
+}
+
+// SendToUser sends an event to every connection of the user. Unlike chat
+// messages it is not stored.
+func (h *Hub) SendToUser(userID int64, msgType string, payload interface{}) {
+	h.send(&directMessage{userID: userID}, msgType, payload)
+}
+
+// SendToClient sends an event to a single connection.
+func (h *Hub) SendToClient(client *Client, msgType string, payload interface{}) {
+	h.send(&directMessage{client: client}, msgType, payload)
+}
+
+// Notify sends a system message of the given kind to every connection of
+// the user.
+func (h *Hub) Notify(userID int64, kind, text string) {
+	h.SendToUser(userID, model.MessageTypeSystem, &model.SystemMessage{Kind: kind, Text: text})
+}
+
+// send hands a direct message to the hub goroutine, so it must not be
+// called from there.
+func (h *Hub) send(msg *directMessage, msgType string, payload interface{}) {
+	var err error
+	msg.message, err = json.Marshal(&model.WSMessage{
+		Type:    msgType,
+		Payload: payload,
+	})
+	if err != nil {
+		log.Printf("error marshalling message: %v", err)
+		return
+	}
+
+	select {
+	case h.direct <- msg:
+	case <-h.done:
+	}
+}
+
+// DisconnectSessions closes every connection opened with one of the given
+// sessions.
+func (h *Hub) DisconnectSessions(sessionIDs ...string) {
+	if len(sessionIDs) == 0 {
+		return
+	}
+
+	revoked := make(map[string]bool, len(sessionIDs))
+	for _, id := range sessionIDs {
+		revoked[id] = true
+	}
+
+	h.clients.Range(func(key, value interface{}) bool {
+		client := key.(*Client)
+		if revoked[client.sessionID] {
+			client.Close(CloseSessionRevoked)
+		}
+		return true
+	})
+}
+
 func (h *Hub) handleRegister(client *Client) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
 	h.clients.Store(client, true)
+	slog.Debug("client registered", "user_id", client.userID, "username", client.username)
+
+	if topic := h.Topic(); topic != "" {
+		if msgBytes, err := json.Marshal(&model.WSMessage{
+			Type:    model.MessageTypeTopic,
+			Payload: &model.Topic{Topic: topic},
+		}); err == nil {
+			client.queue(msgBytes)
+		}
+	}
+
+	// Bots receive events but are not shown as present
+	if !h.presenceEnabled() || client.bot {
+		return
+	}
 
 	wsMsg := &model.WSMessage{
 		Type: model.MessageTypeJoin,
@@ -88,7 +390,12 @@ func (h *Hub) handleUnregister(client *Client) {
 	defer h.mutex.Unlock()
 
 	if _, ok := h.clients.LoadAndDelete(client); ok {
-		close(client.send)
+		client.closeSend()
+		slog.Debug("client unregistered", "user_id", client.userID, "username", client.username)
+
+		if !h.presenceEnabled() || client.bot {
+			return
+		}
 
 		wsMsg := &model.WSMessage{
 			Type: model.MessageTypeLeave,
@@ -111,53 +418,76 @@ func (h *Hub) handleBroadcast(message []byte) {
 		return
 	}
 
+	// Chat messages skip clients that muted the sender
+	var sender string
 	if wsMsg.Type == model.MessageTypeChat {
-		go h.storeMessage(wsMsg)
+		if payload, ok := wsMsg.Payload.(map[string]interface{}); ok {
+			sender, _ = payload["username"].(string)
+		}
 	}
 
-	go h.broadcast(message)
+	go h.broadcastFrom(sender, message)
 }
 
-func (h *Hub) storeMessage(wsMsg model.WSMessage) {
-	payload, ok := wsMsg.Payload.(map[string]interface{})
-	if !ok {
-		log.Printf("invalid message payload")
-		return
-	}
+// handleDirect queues a direct message for its connections that are still
+// registered. A connection closed meanwhile just drops it, as queue never
+// sends on a closed channel.
+func (h *Hub) handleDirect(msg *directMessage) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
 
-	msg := &model.Message{
-		Content:  payload["content"].(string),
-		UserID:   int64(payload["user_id"].(float64)),
-		Username: payload["username"].(string),
-	}
+	h.clients.Range(func(key, value interface{}) bool {
+		client := key.(*Client)
+		if client == msg.client || (msg.client == nil && client.userID == msg.userID) {
+			client.queue(msg.message)
+		}
+		return true
+	})
+}
 
-	if err := h.msgRepo.Create(context.Background(), msg); err != nil {
-		log.Printf("error storing message: %v", err)
+// notifyListeners calls the OnMessage listeners with a stored message.
+func (h *Hub) notifyListeners(msg *model.Message) {
+	h.settingsMutex.RLock()
+	listeners := h.listeners
+	h.settingsMutex.RUnlock()
+	for _, fn := range listeners {
+		fn(msg)
 	}
 }
 
 func (h *Hub) broadcast(message []byte) {
+	h.broadcastFrom("", message)
+}
+
+// broadcastFrom sends a message to every client that has not muted sender.
+func (h *Hub) broadcastFrom(sender string, message []byte) {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
 	h.clients.Range(func(key, value interface{}) bool {
 		client := key.(*Client)
-		select {
-		case client.send <- message:
-		default:
+		if sender != "" && client.isMuted(sender) {
+			return true
+		}
+		// Clients too slow to keep up are dropped
+		if !client.queue(message) {
 			h.clients.Delete(client)
-			close(client.send)
+			client.closeSend()
 		}
 		return true
 	})
 }
 
-func (h *Hub) broadcastOnlineUsers() {
+// onlineUsers returns the sorted names of the connected users, leaving out
+// bots.
+func (h *Hub) onlineUsers() []string {
 	users := make(map[string]bool)
 
 	h.clients.Range(func(key, value interface{}) bool {
 		client := key.(*Client)
-		users[client.username] = true
+		if !client.bot {
+			users[client.username] = true
+		}
 		return true
 	})
 
@@ -165,10 +495,30 @@ func (h *Hub) broadcastOnlineUsers() {
 	for username := range users {
 		uniqueUsers = append(uniqueUsers, username)
 	}
+	slices.Sort(uniqueUsers)
+	return uniqueUsers
+}
 
+// OnlineUserIDs returns the IDs of the connected users, leaving out bots.
+func (h *Hub) OnlineUserIDs() []int64 {
+	seen := make(map[int64]bool)
+	var ids []int64
+
+	h.clients.Range(func(key, value interface{}) bool {
+		client := key.(*Client)
+		if !client.bot && !seen[client.userID] {
+			seen[client.userID] = true
+			ids = append(ids, client.userID)
+		}
+		return true
+	})
+	return ids
+}
+
+func (h *Hub) broadcastOnlineUsers() {
 	wsMsg := &model.WSMessage{
 		Type:    model.MessageTypeUsers,
-		Payload: uniqueUsers,
+		Payload: h.onlineUsers(),
 	}
 
 	if msgBytes, err := json.Marshal(wsMsg); err == nil {
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Admin restricts routes to the users named in the admin list. It must run
+// after JWTMiddleware.Authenticate so the username is in the context.
+type Admin struct {
+	mutex  sync.RWMutex
+	admins map[string]bool
+}
+
+func NewAdmin(usernames []string) *Admin {
+	a := &Admin{}
+	a.SetAdmins(usernames)
+	return a
+}
+
+// SetAdmins replaces the admin list. It is safe to call while requests are
+// being served.
+func (a *Admin) SetAdmins(usernames []string) {
+	admins := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		admins[username] = true
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.admins = admins
+}
+
+func (a *Admin) IsAdmin(username string) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.admins[username]
+}
+
+func (a *Admin) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _ := r.Context().Value(UsernameKey).(string)
+		if !a.IsAdmin(username) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
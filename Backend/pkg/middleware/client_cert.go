@@ -0,0 +1,16 @@
+package middleware
+
+import "net/http"
+
+// RequireClientCert rejects requests that did not present a client
+// certificate verified against the server's client CA pool.
+func RequireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
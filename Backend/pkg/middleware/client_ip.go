@@ -0,0 +1,19 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+)
+
+// ClientIP returns the IP address of the peer that sent the request, or ""
+// if it has none, as for requests on the Unix domain socket.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
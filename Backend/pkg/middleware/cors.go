@@ -1,14 +1,72 @@
 package middleware
 
-import "net/http"
+import (
+	"net/http"
+	"sync"
+)
 
-func CORSMiddleware(next http.Handler) http.Handler {
+type CORS struct {
+	mutex          sync.RWMutex
+	allowedOrigins map[string]bool
+	allowAll       bool
+}
+
+func NewCORS(allowedOrigins []string) *CORS {
+	c := &CORS{}
+	c.SetAllowedOrigins(allowedOrigins)
+	return c
+}
+
+// SetAllowedOrigins replaces the list of allowed origins. It is safe to call
+// while requests are being served.
+func (c *CORS) SetAllowedOrigins(allowedOrigins []string) {
+	origins := make(map[string]bool)
+	allowAll := false
+	for _, origin := range allowedOrigins {
+		if origin == "*" {
+			allowAll = true
+		}
+		origins[origin] = true
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.allowedOrigins = origins
+	c.allowAll = allowAll
+}
+
+// AllowOrigin reports whether requests from origin are permitted. Requests
+// without an Origin header (non-browser clients) are always allowed.
+func (c *CORS) AllowOrigin(origin string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return origin == "" || c.allowAll || c.allowedOrigins[origin]
+}
+
+func (c *CORS) allowsAll() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.allowAll
+}
+
+// CheckOrigin adapts AllowOrigin for websocket.Upgrader.
+func (c *CORS) CheckOrigin(r *http.Request) bool {
+	return c.AllowOrigin(r.Header.Get("Origin"))
+}
+
+func (c *CORS) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Set CORS headers
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if c.allowsAll() {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if origin := r.Header.Get("Origin"); origin != "" && c.AllowOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, X-CSRF-Token")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Access-Control-Expose-Headers", "Retry-After, X-Last-Read-ID, X-Unread-Count")
 
 		// Handle preflight requests
 		if r.Method == "OPTIONS" {
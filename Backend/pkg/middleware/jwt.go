@@ -2,29 +2,29 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strings"
 
-	"github.com/golang-jwt/jwt/v5"
-	"github.com/hdngo/whisper/internal/cache"
+	"github.com/hdngo/whisper/internal/auth"
 )
 
 type contextKey string
 
 const (
-	UserIDKey   contextKey = "user_id"
-	UsernameKey contextKey = "username"
+	UserIDKey    contextKey = "user_id"
+	UsernameKey  contextKey = "username"
+	SessionIDKey contextKey = "session_id"
+	ClaimsKey    contextKey = "claims"
 )
 
 type JWTMiddleware struct {
-	jwtSecret   string
-	redisClient *cache.RedisClient
+	authenticator *auth.Authenticator
 }
 
-func NewJWTMiddleware(jwtSecret string, redisClient *cache.RedisClient) *JWTMiddleware {
+func NewJWTMiddleware(authenticator *auth.Authenticator) *JWTMiddleware {
 	return &JWTMiddleware{
-		jwtSecret:   jwtSecret,
-		redisClient: redisClient,
+		authenticator: authenticator,
 	}
 }
 
@@ -42,30 +42,20 @@ func (m *JWTMiddleware) Authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		token, err := jwt.Parse(bearerToken[1], func(token *jwt.Token) (interface{}, error) {
-			return []byte(m.jwtSecret), nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := m.authenticator.Authenticate(r.Context(), bearerToken[1], ClientIP(r))
+		if errors.Is(err, auth.ErrInvalidToken) {
 			http.Error(w, "invalid token", http.StatusUnauthorized)
 			return
 		}
-
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			http.Error(w, "invalid token claims", http.StatusUnauthorized)
-			return
-		}
-
-		userID := claims["user_id"].(float64)
-		storedToken, err := m.redisClient.GetSession(r.Context(), int64(userID))
-		if err != nil || storedToken != bearerToken[1] {
+		if err != nil {
 			http.Error(w, "session expired or invalid", http.StatusUnauthorized)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), UserIDKey, claims["user_id"])
-		ctx = context.WithValue(ctx, UsernameKey, claims["username"])
+		ctx := context.WithValue(r.Context(), UserIDKey, claims.UserID)
+		ctx = context.WithValue(ctx, UsernameKey, claims.Username)
+		ctx = context.WithValue(ctx, SessionIDKey, claims.SessionID)
+		ctx = context.WithValue(ctx, ClaimsKey, claims)
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
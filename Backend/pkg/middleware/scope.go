@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/hdngo/whisper/internal/token"
+)
+
+// RequireScope restricts routes to login sessions and personal access
+// tokens granted scope. It must run after JWTMiddleware.Authenticate.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value(ClaimsKey).(*token.Claims)
+			if !ok || !claims.Allows(scope) {
+				http.Error(w, "token lacks the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSession restricts routes to login sessions, keeping account
+// management out of reach of personal access tokens.
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(ClaimsKey).(*token.Claims)
+		if !ok || claims.Personal() {
+			http.Error(w, "not allowed with a personal access token", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
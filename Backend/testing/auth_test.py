@@ -1,4 +1,9 @@
+import base64
+import hashlib
+import hmac
 import logging
+import struct
+import time
 from datetime import datetime
 from typing import Any, Dict
 
@@ -18,6 +23,7 @@ class AuthTester:
         self.base_url = base_url or "http://localhost:6262"
         self.ws_url = f"ws://localhost:6262/api/ws"
         self.auth_tokens: Dict[str, str] = {}
+        self.refresh_tokens: Dict[str, str] = {}
         self.session = requests.Session()
 
     def register_user(self, username: str, password: str) -> Dict[str, Any]:
@@ -30,6 +36,7 @@ class AuthTester:
             response.raise_for_status()
             data = response.json()
             self.auth_tokens[username] = data["token"]
+            self.refresh_tokens[username] = data["refresh_token"]
             return data
         except requests.exceptions.RequestException as e:
             logger.error(f"Registration failed for user {username}: {str(e)}")
@@ -45,11 +52,19 @@ class AuthTester:
             response.raise_for_status()
             data = response.json()
             self.auth_tokens[username] = data["token"]
+            self.refresh_tokens[username] = data["refresh_token"]
             return data
         except requests.exceptions.RequestException as e:
             logger.error(f"Login failed for user {username}: {str(e)}")
             raise
 
+    def refresh(self, refresh_token: str) -> requests.Response:
+        """Exchange a refresh token for new tokens and return the raw response"""
+        return self.session.post(
+            f"{self.base_url}/api/auth/refresh",
+            json={"refresh_token": refresh_token}
+        )
+
     def logout_user(self, username: str) -> bool:
         """Logout a user and return success status"""
         try:
@@ -66,6 +81,16 @@ class AuthTester:
             return False
 
 
+def totp_code(secret: str, at: float = None) -> str:
+    """Compute the current RFC 6238 code for a base32 secret"""
+    key = base64.b32decode(secret + "=" * (-len(secret) % 8))
+    step = int((at or time.time()) // 30)
+    digest = hmac.new(key, struct.pack(">Q", step), hashlib.sha1).digest()
+    offset = digest[-1] & 0x0F
+    value = struct.unpack(">I", digest[offset:offset + 4])[0] & 0x7FFFFFFF
+    return f"{value % 1000000:06d}"
+
+
 @pytest.fixture
 def tester(api_url):
     return AuthTester(api_url)
@@ -112,10 +137,144 @@ def test_user_login_logout(tester):
     assert tester.logout_user(test_user["username"]) is True
 
 
+def test_refresh_token_rotation(tester):
+    """Test refresh token rotation and reuse detection"""
+    username = f"test_user_{datetime.now().timestamp()}"
+    tester.register_user(username, "TestPass123!")
+    first_refresh = tester.refresh_tokens[username]
+
+    # Refreshing returns a new access token and a new refresh token
+    response = tester.refresh(first_refresh)
+    assert response.status_code == 200
+    data = response.json()
+    assert data["refresh_token"] != first_refresh
+    assert data["expires_at"] > 0
+
+    headers = {"Authorization": f"Bearer {data['token']}"}
+    assert requests.get(f"{tester.base_url}/api/messages", headers=headers).status_code == 200
+
+    # Reusing the rotated token revokes the whole session
+    assert tester.refresh(first_refresh).status_code == 401
+    assert tester.refresh(data["refresh_token"]).status_code == 401
+    assert requests.get(f"{tester.base_url}/api/messages", headers=headers).status_code == 401
+
+
+def test_multiple_sessions(tester):
+    """Test that each login gets its own session that can be revoked separately"""
+    username = f"test_user_{datetime.now().timestamp()}"
+    first = tester.register_user(username, "TestPass123!")
+    second = tester.login_user(username, "TestPass123!")
+
+    first_headers = {"Authorization": f"Bearer {first['token']}"}
+    second_headers = {"Authorization": f"Bearer {second['token']}"}
+
+    # Logging in again leaves the first session intact
+    assert requests.get(f"{tester.base_url}/api/messages", headers=first_headers).status_code == 200
+
+    response = requests.get(f"{tester.base_url}/api/auth/sessions", headers=second_headers)
+    assert response.status_code == 200
+    sessions = response.json()
+    assert len(sessions) == 2
+    assert sum(1 for s in sessions if s["current"]) == 1
+
+    # Revoking the other session logs it out without touching this one
+    other = next(s for s in sessions if not s["current"])
+    response = requests.delete(f"{tester.base_url}/api/auth/sessions/{other['id']}", headers=second_headers)
+    assert response.status_code == 204
+    assert requests.get(f"{tester.base_url}/api/messages", headers=first_headers).status_code == 401
+    assert requests.get(f"{tester.base_url}/api/messages", headers=second_headers).status_code == 200
+
+
+def test_jwks(tester):
+    """Test that the JWKS document lists well-formed verification keys"""
+    response = requests.get(f"{tester.base_url}/.well-known/jwks.json")
+    assert response.status_code == 200
+    for key in response.json()["keys"]:
+        assert key["use"] == "sig"
+        assert key["alg"] in ("RS256", "EdDSA")
+        assert key["kid"]
+
+
+def test_two_factor_login(tester):
+    """Test TOTP enrollment, the second login step and recovery codes"""
+    username = f"test_user_{datetime.now().timestamp()}"
+    password = "TestPass123!"
+    tester.register_user(username, password)
+    headers = {"Authorization": f"Bearer {tester.auth_tokens[username]}"}
+
+    response = requests.post(f"{tester.base_url}/api/auth/2fa/enroll", headers=headers)
+    assert response.status_code == 200
+    enrollment = response.json()
+    assert enrollment["uri"].startswith("otpauth://totp/")
+
+    response = requests.post(f"{tester.base_url}/api/auth/2fa/confirm", headers=headers,
+                             json={"code": totp_code(enrollment["secret"])})
+    assert response.status_code == 200
+    recovery_codes = response.json()["recovery_codes"]
+    assert len(recovery_codes) == 10
+
+    # A correct password now only yields a challenge
+    response = requests.post(f"{tester.base_url}/api/auth/login",
+                             json={"username": username, "password": password})
+    assert response.status_code == 200
+    challenge = response.json()
+    assert challenge["mfa_required"] is True
+    assert "token" not in challenge
+
+    response = requests.post(f"{tester.base_url}/api/auth/2fa/verify",
+                             json={"mfa_token": challenge["mfa_token"], "code": recovery_codes[0]})
+    assert response.status_code == 200
+    assert response.json()["token"]
+
+    # Recovery codes work once and the challenge is used up
+    response = requests.post(f"{tester.base_url}/api/auth/2fa/verify",
+                             json={"mfa_token": challenge["mfa_token"], "code": recovery_codes[1]})
+    assert response.status_code == 401
+
+    response = requests.post(f"{tester.base_url}/api/auth/2fa/disable", headers=headers,
+                             json={"code": recovery_codes[1]})
+    assert response.status_code == 204
+
+
+def test_personal_access_tokens(tester):
+    """Test scoped personal access tokens, their use and revocation"""
+    username = f"test_user_{datetime.now().timestamp()}"
+    tester.register_user(username, "TestPass123!")
+    headers = {"Authorization": f"Bearer {tester.auth_tokens[username]}"}
+
+    response = requests.post(f"{tester.base_url}/api/auth/tokens", headers=headers,
+                             json={"name": "bad", "scopes": ["everything"], "expires_at": int(time.time()) + 3600})
+    assert response.status_code == 400
+
+    response = requests.post(f"{tester.base_url}/api/auth/tokens", headers=headers,
+                             json={"name": "reader", "scopes": ["messages:read"], "expires_at": int(time.time()) + 3600})
+    assert response.status_code == 201
+    created = response.json()
+    assert created["token"].startswith("whp_")
+    assert created["scopes"] == ["messages:read"]
+    token_headers = {"Authorization": f"Bearer {created['token']}"}
+
+    # The token only reaches what its scopes allow, and never account management
+    assert requests.get(f"{tester.base_url}/api/messages", headers=token_headers).status_code == 200
+    assert requests.get(f"{tester.base_url}/api/admin/audit", headers=token_headers).status_code == 403
+    assert requests.get(f"{tester.base_url}/api/auth/sessions", headers=token_headers).status_code == 403
+
+    response = requests.get(f"{tester.base_url}/api/auth/tokens", headers=headers)
+    assert response.status_code == 200
+    listed = response.json()
+    assert [t["name"] for t in listed] == ["reader"]
+    assert "token" not in listed[0]
+    assert listed[0]["last_used_at"] > 0
+
+    response = requests.delete(f"{tester.base_url}/api/auth/tokens/{created['id']}", headers=headers)
+    assert response.status_code == 204
+    assert requests.get(f"{tester.base_url}/api/messages", headers=token_headers).status_code == 401
+
+
 def test_invalid_auth_token(tester):
     """Test authentication with invalid token"""
     headers = {"Authorization": "Bearer invalid_token"}
-    response = requests.get(f"{tester.base_url}/api/messages/recent", headers=headers)
+    response = requests.get(f"{tester.base_url}/api/messages", headers=headers)
     assert response.status_code == 401
 
 
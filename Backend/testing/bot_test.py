@@ -0,0 +1,78 @@
+import asyncio
+import json
+import time
+from datetime import datetime
+
+import pytest
+import requests
+import websockets
+
+
+def create_bot(api_url: str) -> tuple:
+    """Register an owner, create a bot for them and return (owner headers, bot, bot token)"""
+    owner = f"test_user_{datetime.now().timestamp()}"
+    response = requests.post(f"{api_url}/api/auth/register", json={"username": owner, "password": "TestPass123!"})
+    assert response.status_code == 200
+    headers = {"Authorization": f"Bearer {response.json()['token']}"}
+
+    response = requests.post(f"{api_url}/api/bots", headers=headers,
+                             json={"username": f"bot_{datetime.now().timestamp()}", "display_name": "Deploy Bot"})
+    assert response.status_code == 201
+    bot = response.json()
+    assert bot["is_bot"] is True
+
+    response = requests.post(f"{api_url}/api/bots/{bot['id']}/tokens", headers=headers,
+                             json={"name": "deploys", "scopes": ["messages:read", "messages:write"],
+                                   "expires_at": int(time.time()) + 3600})
+    assert response.status_code == 201
+    return headers, bot, response.json()["token"]
+
+
+def test_bot_accounts(api_url):
+    """Test that owners manage their bots' tokens and bots cannot log in"""
+    headers, bot, _ = create_bot(api_url)
+
+    response = requests.get(f"{api_url}/api/bots", headers=headers)
+    assert response.status_code == 200
+    assert [b["username"] for b in response.json()] == [bot["username"]]
+
+    # Bots are not admins and have no password
+    response = requests.post(f"{api_url}/api/bots/{bot['id']}/tokens", headers=headers,
+                             json={"name": "admin", "scopes": ["admin"], "expires_at": int(time.time()) + 3600})
+    assert response.status_code == 400
+    response = requests.post(f"{api_url}/api/auth/login", json={"username": bot["username"], "password": ""})
+    assert response.status_code == 401
+
+    # Other users cannot touch the bot
+    other = requests.post(f"{api_url}/api/auth/register",
+                          json={"username": f"test_user_{datetime.now().timestamp()}", "password": "TestPass123!"})
+    other_headers = {"Authorization": f"Bearer {other.json()['token']}"}
+    assert requests.get(f"{api_url}/api/bots/{bot['id']}/tokens", headers=other_headers).status_code == 404
+
+
+async def test_bot_posts_marked_messages(api_url, ws_url):
+    """Test that messages posted by a bot over REST are broadcast and stored with the bot marker"""
+    headers, bot, bot_token = create_bot(api_url)
+    content = f"deployed build {datetime.now().timestamp()}"
+
+    async with websockets.connect(ws_url, subprotocols=[f"access_token|{bot_token}"]) as websocket:
+        response = requests.post(f"{api_url}/api/messages", headers={"Authorization": f"Bearer {bot_token}"},
+                                 json={"content": content})
+        assert response.status_code == 202
+
+        # The bot's own connection receives events, including its message
+        while True:
+            event = json.loads(await asyncio.wait_for(websocket.recv(), timeout=5))
+            if event["type"] == "chat" and event["payload"]["content"] == content:
+                break
+        assert event["payload"]["username"] == bot["username"]
+        assert event["payload"]["bot"] is True
+
+    await asyncio.sleep(0.5)
+    response = requests.get(f"{api_url}/api/messages", headers=headers)
+    stored = next(m for m in response.json()["messages"] if m["content"] == content)
+    assert stored["bot"] is True
+
+
+if __name__ == "__main__":
+    pytest.main([__file__])
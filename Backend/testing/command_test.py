@@ -0,0 +1,178 @@
+import asyncio
+import hashlib
+import hmac
+import json
+import os
+import threading
+import time
+from datetime import datetime
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+import pytest
+import requests
+import websockets
+
+SECRET = os.getenv("COMMAND_SECRET", "whisper-test")
+
+
+class CommandService:
+    """A stand-in for an external slash command service. /echo answers
+    with the text it was called with, publicly when it starts with
+    --public, and a second late when it starts with --slow."""
+
+    def __init__(self, port: int):
+        self.calls = []
+        self.server = ThreadingHTTPServer(("localhost", port), self.handler())
+
+    def start(self):
+        threading.Thread(target=self.server.serve_forever, daemon=True).start()
+
+    def stop(self):
+        self.server.shutdown()
+        self.server.server_close()
+
+    def handler(self):
+        service = self
+
+        class Handler(BaseHTTPRequestHandler):
+            def do_POST(self):
+                body = self.rfile.read(int(self.headers.get("Content-Length", 0)))
+                mac = hmac.new(SECRET.encode(), f"{self.headers['X-Whisper-Timestamp']}.".encode() + body, hashlib.sha256)
+                if self.headers.get("X-Whisper-Signature") != f"sha256={mac.hexdigest()}":
+                    self.send_response(401)
+                    self.end_headers()
+                    return
+
+                call = json.loads(body)
+                service.calls.append(call)
+                public = call["args"][:1] == ["--public"]
+                slow = call["args"][:1] == ["--slow"]
+                if slow:
+                    time.sleep(1)
+                reply = json.dumps({
+                    "text": " ".join(call["args"][1:] if public or slow else call["args"]),
+                    "response_type": "in_channel" if public else "ephemeral",
+                }).encode()
+                self.send_response(200)
+                self.send_header("Content-Type", "application/json")
+                self.send_header("Content-Length", str(len(reply)))
+                self.end_headers()
+                self.wfile.write(reply)
+
+            def log_message(self, format, *args):
+                pass
+
+        return Handler
+
+
+@pytest.fixture(scope="module")
+def service():
+    service = CommandService(int(os.getenv("COMMAND_SERVICE_PORT", "6265")))
+    service.start()
+    yield service
+    service.stop()
+
+
+def register(api_url: str) -> tuple:
+    username = f"test_user_{datetime.now().timestamp()}"
+    response = requests.post(f"{api_url}/api/auth/register", json={"username": username, "password": "TestPass123!"})
+    assert response.status_code == 200
+    return username, response.json()["token"]
+
+
+async def next_event(websocket, *types: str) -> dict:
+    """Return the next event of one of the types, where system messages are
+    matched by their kind"""
+    while True:
+        event = json.loads(await asyncio.wait_for(websocket.recv(), timeout=5))
+        if event["type"] in types or (event["type"] == "system" and event["payload"]["kind"] in types):
+            return event
+
+
+async def test_builtin_commands(api_url, ws_url):
+    """Test that command output only reaches the caller and commands are not stored"""
+    alice, alice_token = register(api_url)
+    bob, bob_token = register(api_url)
+
+    async with websockets.connect(ws_url, subprotocols=[f"access_token|{alice_token}"]) as alice_ws, \
+            websockets.connect(ws_url, subprotocols=[f"access_token|{bob_token}"]) as bob_ws:
+        await alice_ws.send("/who")
+        event = await next_event(alice_ws, "command")
+        assert event["type"] == "system"
+        assert event["payload"]["command"] == "who"
+        assert alice in event["payload"]["text"] and bob in event["payload"]["text"]
+
+        await alice_ws.send("/me waves")
+        event = await next_event(bob_ws, "chat")
+        assert event["payload"]["content"] == f"* {alice} waves"
+
+        await alice_ws.send("/shrug ok")
+        event = await next_event(bob_ws, "chat")
+        assert event["payload"]["content"] == "ok ¯\\_(ツ)_/¯"
+
+        topic = f"release day {datetime.now().timestamp()}"
+        await alice_ws.send(f"/topic {topic}")
+        event = await next_event(bob_ws, "topic")
+        assert event["payload"] == {"topic": topic, "username": alice}
+
+        await alice_ws.send("/nope")
+        event = await next_event(alice_ws, "error")
+        assert "/help" in event["payload"]["text"]
+
+        await alice_ws.send("/unmute")
+        event = await next_event(alice_ws, "error")
+        assert event["payload"] == {"kind": "error", "text": "usage: /unmute <username>", "command": "unmute"}
+
+        # A doubled slash posts the message
+        await alice_ws.send("//me is not a command")
+        event = await next_event(bob_ws, "chat")
+        assert event["payload"]["content"] == "/me is not a command"
+
+        # Muted users' messages are not delivered to the muting connection
+        await bob_ws.send(f"/mute {alice}")
+        assert (await next_event(bob_ws, "command"))["payload"]["text"].startswith(f"Muted {alice}")
+        await alice_ws.send("hidden from bob")
+        await bob_ws.send("visible to bob")
+        event = await next_event(bob_ws, "chat")
+        assert event["payload"]["content"] == "visible to bob"
+
+    headers = {"Authorization": f"Bearer {alice_token}"}
+    contents = [m["content"] for m in requests.get(f"{api_url}/api/messages", headers=headers).json()["messages"]]
+    assert f"* {alice} waves" in contents
+    assert not any(c.startswith("/who") or c.startswith("/topic") for c in contents)
+
+
+async def test_external_command(api_url, ws_url, service):
+    """Test that configured commands are sent to their service, signed"""
+    username, token = register(api_url)
+
+    async with websockets.connect(ws_url, subprotocols=[f"access_token|{token}"]) as websocket:
+        await websocket.send("/help echo")
+        event = await next_event(websocket, "command", "error")
+        if event["payload"]["kind"] == "error":
+            pytest.skip("server is not configured with the /echo command")
+        assert event["payload"]["text"].startswith("/echo [--public] <text>")
+
+        await websocket.send('/echo "just for me" ok')
+        event = await next_event(websocket, "command")
+        assert event["payload"] == {"kind": "command", "text": "just for me ok", "command": "echo"}
+        assert service.calls[-1]["username"] == username
+        assert service.calls[-1]["args"] == ["just for me", "ok"]
+
+        text = f"for everyone {datetime.now().timestamp()}"
+        await websocket.send(f"/echo --public {text}")
+        event = await next_event(websocket, "chat")
+        assert event["payload"]["content"] == text
+        assert event["payload"]["username"] == username
+
+        # A slow command does not hold up the connection meanwhile
+        await websocket.send("/echo --slow late")
+        await websocket.send("/who")
+        event = await next_event(websocket, "command")
+        assert event["payload"]["command"] == "who"
+        event = await next_event(websocket, "command")
+        assert event["payload"] == {"kind": "command", "text": "late", "command": "echo"}
+
+
+if __name__ == "__main__":
+    pytest.main([__file__])
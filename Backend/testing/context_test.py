@@ -0,0 +1,36 @@
+import time
+from datetime import datetime
+
+import requests
+
+
+def test_message_context(api_url):
+    """Test opening history at a message and paging forwards from it"""
+    username = f"test_user_{datetime.now().timestamp()}"
+    response = requests.post(f"{api_url}/api/auth/register", json={"username": username, "password": "TestPass123!"})
+    headers = {"Authorization": f"Bearer {response.json()['token']}"}
+
+    tag = datetime.now().timestamp()
+    for i in range(5):
+        requests.post(f"{api_url}/api/messages", headers=headers, json={"content": f"context {tag} {i}"})
+        time.sleep(0.1)
+    time.sleep(0.5)
+    recent = requests.get(f"{api_url}/api/messages", headers=headers).json()
+    ids = [m["id"] for m in recent["messages"] if m["content"].startswith(f"context {tag} ")]
+    assert len(ids) == 5
+
+    response = requests.get(f"{api_url}/api/messages/{ids[2]}/context", headers=headers, params={"before": 2, "after": 1})
+    assert response.status_code == 200
+    context = response.json()
+    assert context["message"]["content"] == f"context {tag} 2"
+    assert [m["id"] for m in context["before"]] == ids[:2]
+    assert [m["id"] for m in context["after"]] == ids[3:4]
+
+    response = requests.get(f"{api_url}/api/messages", headers=headers, params={"cursor": context["next"], "limit": 1})
+    assert [m["id"] for m in response.json()["messages"]] == ids[4:5]
+    response = requests.get(f"{api_url}/api/messages", headers=headers, params={"cursor": context["prev"], "limit": 5})
+    assert ids[0] not in [m["id"] for m in response.json()["messages"]]
+
+    assert requests.get(f"{api_url}/api/messages/{ids[2]}/context", headers=headers,
+                        params={"before": -1}).status_code == 400
+    assert requests.get(f"{api_url}/api/messages/999999999/context", headers=headers).status_code == 404
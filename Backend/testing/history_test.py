@@ -0,0 +1,80 @@
+import asyncio
+import json
+import time
+from datetime import datetime
+
+import requests
+import websockets
+
+
+def test_history_pages_with_cursors(api_url):
+    """Test paging history backwards and forwards with cursors"""
+    username = f"test_user_{datetime.now().timestamp()}"
+    response = requests.post(f"{api_url}/api/auth/register", json={"username": username, "password": "TestPass123!"})
+    headers = {"Authorization": f"Bearer {response.json()['token']}"}
+
+    tag = datetime.now().timestamp()
+    for i in range(5):
+        requests.post(f"{api_url}/api/messages", headers=headers, json={"content": f"history {tag} {i}"})
+    time.sleep(0.5)
+
+    response = requests.get(f"{api_url}/api/messages", headers=headers, params={"limit": 3})
+    assert response.status_code == 200
+    newest = response.json()
+    assert newest["has_more"] is True
+    assert [m["content"] for m in newest["messages"]] == [f"history {tag} {i}" for i in range(2, 5)]
+
+    ids = [m["id"] for m in newest["messages"]]
+    assert ids == sorted(ids)
+
+    response = requests.get(f"{api_url}/api/messages", headers=headers, params={"cursor": newest["next"], "limit": 2})
+    older = response.json()
+    assert [m["content"] for m in older["messages"]] == [f"history {tag} {i}" for i in range(2)]
+
+    # prev pages forwards again from the end of the older page
+    response = requests.get(f"{api_url}/api/messages", headers=headers, params={"cursor": older["prev"], "limit": 3})
+    assert [m["id"] for m in response.json()["messages"]] == ids
+
+    # The newest page has nothing after it yet
+    response = requests.get(f"{api_url}/api/messages", headers=headers, params={"cursor": newest["prev"]})
+    assert response.json()["messages"] == []
+    assert response.json()["has_more"] is False
+
+    response = requests.get(f"{api_url}/api/messages", headers=headers, params={"direction": "after", "limit": 1})
+    oldest = response.json()["messages"]
+    assert len(oldest) == 1 and oldest[0]["id"] <= older["messages"][0]["id"]
+
+
+def test_history_rejects_bad_parameters(api_url):
+    """Test that an invalid limit, direction or cursor is a 400"""
+    username = f"test_user_{datetime.now().timestamp()}"
+    response = requests.post(f"{api_url}/api/auth/register", json={"username": username, "password": "TestPass123!"})
+    headers = {"Authorization": f"Bearer {response.json()['token']}"}
+
+    for params in ({"limit": 0}, {"limit": "ten"}, {"limit": 100000}, {"direction": "sideways"}, {"cursor": "not-a-cursor"}):
+        response = requests.get(f"{api_url}/api/messages", headers=headers, params=params)
+        assert response.status_code == 400, params
+
+
+async def test_broadcast_and_stored_times_match(api_url, ws_url):
+    """Test that a message has the same RFC 3339 time when broadcast and in history"""
+    username = f"test_user_{datetime.now().timestamp()}"
+    response = requests.post(f"{api_url}/api/auth/register", json={"username": username, "password": "TestPass123!"})
+    token = response.json()["token"]
+    headers = {"Authorization": f"Bearer {token}"}
+    content = f"timestamp {datetime.now().timestamp()}"
+
+    async with websockets.connect(ws_url, subprotocols=[f"access_token|{token}"]) as websocket:
+        requests.post(f"{api_url}/api/messages", headers=headers, json={"content": content})
+        while True:
+            event = json.loads(await asyncio.wait_for(websocket.recv(), timeout=5))
+            if event["type"] == "chat" and event["payload"]["content"] == content:
+                broadcast = event["payload"]
+                break
+
+    time.sleep(0.5)
+    messages = requests.get(f"{api_url}/api/messages", headers=headers).json()["messages"]
+    stored = next(m for m in messages if m["content"] == content)
+    assert stored["created_at"] == broadcast["created_at"]
+    assert stored["created_at_unix"] == broadcast["created_at_unix"]
+    assert datetime.fromisoformat(stored["created_at"].replace("Z", "+00:00")).timestamp() // 1 == stored["created_at_unix"]
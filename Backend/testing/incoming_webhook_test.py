@@ -0,0 +1,126 @@
+import json
+import os
+import time
+from datetime import datetime
+
+import pytest
+import requests
+
+ADMIN_USERNAME = os.getenv("WEBHOOK_ADMIN_USERNAME", "webhook_admin")
+ADMIN_PASSWORD = "TestPass123!"
+
+
+@pytest.fixture
+def admin_headers(api_url):
+    credentials = {"username": ADMIN_USERNAME, "password": ADMIN_PASSWORD}
+    response = requests.post(f"{api_url}/api/auth/login", json=credentials)
+    if response.status_code != 200:
+        response = requests.post(f"{api_url}/api/auth/register", json=credentials)
+    headers = {"Authorization": f"Bearer {response.json()['token']}"}
+    if requests.get(f"{api_url}/api/admin/hooks", headers=headers).status_code == 403:
+        pytest.skip(f"{ADMIN_USERNAME} is not in ADMIN_USERNAMES")
+    return headers
+
+
+def create_hook(api_url: str, headers: dict) -> dict:
+    response = requests.post(f"{api_url}/api/admin/hooks", headers=headers,
+                             json={"name": "CI", "username": f"ci_hook_{datetime.now().timestamp()}"})
+    assert response.status_code == 201
+    hook = response.json()
+    assert "/api/hooks/" in hook["url"]
+    return hook
+
+
+def find_message(api_url: str, headers: dict, content: str) -> dict:
+    for _ in range(20):
+        messages = requests.get(f"{api_url}/api/messages", headers=headers).json()["messages"]
+        found = [m for m in messages if m["content"] == content]
+        if found:
+            return found[0]
+        time.sleep(0.1)
+    raise AssertionError(f"message {content!r} was not stored")
+
+
+def test_incoming_webhook_slack_payload(api_url, admin_headers):
+    """Test that Slack-style payloads are posted as bot messages"""
+    hook = create_hook(api_url, admin_headers)
+    build = datetime.now().timestamp()
+
+    response = requests.post(hook["url"], json={
+        "text": f"Build <https://ci.example.com/{build}|{build}> passed &amp; deployed",
+        "username": "ci-runner",
+        "attachments": [{"title": "Details", "fields": [{"title": "Branch", "value": "main"}]}],
+    })
+    assert response.status_code == 200
+    assert response.text == "ok"
+
+    content = f"Build {build} (https://ci.example.com/{build}) passed & deployed\nDetails\nBranch: main"
+    message = find_message(api_url, admin_headers, content)
+    assert message["display_name"] == "ci-runner"
+    assert message["username"] == hook["username"]
+    assert message["user_id"] == hook["user_id"]
+    assert message["bot"] is True
+
+    # Slack's form encoding is accepted too
+    text = f"form post {build}"
+    response = requests.post(hook["url"], data={"payload": json.dumps({"text": text})})
+    assert response.status_code == 200
+    assert find_message(api_url, admin_headers, text)["username"] == hook["username"]
+
+    assert requests.post(hook["url"], json={"text": "  "}).status_code == 400
+
+
+def test_incoming_webhook_cannot_post_as_a_user(api_url, admin_headers):
+    """Test that a Slack username naming a real user does not change the author"""
+    hook = create_hook(api_url, admin_headers)
+    text = f"impersonation {datetime.now().timestamp()}"
+
+    response = requests.post(hook["url"], json={"text": text, "username": ADMIN_USERNAME})
+    assert response.status_code == 200
+
+    message = find_message(api_url, admin_headers, text)
+    assert message["username"] == hook["username"]
+    assert message["user_id"] == hook["user_id"]
+    assert message["display_name"] == ADMIN_USERNAME
+
+    response = requests.get(f"{api_url}/api/messages/search", headers=admin_headers,
+                            params={"q": text, "author": ADMIN_USERNAME})
+    assert all(r["message"]["content"] != text for r in response.json()["results"])
+
+
+def test_incoming_webhook_rotate_and_delete(api_url, admin_headers):
+    """Test that rotating a webhook replaces its URL and deleting it disables it"""
+    hook = create_hook(api_url, admin_headers)
+
+    response = requests.post(f"{api_url}/api/admin/hooks/{hook['id']}/rotate", headers=admin_headers)
+    assert response.status_code == 200
+    rotated = response.json()
+    assert rotated["url"] != hook["url"]
+    assert requests.post(hook["url"], json={"text": "old url"}).status_code == 404
+    assert requests.post(rotated["url"], json={"text": "new url"}).status_code == 200
+
+    listed = requests.get(f"{api_url}/api/admin/hooks", headers=admin_headers).json()
+    assert any(h["id"] == hook["id"] and h["last_used_at"] > 0 for h in listed)
+
+    response = requests.delete(f"{api_url}/api/admin/hooks/{hook['id']}", headers=admin_headers)
+    assert response.status_code == 204
+    assert requests.post(rotated["url"], json={"text": "deleted"}).status_code == 404
+
+
+
+def test_incoming_webhook_rate_limit(api_url, admin_headers):
+    """Test that an incoming webhook is held to the websocket rate limit like any other poster"""
+    hook = create_hook(api_url, admin_headers)
+
+    for i in range(50):
+        response = requests.post(hook["url"], json={"text": f"flood {i}"})
+        if response.status_code != 200:
+            break
+    else:
+        pytest.skip("server is not configured with websocket.rate_limit")
+    assert response.status_code == 429
+    assert int(response.headers["Retry-After"]) >= 1
+
+
+if __name__ == "__main__":
+    pytest.main([__file__])
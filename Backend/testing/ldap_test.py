@@ -0,0 +1,259 @@
+import os
+import socketserver
+import threading
+from datetime import datetime
+
+import pytest
+import requests
+
+BASE_DN = "dc=example,dc=org"
+SERVICE_DN = f"cn=admin,{BASE_DN}"
+SERVICE_PASSWORD = os.getenv("LDAP_BIND_PASSWORD", "adminpass")
+CHAT_GROUP = f"cn=whisper,ou=groups,{BASE_DN}"
+
+# LDAP result codes and protocol operation tags (RFC 4511)
+SUCCESS = 0
+OPERATIONS_ERROR = 1
+SIZE_LIMIT_EXCEEDED = 4
+INVALID_CREDENTIALS = 49
+UNWILLING_TO_PERFORM = 53
+
+BIND_REQUEST = 0x60
+BIND_RESPONSE = 0x61
+UNBIND_REQUEST = 0x42
+SEARCH_REQUEST = 0x63
+SEARCH_RESULT_ENTRY = 0x64
+SEARCH_RESULT_DONE = 0x65
+
+
+def ber(tag: int, content: bytes) -> bytes:
+    n = len(content)
+    if n < 0x80:
+        length = bytes([n])
+    else:
+        encoded = n.to_bytes((n.bit_length() + 7) // 8, "big")
+        length = bytes([0x80 | len(encoded)]) + encoded
+    return bytes([tag]) + length + content
+
+
+def ber_int(tag: int, value: int) -> bytes:
+    return ber(tag, value.to_bytes(max(1, (value.bit_length() + 8) // 8), "big", signed=True))
+
+
+def ber_str(value: str, tag: int = 0x04) -> bytes:
+    return ber(tag, value.encode())
+
+
+def ber_read(data: bytes, offset: int = 0) -> tuple:
+    """Decode the element at offset into (tag, content, next offset)"""
+    tag = data[offset]
+    length = data[offset + 1]
+    offset += 2
+    if length & 0x80:
+        size = length & 0x7F
+        length = int.from_bytes(data[offset:offset + size], "big")
+        offset += size
+    return tag, data[offset:offset + length], offset + length
+
+
+def ber_children(content: bytes) -> list:
+    children, offset = [], 0
+    while offset < len(content):
+        tag, value, offset = ber_read(content, offset)
+        children.append((tag, value))
+    return children
+
+
+class MockLDAPServer:
+    """An in-process LDAP server answering the simple binds and searches
+    the backend makes, with a directory tests can add people to"""
+
+    def __init__(self, port: int):
+        self.entries = {}
+        self.passwords = {SERVICE_DN: SERVICE_PASSWORD}
+        self.connections = 0
+        self.server = socketserver.ThreadingTCPServer(("localhost", port), self.handler())
+        self.server.daemon_threads = True
+
+    def start(self):
+        threading.Thread(target=self.server.serve_forever, daemon=True).start()
+
+    def stop(self):
+        self.server.shutdown()
+        self.server.server_close()
+
+    def add_person(self, uid: str, password: str, display_name: str, groups: list) -> str:
+        dn = f"uid={uid},ou=people,{BASE_DN}"
+        self.entries[dn] = {
+            "objectclass": ["top", "person"],
+            "uid": [uid],
+            "displayname": [display_name],
+            "memberof": groups,
+        }
+        self.passwords[dn] = password
+        return dn
+
+    def matches(self, attrs: dict, tag: int, content: bytes) -> bool:
+        if tag == 0xA0:
+            return all(self.matches(attrs, *child) for child in ber_children(content))
+        if tag == 0xA1:
+            return any(self.matches(attrs, *child) for child in ber_children(content))
+        if tag == 0xA2:
+            return not self.matches(attrs, *ber_children(content)[0])
+        if tag == 0xA3:
+            (_, name), (_, value) = ber_children(content)
+            values = attrs.get(name.decode().lower(), [])
+            return value.decode().lower() in (v.lower() for v in values)
+        if tag == 0x87:
+            return content.decode().lower() in attrs
+        return False
+
+    def bind(self, content: bytes) -> int:
+        _, (_, name), (auth_tag, password) = ber_children(content)
+        if auth_tag != 0x80:
+            return UNWILLING_TO_PERFORM
+        dn = name.decode()
+        if not password:
+            return UNWILLING_TO_PERFORM
+        return SUCCESS if self.passwords.get(dn) == password.decode() else INVALID_CREDENTIALS
+
+    def search(self, content: bytes) -> list:
+        children = ber_children(content)
+        base = children[0][1].decode().lower()
+        size_limit = int.from_bytes(children[3][1], "big")
+        filter_tag, filter_content = children[6]
+        wanted = [v.decode() for _, v in ber_children(children[7][1])]
+
+        found = [(dn, attrs) for dn, attrs in self.entries.items()
+                 if dn.lower().endswith(base) and self.matches(attrs, filter_tag, filter_content)]
+        results = []
+        for dn, attrs in found[:size_limit or None]:
+            attributes = b"".join(
+                ber(0x30, ber_str(name) + ber(0x31, b"".join(ber_str(v) for v in attrs.get(name.lower(), []))))
+                for name in wanted if name.lower() in attrs
+            )
+            results.append(ber(SEARCH_RESULT_ENTRY, ber_str(dn) + ber(0x30, attributes)))
+
+        code = SIZE_LIMIT_EXCEEDED if size_limit and len(found) > size_limit else SUCCESS
+        return results + [ber(SEARCH_RESULT_DONE, ber_int(0x0A, code) + ber_str("") + ber_str(""))]
+
+    def handler(self):
+        server = self
+
+        class Handler(socketserver.BaseRequestHandler):
+            def read_message(self) -> bytes:
+                data = b""
+                while True:
+                    if len(data) >= 2:
+                        try:
+                            _, _, end = ber_read(data)
+                            if end <= len(data):
+                                return data[:end]
+                        except IndexError:
+                            pass
+                    chunk = self.request.recv(4096)
+                    if not chunk:
+                        return b""
+                    data += chunk
+
+            def handle(self):
+                server.connections += 1
+                bound = False
+                while True:
+                    message = self.read_message()
+                    if not message:
+                        return
+                    _, content, _ = ber_read(message)
+                    children = ber_children(content)
+                    message_id = int.from_bytes(children[0][1], "big")
+                    op_tag, op = children[1]
+
+                    if op_tag == UNBIND_REQUEST:
+                        return
+                    if op_tag == BIND_REQUEST:
+                        code = server.bind(op)
+                        bound = code == SUCCESS
+                        replies = [ber(BIND_RESPONSE, ber_int(0x0A, code) + ber_str("") + ber_str(""))]
+                    elif op_tag == SEARCH_REQUEST and bound:
+                        replies = server.search(op)
+                    else:
+                        replies = [ber(op_tag + 1, ber_int(0x0A, OPERATIONS_ERROR) + ber_str("") + ber_str(""))]
+
+                    for reply in replies:
+                        self.request.sendall(ber(0x30, ber_int(0x02, message_id) + reply))
+
+        return Handler
+
+
+@pytest.fixture(scope="module")
+def directory():
+    server = MockLDAPServer(int(os.getenv("LDAP_MOCK_PORT", "6389")))
+    server.start()
+    yield server
+    server.stop()
+
+
+def login(api_url: str, username: str, password: str) -> requests.Response:
+    return requests.post(f"{api_url}/api/auth/login", json={"username": username, "password": password})
+
+
+def test_ldap_login(api_url, directory):
+    """Test that directory users in the chat group log in and get a local account"""
+    uid = f"ldap_user_{int(datetime.now().timestamp() * 1000)}"
+    directory.add_person(uid, "DirectoryPass1", "Ldap User", [CHAT_GROUP])
+
+    response = login(api_url, uid, "DirectoryPass1")
+    if directory.connections == 0:
+        pytest.skip("server is not configured with the mock LDAP server")
+    assert response.status_code == 200
+    data = response.json()
+    assert data["username"] == uid
+    assert data["display_name"] == "Ldap User"
+
+    # The directory stays in charge of the password
+    directory.passwords[f"uid={uid},ou=people,{BASE_DN}"] = "Rotated1"
+    assert login(api_url, uid, "Rotated1").status_code == 200
+    assert login(api_url, uid, "DirectoryPass1").status_code == 401
+
+
+def test_ldap_group_filter(api_url, directory):
+    """Test that directory users outside the chat group may not log in"""
+    uid = f"ldap_user_{int(datetime.now().timestamp() * 1000)}"
+    directory.add_person(uid, "DirectoryPass1", "Outsider", [f"cn=other,ou=groups,{BASE_DN}"])
+
+    response = login(api_url, uid, "DirectoryPass1")
+    if directory.connections == 0:
+        pytest.skip("server is not configured with the mock LDAP server")
+    assert response.status_code == 401
+
+
+def test_local_users_with_ldap(api_url, directory):
+    """Test that local accounts still log in with their own password"""
+    username = f"test_user_{datetime.now().timestamp()}"
+    assert requests.post(f"{api_url}/api/auth/register",
+                         json={"username": username, "password": "TestPass123!"}).status_code == 200
+    assert login(api_url, username, "TestPass123!").status_code == 200
+
+
+
+def test_ldap_cannot_take_over_local_account(api_url, directory):
+    """Test that a directory user with the name of a local account is refused"""
+    username = f"test_user_{datetime.now().timestamp()}"
+    assert requests.post(f"{api_url}/api/auth/register",
+                         json={"username": username, "password": "TestPass123!"}).status_code == 200
+    directory.add_person(username, "DirectoryPass1", "Impostor", [CHAT_GROUP])
+
+    connections = directory.connections
+    response = login(api_url, username, "DirectoryPass1")
+    if directory.connections == connections:
+        pytest.skip("server is not configured with the mock LDAP server")
+    assert response.status_code == 401
+
+    # The local account keeps its own password
+    response = login(api_url, username, "TestPass123!")
+    assert response.status_code == 200
+    assert response.json().get("display_name") != "Impostor"
+
+
+if __name__ == "__main__":
+    pytest.main([__file__])
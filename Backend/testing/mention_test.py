@@ -0,0 +1,70 @@
+import asyncio
+import json
+from datetime import datetime
+
+import requests
+import websockets
+
+
+def register(api_url: str) -> tuple:
+    username = f"test_user_{datetime.now().timestamp()}"
+    response = requests.post(f"{api_url}/api/auth/register", json={"username": username, "password": "TestPass123!"})
+    assert response.status_code == 200
+    return username, {"Authorization": f"Bearer {response.json()['token']}"}
+
+
+async def next_mention(websocket) -> dict:
+    while True:
+        event = json.loads(await asyncio.wait_for(websocket.recv(), timeout=5))
+        if event["type"] == "mention":
+            return event["payload"]
+
+
+async def test_mention_event_and_inbox(api_url, ws_url):
+    """Test that a mentioned user is notified and finds the mention in their inbox"""
+    alice, alice_headers = register(api_url)
+    bob, bob_headers = register(api_url)
+    bob_token = bob_headers["Authorization"].split()[1]
+    content = f"@{bob} can you review {datetime.now().timestamp()}?"
+
+    async with websockets.connect(ws_url, subprotocols=[f"access_token|{bob_token}"]) as websocket:
+        response = requests.post(f"{api_url}/api/messages", headers=alice_headers, json={"content": content})
+        assert response.status_code == 202
+
+        mention = await next_mention(websocket)
+        assert mention["kind"] == "user"
+        assert mention["read"] is False
+        assert mention["message"]["content"] == content
+        assert mention["message"]["username"] == alice
+
+    response = requests.get(f"{api_url}/api/mentions", headers=bob_headers)
+    assert response.status_code == 200
+    inbox = response.json()
+    assert inbox["unread"] == 1
+    assert [m["id"] for m in inbox["mentions"]] == [mention["id"]]
+
+    # Senders are not notified about themselves
+    assert requests.get(f"{api_url}/api/mentions", headers=alice_headers).json()["mentions"] == []
+
+    response = requests.post(f"{api_url}/api/mentions/read", headers=bob_headers, json={"ids": [mention["id"]]})
+    assert response.status_code == 200
+    assert response.json() == {"unread": 0}
+    inbox = requests.get(f"{api_url}/api/mentions", headers=bob_headers).json()
+    assert inbox["mentions"][0]["read"] is True
+    assert requests.get(f"{api_url}/api/mentions?unread=true", headers=bob_headers).json()["mentions"] == []
+
+
+async def test_here_mentions_online_users(api_url, ws_url):
+    """Test that @here mentions users who are connected and not those who are away"""
+    _, alice_headers = register(api_url)
+    _, bob_headers = register(api_url)
+    _, carol_headers = register(api_url)
+    bob_token = bob_headers["Authorization"].split()[1]
+
+    async with websockets.connect(ws_url, subprotocols=[f"access_token|{bob_token}"]) as websocket:
+        await asyncio.sleep(0.5)
+        requests.post(f"{api_url}/api/messages", headers=alice_headers, json={"content": "standup in 5 @here"})
+        mention = await next_mention(websocket)
+        assert mention["kind"] == "here"
+
+    assert requests.get(f"{api_url}/api/mentions", headers=carol_headers).json()["unread"] == 0
@@ -0,0 +1,200 @@
+import base64
+import hashlib
+import json
+import os
+import secrets
+import threading
+import time
+from datetime import datetime
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from urllib.parse import parse_qs, urlparse
+
+import pytest
+import requests
+from cryptography.hazmat.primitives import hashes
+from cryptography.hazmat.primitives.asymmetric import padding, rsa
+
+CLIENT_ID = os.getenv("OIDC_CLIENT_ID", "whisper-test")
+
+
+def b64url(data: bytes) -> str:
+    return base64.urlsafe_b64encode(data).rstrip(b"=").decode()
+
+
+class MockOIDCProvider:
+    """A minimal OpenID Connect provider. Instead of a login page, tests
+    call authorize() to log a user in and get the code the provider would
+    redirect the browser back with."""
+
+    def __init__(self, port: int):
+        self.issuer = f"http://localhost:{port}"
+        self.key = rsa.generate_private_key(public_exponent=65537, key_size=2048)
+        self.kid = secrets.token_hex(8)
+        self.codes = {}
+        self.server = ThreadingHTTPServer(("localhost", port), self.handler())
+
+    def start(self):
+        threading.Thread(target=self.server.serve_forever, daemon=True).start()
+
+    def stop(self):
+        self.server.shutdown()
+        self.server.server_close()
+
+    def authorize(self, authorization_url: str, claims: dict) -> dict:
+        """Log in as the user with claims and return the redirect parameters"""
+        params = {k: v[0] for k, v in parse_qs(urlparse(authorization_url).query).items()}
+        assert params["client_id"] == CLIENT_ID
+        assert params["response_type"] == "code"
+        assert params["code_challenge_method"] == "S256"
+
+        code = secrets.token_urlsafe(16)
+        self.codes[code] = {"params": params, "claims": claims}
+        return {"code": code, "state": params["state"]}
+
+    def id_token(self, params: dict, claims: dict) -> str:
+        now = int(time.time())
+        header = {"alg": "RS256", "typ": "JWT", "kid": self.kid}
+        payload = {"iss": self.issuer, "aud": CLIENT_ID, "iat": now, "exp": now + 300,
+                   "nonce": params["nonce"], **claims}
+        signing_input = f"{b64url(json.dumps(header).encode())}.{b64url(json.dumps(payload).encode())}"
+        signature = self.key.sign(signing_input.encode(), padding.PKCS1v15(), hashes.SHA256())
+        return f"{signing_input}.{b64url(signature)}"
+
+    def jwks(self) -> dict:
+        public = self.key.public_key().public_numbers()
+        return {"keys": [{
+            "kty": "RSA", "use": "sig", "alg": "RS256", "kid": self.kid,
+            "n": b64url(public.n.to_bytes((public.n.bit_length() + 7) // 8, "big")),
+            "e": b64url(public.e.to_bytes(3, "big")),
+        }]}
+
+    def token(self, form: dict) -> tuple:
+        grant = self.codes.pop(form.get("code", ""), None)
+        if grant is None or form.get("grant_type") != "authorization_code":
+            return 400, {"error": "invalid_grant"}
+
+        params = grant["params"]
+        challenge = b64url(hashlib.sha256(form.get("code_verifier", "").encode()).digest())
+        if challenge != params["code_challenge"] or form.get("redirect_uri") != params["redirect_uri"]:
+            return 400, {"error": "invalid_grant"}
+
+        return 200, {
+            "access_token": secrets.token_urlsafe(16),
+            "token_type": "Bearer",
+            "expires_in": 300,
+            "id_token": self.id_token(params, grant["claims"]),
+        }
+
+    def handler(self):
+        provider = self
+
+        class Handler(BaseHTTPRequestHandler):
+            def reply(self, status: int, body: dict):
+                data = json.dumps(body).encode()
+                self.send_response(status)
+                self.send_header("Content-Type", "application/json")
+                self.send_header("Content-Length", str(len(data)))
+                self.end_headers()
+                self.wfile.write(data)
+
+            def do_GET(self):
+                if self.path == "/.well-known/openid-configuration":
+                    self.reply(200, {
+                        "issuer": provider.issuer,
+                        "authorization_endpoint": f"{provider.issuer}/authorize",
+                        "token_endpoint": f"{provider.issuer}/token",
+                        "jwks_uri": f"{provider.issuer}/jwks",
+                        "response_types_supported": ["code"],
+                        "subject_types_supported": ["public"],
+                        "id_token_signing_alg_values_supported": ["RS256"],
+                    })
+                elif self.path == "/jwks":
+                    self.reply(200, provider.jwks())
+                else:
+                    self.reply(404, {"error": "not_found"})
+
+            def do_POST(self):
+                if self.path != "/token":
+                    self.reply(404, {"error": "not_found"})
+                    return
+                length = int(self.headers.get("Content-Length", 0))
+                form = {k: v[0] for k, v in parse_qs(self.rfile.read(length).decode()).items()}
+                self.reply(*provider.token(form))
+
+            def log_message(self, format, *args):
+                pass
+
+        return Handler
+
+
+@pytest.fixture(scope="module")
+def provider():
+    provider = MockOIDCProvider(int(os.getenv("OIDC_MOCK_PORT", "6263")))
+    provider.start()
+    yield provider
+    provider.stop()
+
+
+def begin_login(api_url: str, headers: dict = None, link: bool = False) -> str:
+    path = "/api/auth/oidc/link/begin" if link else "/api/auth/oidc/begin"
+    response = requests.post(f"{api_url}{path}", headers=headers)
+    if response.status_code == 404:
+        pytest.skip("server is not configured with the mock OIDC provider")
+    assert response.status_code == 200
+    return response.json()["authorization_url"]
+
+
+def sso_login(api_url: str, provider: MockOIDCProvider, claims: dict) -> requests.Response:
+    callback = provider.authorize(begin_login(api_url), claims)
+    return requests.post(f"{api_url}/api/auth/oidc/finish", json=callback)
+
+
+def test_oidc_login_provisions_user(api_url, provider):
+    """Test that a first single sign-on creates an account that later logins reuse"""
+    username = f"sso_user_{datetime.now().timestamp()}"
+    subject = secrets.token_hex(8)
+
+    response = sso_login(api_url, provider, {"sub": subject, "preferred_username": username, "name": "Sso User"})
+    assert response.status_code == 200
+    data = response.json()
+    assert data["username"] == username
+    assert data["display_name"] == "Sso User"
+    assert data["token"]
+
+    # The subject, not the username claim, identifies the user
+    response = sso_login(api_url, provider, {"sub": subject, "preferred_username": "renamed", "name": "Renamed"})
+    assert response.status_code == 200
+    assert response.json()["username"] == username
+    assert response.json()["display_name"] == "Renamed"
+
+
+def test_oidc_callback_single_use(api_url, provider):
+    """Test that an authorization response cannot be replayed"""
+    callback = provider.authorize(begin_login(api_url), {"sub": secrets.token_hex(8),
+                                                         "preferred_username": f"sso_user_{datetime.now().timestamp()}"})
+    assert requests.post(f"{api_url}/api/auth/oidc/finish", json=callback).status_code == 200
+    assert requests.post(f"{api_url}/api/auth/oidc/finish", json=callback).status_code == 401
+
+
+def test_oidc_link_existing_account(api_url, provider):
+    """Test linking an identity to a password account instead of taking its name"""
+    username = f"test_user_{datetime.now().timestamp()}"
+    response = requests.post(f"{api_url}/api/auth/register", json={"username": username, "password": "TestPass123!"})
+    assert response.status_code == 200
+    headers = {"Authorization": f"Bearer {response.json()['token']}"}
+    claims = {"sub": secrets.token_hex(8), "preferred_username": username}
+
+    # An unlinked identity may not take over an existing account's name
+    assert sso_login(api_url, provider, claims).status_code == 409
+
+    callback = provider.authorize(begin_login(api_url, headers, link=True), claims)
+    response = requests.post(f"{api_url}/api/auth/oidc/link/finish", headers=headers, json=callback)
+    assert response.status_code == 204
+
+    response = sso_login(api_url, provider, claims)
+    assert response.status_code == 200
+    assert response.json()["username"] == username
+
+
+if __name__ == "__main__":
+    pytest.main([__file__])
@@ -0,0 +1,113 @@
+import asyncio
+import json
+import time
+from datetime import datetime
+
+import requests
+import websockets
+
+
+def register(api_url: str) -> tuple:
+    username = f"test_user_{datetime.now().timestamp()}"
+    response = requests.post(f"{api_url}/api/auth/register", json={"username": username, "password": "TestPass123!"})
+    assert response.status_code == 200
+    return username, {"Authorization": f"Bearer {response.json()['token']}"}
+
+
+def post(api_url: str, headers: dict, content: str) -> int:
+    """Post a message and return its ID once it is stored"""
+    assert requests.post(f"{api_url}/api/messages", headers=headers, json={"content": content}).status_code == 202
+    for _ in range(20):
+        messages = requests.get(f"{api_url}/api/messages", headers=headers).json()["messages"]
+        found = [m["id"] for m in messages if m["content"] == content]
+        if found:
+            return found[0]
+        time.sleep(0.1)
+    raise AssertionError(f"message {content!r} was not stored")
+
+
+def test_unread_count_with_history(api_url):
+    """Test that history carries the caller's read marker and unread count"""
+    _, alice_headers = register(api_url)
+    _, bob_headers = register(api_url)
+    first = post(api_url, alice_headers, f"first {datetime.now().timestamp()}")
+    second = post(api_url, alice_headers, f"second {datetime.now().timestamp()}")
+
+    response = requests.post(f"{api_url}/api/messages/read", headers=bob_headers, json={"message_id": first})
+    assert response.status_code == 200
+    state = response.json()
+    assert state["last_read_message_id"] == first
+    assert state["unread"] >= 1
+
+    response = requests.get(f"{api_url}/api/messages", headers=bob_headers)
+    assert response.headers["X-Last-Read-ID"] == str(first)
+    assert int(response.headers["X-Unread-Count"]) == state["unread"]
+    page = response.json()
+    assert page["last_read_id"] == first
+    assert page["unread"] == state["unread"]
+
+    # The marker never moves backwards, and a sender's own messages are not unread
+    requests.post(f"{api_url}/api/messages/read", headers=bob_headers, json={"message_id": second})
+    response = requests.post(f"{api_url}/api/messages/read", headers=bob_headers, json={"message_id": first})
+    assert response.json()["last_read_message_id"] >= second
+    response = requests.post(f"{api_url}/api/messages/read", headers=alice_headers, json={"message_id": second})
+    assert response.json()["last_read_message_id"] >= second
+
+    assert requests.post(f"{api_url}/api/messages/read", headers=bob_headers, json={}).status_code == 400
+
+
+async def test_read_frame_and_receipts(api_url, ws_url):
+    """Test that a read frame updates every connection of the reader and tells the sender"""
+    alice, alice_headers = register(api_url)
+    bob, bob_headers = register(api_url)
+    message_id = post(api_url, alice_headers, f"read me {datetime.now().timestamp()}")
+    alice_token = alice_headers["Authorization"].split()[1]
+    bob_token = bob_headers["Authorization"].split()[1]
+
+    async with websockets.connect(ws_url, subprotocols=[f"access_token|{alice_token}"]) as alice_ws, \
+            websockets.connect(ws_url, subprotocols=[f"access_token|{bob_token}"]) as bob_ws:
+        await bob_ws.send(json.dumps({"type": "read", "payload": {"message_id": message_id}}))
+
+        while True:
+            event = json.loads(await asyncio.wait_for(bob_ws.recv(), timeout=5))
+            if event["type"] == "read_state":
+                break
+        assert event["payload"]["last_read_message_id"] >= message_id
+
+        while True:
+            event = json.loads(await asyncio.wait_for(alice_ws.recv(), timeout=5))
+            if event["type"] == "read" and event["payload"]["username"] == bob:
+                break
+        assert event["payload"]["message_id"] >= message_id
+
+
+async def test_read_live_message(api_url, ws_url):
+    """Test that a live chat frame carries the ID of the stored message, which a read frame accepts"""
+    _, alice_headers = register(api_url)
+    _, bob_headers = register(api_url)
+    content = f"live {datetime.now().timestamp()}"
+    alice_token = alice_headers["Authorization"].split()[1]
+    bob_token = bob_headers["Authorization"].split()[1]
+
+    async with websockets.connect(ws_url, subprotocols=[f"access_token|{alice_token}"]) as alice_ws, \
+            websockets.connect(ws_url, subprotocols=[f"access_token|{bob_token}"]) as bob_ws:
+        await alice_ws.send(content)
+
+        while True:
+            event = json.loads(await asyncio.wait_for(bob_ws.recv(), timeout=5))
+            if event["type"] == "chat" and event["payload"]["content"] == content:
+                break
+        message_id = event["payload"]["id"]
+        assert message_id > 0
+
+        # The ID is the stored message's, so it can be linked to right away
+        response = requests.get(f"{api_url}/api/messages/{message_id}/context", headers=bob_headers)
+        assert response.status_code == 200
+        assert response.json()["message"]["content"] == content
+
+        await bob_ws.send(json.dumps({"type": "read", "payload": {"message_id": message_id}}))
+        while True:
+            event = json.loads(await asyncio.wait_for(bob_ws.recv(), timeout=5))
+            if event["type"] == "read_state":
+                break
+        assert event["payload"]["last_read_message_id"] == message_id
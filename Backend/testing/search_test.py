@@ -0,0 +1,75 @@
+import time
+from datetime import datetime
+
+import requests
+
+
+def register(api_url: str) -> tuple:
+    username = f"test_user_{datetime.now().timestamp()}"
+    response = requests.post(f"{api_url}/api/auth/register", json={"username": username, "password": "TestPass123!"})
+    assert response.status_code == 200
+    return username, {"Authorization": f"Bearer {response.json()['token']}"}
+
+
+def search(api_url: str, headers: dict, **params) -> requests.Response:
+    return requests.get(f"{api_url}/api/messages/search", headers=headers, params=params)
+
+
+def test_message_search(api_url):
+    """Test ranked full-text search with highlighted snippets and filters"""
+    alice, alice_headers = register(api_url)
+    _, bob_headers = register(api_url)
+    word = f"zebra{int(datetime.now().timestamp() * 1000)}"
+
+    for headers, content in [
+        (alice_headers, f"the {word} deployed to staging"),
+        (bob_headers, f"{word} {word} <b>rollback</b> & retry"),
+        (alice_headers, "nothing to see here"),
+    ]:
+        assert requests.post(f"{api_url}/api/messages", headers=headers, json={"content": content}).status_code == 202
+    time.sleep(1)
+
+    response = search(api_url, alice_headers, q=word)
+    assert response.status_code == 200
+    results = response.json()["results"]
+    assert len(results) == 2
+    # The message repeating the word ranks first, and its snippet is escaped
+    assert results[0]["rank"] >= results[1]["rank"]
+    assert f"<mark>{word}</mark>" in results[0]["snippet"]
+    assert "&lt;b&gt;" in results[0]["snippet"]
+
+    # Stemming matches other forms of a word
+    results = search(api_url, alice_headers, q=f"{word} deploying").json()["results"]
+    assert [r["message"]["username"] for r in results] == [alice]
+
+    results = search(api_url, alice_headers, q=word, author=alice).json()["results"]
+    assert [r["message"]["username"] for r in results] == [alice]
+    assert search(api_url, alice_headers, q=word, to=int(time.time()) - 3600).json()["results"] == []
+
+    assert search(api_url, alice_headers, q="").status_code == 400
+    assert search(api_url, alice_headers, q=word, cursor="garbage").status_code == 400
+    # There is a single chat room, so a room filter is refused rather than ignored
+    assert search(api_url, alice_headers, q=word, room="general").status_code == 400
+
+
+def test_message_search_pages(api_url):
+    """Test that search cursors page through results without repeats"""
+    _, headers = register(api_url)
+    word = f"okapi{int(datetime.now().timestamp() * 1000)}"
+    for i in range(5):
+        requests.post(f"{api_url}/api/messages", headers=headers, json={"content": f"{word} number {i}"})
+    time.sleep(1)
+
+    seen, cursor = [], None
+    while True:
+        params = {"q": word, "limit": 2}
+        if cursor:
+            params["cursor"] = cursor
+        page = search(api_url, headers, **params).json()
+        seen += [r["message"]["id"] for r in page["results"]]
+        if not page["has_more"]:
+            break
+        cursor = page["next"]
+
+    assert len(seen) == 5
+    assert len(set(seen)) == 5
@@ -0,0 +1,173 @@
+import base64
+import hashlib
+import json
+import os
+import struct
+from datetime import datetime
+
+import pytest
+import requests
+from cryptography.hazmat.primitives import hashes
+from cryptography.hazmat.primitives.asymmetric import ec
+
+
+def b64url(data: bytes) -> str:
+    return base64.urlsafe_b64encode(data).rstrip(b"=").decode()
+
+
+def b64url_decode(data: str) -> bytes:
+    return base64.urlsafe_b64decode(data + "=" * (-len(data) % 4))
+
+
+def cbor(value) -> bytes:
+    """Encode the few CBOR types an attestation object needs"""
+    def head(major: int, n: int) -> bytes:
+        if n < 24:
+            return bytes([major << 5 | n])
+        if n < 0x100:
+            return bytes([major << 5 | 24, n])
+        if n < 0x10000:
+            return bytes([major << 5 | 25]) + struct.pack(">H", n)
+        return bytes([major << 5 | 26]) + struct.pack(">I", n)
+
+    if isinstance(value, int):
+        return head(0, value) if value >= 0 else head(1, -1 - value)
+    if isinstance(value, bytes):
+        return head(2, len(value)) + value
+    if isinstance(value, str):
+        encoded = value.encode()
+        return head(3, len(encoded)) + encoded
+    if isinstance(value, dict):
+        return head(5, len(value)) + b"".join(cbor(k) + cbor(v) for k, v in value.items())
+    raise TypeError(f"cannot encode {type(value)}")
+
+
+class SoftwareAuthenticator:
+    """A passkey held in memory, answering ceremonies the way a browser and
+    platform authenticator would"""
+
+    FLAG_USER_PRESENT = 0x01
+    FLAG_USER_VERIFIED = 0x04
+    FLAG_ATTESTED = 0x40
+
+    def __init__(self, origin: str, rp_id: str = "localhost"):
+        self.origin = origin
+        self.rp_id_hash = hashlib.sha256(rp_id.encode()).digest()
+        self.key = ec.generate_private_key(ec.SECP256R1())
+        self.credential_id = os.urandom(32)
+        self.user_handle = b""
+        self.sign_count = 0
+
+    def client_data(self, kind: str, challenge: str) -> bytes:
+        return json.dumps({"type": kind, "challenge": challenge, "origin": self.origin}).encode()
+
+    def create(self, options: dict) -> dict:
+        public = self.key.public_key().public_numbers()
+        cose_key = cbor({1: 2, 3: -7, -1: 1, -2: public.x.to_bytes(32, "big"), -3: public.y.to_bytes(32, "big")})
+        auth_data = (
+            self.rp_id_hash
+            + bytes([self.FLAG_USER_PRESENT | self.FLAG_USER_VERIFIED | self.FLAG_ATTESTED])
+            + struct.pack(">I", self.sign_count)
+            + bytes(16)
+            + struct.pack(">H", len(self.credential_id))
+            + self.credential_id
+            + cose_key
+        )
+        self.user_handle = b64url_decode(options["publicKey"]["user"]["id"])
+
+        return {
+            "id": b64url(self.credential_id),
+            "rawId": b64url(self.credential_id),
+            "type": "public-key",
+            "response": {
+                "clientDataJSON": b64url(self.client_data("webauthn.create", options["publicKey"]["challenge"])),
+                "attestationObject": b64url(cbor({"fmt": "none", "attStmt": {}, "authData": auth_data})),
+            },
+        }
+
+    def get(self, options: dict) -> dict:
+        self.sign_count += 1
+        client_data = self.client_data("webauthn.get", options["publicKey"]["challenge"])
+        auth_data = (
+            self.rp_id_hash
+            + bytes([self.FLAG_USER_PRESENT | self.FLAG_USER_VERIFIED])
+            + struct.pack(">I", self.sign_count)
+        )
+        signature = self.key.sign(auth_data + hashlib.sha256(client_data).digest(), ec.ECDSA(hashes.SHA256()))
+
+        return {
+            "id": b64url(self.credential_id),
+            "rawId": b64url(self.credential_id),
+            "type": "public-key",
+            "response": {
+                "clientDataJSON": b64url(client_data),
+                "authenticatorData": b64url(auth_data),
+                "signature": b64url(signature),
+                "userHandle": b64url(self.user_handle),
+            },
+        }
+
+
+def passkey_login(api_url: str, authenticator: SoftwareAuthenticator) -> requests.Response:
+    response = requests.post(f"{api_url}/api/auth/webauthn/login/begin")
+    assert response.status_code == 200
+    ceremony = response.json()
+
+    return requests.post(f"{api_url}/api/auth/webauthn/login/finish", json={
+        "ceremony_id": ceremony["ceremony_id"],
+        "credential": authenticator.get(ceremony["options"]),
+    })
+
+
+def test_passkey_registration_and_login(api_url):
+    """Test registering a passkey and logging in with it instead of a password"""
+    username = f"test_user_{datetime.now().timestamp()}"
+    response = requests.post(f"{api_url}/api/auth/register",
+                             json={"username": username, "password": "TestPass123!"})
+    assert response.status_code == 200
+    headers = {"Authorization": f"Bearer {response.json()['token']}"}
+    authenticator = SoftwareAuthenticator(api_url)
+
+    response = requests.post(f"{api_url}/api/auth/webauthn/register/begin", headers=headers)
+    assert response.status_code == 200
+    ceremony = response.json()
+    assert ceremony["options"]["publicKey"]["user"]["name"] == username
+
+    response = requests.post(f"{api_url}/api/auth/webauthn/register/finish", headers=headers, json={
+        "ceremony_id": ceremony["ceremony_id"],
+        "name": "Test key",
+        "credential": authenticator.create(ceremony["options"]),
+    })
+    assert response.status_code == 201
+    passkey = response.json()
+    assert passkey["name"] == "Test key"
+
+    # The passkey alone starts a session for its owner
+    response = passkey_login(api_url, authenticator)
+    assert response.status_code == 200
+    assert response.json()["username"] == username
+    assert response.json()["token"]
+
+    # A copy of the key replaying an old sign counter is refused
+    authenticator.sign_count = 0
+    assert passkey_login(api_url, authenticator).status_code == 401
+
+    response = requests.get(f"{api_url}/api/auth/webauthn/credentials", headers=headers)
+    assert response.status_code == 200
+    assert [p["id"] for p in response.json()] == [passkey["id"]]
+
+    response = requests.delete(f"{api_url}/api/auth/webauthn/credentials/{passkey['id']}", headers=headers)
+    assert response.status_code == 204
+    authenticator.sign_count = 10
+    assert passkey_login(api_url, authenticator).status_code == 401
+
+
+def test_passkey_ceremony_single_use(api_url):
+    """Test that an unknown or already finished ceremony is rejected"""
+    response = requests.post(f"{api_url}/api/auth/webauthn/login/finish",
+                             json={"ceremony_id": "unknown", "credential": {}})
+    assert response.status_code == 401
+
+
+if __name__ == "__main__":
+    pytest.main([__file__])
@@ -0,0 +1,156 @@
+import hashlib
+import hmac
+import json
+import os
+import threading
+import time
+from datetime import datetime
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+import pytest
+import requests
+
+SECRET = os.getenv("WEBHOOK_SECRET", "whisper-test")
+ADMIN_USERNAME = os.getenv("WEBHOOK_ADMIN_USERNAME", "webhook_admin")
+ADMIN_PASSWORD = "TestPass123!"
+
+
+class WebhookReceiver:
+    """A local stand-in for a CI or ticketing system that records the
+    webhook requests it gets. Paths listed in failures answer 500 that many
+    times before accepting."""
+
+    def __init__(self, port: int):
+        self.requests = []
+        self.failures = {}
+        self.lock = threading.Lock()
+        self.server = ThreadingHTTPServer(("localhost", port), self.handler())
+
+    def start(self):
+        threading.Thread(target=self.server.serve_forever, daemon=True).start()
+
+    def stop(self):
+        self.server.shutdown()
+        self.server.server_close()
+
+    def wait_for(self, predicate, count: int = 1, timeout: float = 10) -> list:
+        """Wait until count recorded requests match predicate and return those that do"""
+        deadline = time.time() + timeout
+        while True:
+            with self.lock:
+                found = [r for r in self.requests if predicate(r)]
+            if len(found) >= count or time.time() >= deadline:
+                return found
+            time.sleep(0.1)
+
+    def handler(self):
+        receiver = self
+
+        class Handler(BaseHTTPRequestHandler):
+            def do_POST(self):
+                body = self.rfile.read(int(self.headers.get("Content-Length", 0)))
+                with receiver.lock:
+                    receiver.requests.append({"path": self.path, "headers": dict(self.headers), "body": body})
+                    failing = receiver.failures.get(self.path, 0)
+                    if failing:
+                        receiver.failures[self.path] = failing - 1
+                self.send_response(500 if failing else 204)
+                self.end_headers()
+
+            def log_message(self, format, *args):
+                pass
+
+        return Handler
+
+
+@pytest.fixture(scope="module")
+def receiver():
+    receiver = WebhookReceiver(int(os.getenv("WEBHOOK_RECEIVER_PORT", "6264")))
+    receiver.start()
+    yield receiver
+    receiver.stop()
+
+
+def post_message(api_url: str, content: str):
+    username = f"test_user_{datetime.now().timestamp()}"
+    response = requests.post(f"{api_url}/api/auth/register", json={"username": username, "password": "TestPass123!"})
+    headers = {"Authorization": f"Bearer {response.json()['token']}"}
+    assert requests.post(f"{api_url}/api/messages", headers=headers, json={"content": content}).status_code == 202
+
+
+def with_content(path: str, content: str):
+    return lambda r: r["path"] == path and json.loads(r["body"])["message"]["content"] == content
+
+
+def admin_headers(api_url: str) -> dict:
+    credentials = {"username": ADMIN_USERNAME, "password": ADMIN_PASSWORD}
+    response = requests.post(f"{api_url}/api/auth/login", json=credentials)
+    if response.status_code != 200:
+        response = requests.post(f"{api_url}/api/auth/register", json=credentials)
+    return {"Authorization": f"Bearer {response.json()['token']}"}
+
+
+def test_webhook_signed_delivery(api_url, receiver):
+    """Test that messages are POSTed to matching webhooks with a valid signature"""
+    content = f"hello webhooks {datetime.now().timestamp()}"
+    post_message(api_url, content)
+
+    delivered = receiver.wait_for(with_content("/hooks/all", content))
+    if not delivered:
+        pytest.skip("server is not configured with testing/webhooks.yaml")
+    request = delivered[0]
+    headers = request["headers"]
+    assert headers["X-Whisper-Event"] == "message.created"
+
+    expected = hmac.new(SECRET.encode(), headers["X-Whisper-Timestamp"].encode() + b"." + request["body"],
+                        hashlib.sha256).hexdigest()
+    assert hmac.compare_digest(headers["X-Whisper-Signature"], f"sha256={expected}")
+
+    event = json.loads(request["body"])
+    assert event["event"] == "message.created"
+    assert event["message"]["id"] > 0
+
+    # The keyword filter keeps unrelated messages from the deploys webhook
+    assert not receiver.wait_for(with_content("/hooks/deploys", content), timeout=2)
+
+
+def test_webhook_retry_and_dead_letter(api_url, receiver):
+    """Test that failed deliveries are retried with backoff, then dead-lettered"""
+    receiver.failures["/hooks/deploys"] = 1
+    content = f"deploy started {datetime.now().timestamp()}"
+    post_message(api_url, content)
+
+    attempts = receiver.wait_for(with_content("/hooks/deploys", content), count=2, timeout=15)
+    if not attempts:
+        pytest.skip("server is not configured with testing/webhooks.yaml")
+    assert len(attempts) == 2
+
+    receiver.failures["/hooks/deploys"] = 100
+    content = f"deploy failed {datetime.now().timestamp()}"
+    post_message(api_url, content)
+    assert len(receiver.wait_for(with_content("/hooks/deploys", content), count=3, timeout=20)) == 3
+    receiver.failures["/hooks/deploys"] = 0
+
+    # The delivery log needs an admin
+    headers = admin_headers(api_url)
+    deadline = time.time() + 5
+    while True:
+        response = requests.get(f"{api_url}/api/admin/webhooks/dead-letters", headers=headers,
+                                params={"webhook": "deploys"})
+        if response.status_code == 403:
+            pytest.skip(f"{ADMIN_USERNAME} is not in ADMIN_USERNAMES")
+        assert response.status_code == 200
+        dead = [d for d in response.json() if d["payload"]["message"]["content"] == content]
+        if dead or time.time() >= deadline:
+            break
+        time.sleep(0.2)
+    assert dead[0]["attempts"] == 3
+    assert dead[0]["response_status"] == 500
+
+    response = requests.post(f"{api_url}/api/admin/webhooks/deliveries/{dead[0]['id']}/retry", headers=headers)
+    assert response.status_code == 204
+    assert len(receiver.wait_for(with_content("/hooks/deploys", content), count=4)) == 4
+
+
+if __name__ == "__main__":
+    pytest.main([__file__])
@@ -1,6 +1,7 @@
 import asyncio
 import json
 import logging
+import time
 from datetime import datetime
 from typing import Any, Dict, List, Optional
 
@@ -206,15 +207,72 @@ async def test_message_persistence(tester: WebSocketTester):
     await asyncio.sleep(1)
 
     # Retrieve recent messages
-    response = requests.get(f"{tester.base_url}/api/messages/recent", headers=headers)
+    response = requests.get(f"{tester.base_url}/api/messages", headers=headers)
     assert response.status_code == 200
 
-    messages = response.json()
+    messages = response.json()["messages"]
     assert len(messages) > 0
     assert any(msg["content"] == test_message for msg in messages)
 
     # Cleanup
     await tester.cleanup_ws_clients()
 
+@pytest.mark.asyncio
+async def test_logout_closes_websocket(tester: WebSocketTester):
+    """Test that logging out closes live sockets and rejects new ones"""
+    username = f"ws_test_user_{datetime.now().timestamp()}"
+    password = "TestPass123!"
+
+    tester.register_user(username, password)
+    token = tester.auth_tokens[username]
+    client = await tester.setup_ws_client(username)
+    assert client.connected is True
+
+    # Logging out closes the open socket with the session revoked code
+    assert tester.logout_user(username) is True
+    await asyncio.sleep(1)
+    assert client.connected is False
+    assert client.websocket.close_code == 4003
+
+    # The logged-out token can no longer open a socket
+    stale = WebSocketClient(tester.ws_url, token, username)
+    assert await stale.connect() is False
+
+    # Cleanup
+    await tester.cleanup_ws_clients()
+
+@pytest.mark.asyncio
+async def test_system_messages_only_reach_sender(tester: WebSocketTester):
+    """Test that refused messages are answered with a system message to the sender alone"""
+    reader = f"ws_test_user1_{datetime.now().timestamp()}"
+    other = f"ws_test_user2_{datetime.now().timestamp()}"
+    for username in (reader, other):
+        tester.register_user(username, "TestPass123!")
+    headers = {"Authorization": f"Bearer {tester.auth_tokens[reader]}"}
+
+    # A read-only token may connect but not post
+    response = requests.post(f"{tester.base_url}/api/auth/tokens", headers=headers,
+                             json={"name": "reader", "scopes": ["messages:read"], "expires_at": int(time.time()) + 3600})
+    assert response.status_code == 201
+    read_only = WebSocketClient(tester.ws_url, response.json()["token"], reader)
+    assert await read_only.connect() is True
+    asyncio.create_task(read_only.listen())
+    listener = await tester.setup_ws_client(other)
+
+    content = f"not allowed {datetime.now().timestamp()}"
+    await read_only.send_message(content)
+    await asyncio.sleep(1)
+
+    notices = [m for m in read_only.received_messages if m["type"] == "system"]
+    assert notices and notices[0]["payload"]["kind"] == "error"
+    assert not any(m["type"] == "system" for m in listener.received_messages)
+
+    messages = requests.get(f"{tester.base_url}/api/messages", headers=headers).json()["messages"]
+    assert not any(m["content"] == content for m in messages)
+
+    # Cleanup
+    await read_only.disconnect()
+    await tester.cleanup_ws_clients()
+
 if __name__ == "__main__":
     pytest.main([__file__, "-v"])
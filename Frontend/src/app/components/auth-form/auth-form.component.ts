@@ -13,6 +13,8 @@ import { FormsModule } from "@angular/forms";
 export class AuthFormComponent {
     username: string = '';
     password: string = '';
+    code: string = '';
+    mfaToken: string | null = null;
     error: string = '';
 
     constructor(private authService: AuthService) { }
@@ -24,6 +26,7 @@ export class AuthFormComponent {
 
         if (isLogin) {
             this.authService.login(credentials).subscribe({
+                next: (response) => this.mfaToken = response.mfa_token ?? null,
                 error: (err) => this.error = err.error || 'Login failed'
             });
         } else {
@@ -32,4 +35,21 @@ export class AuthFormComponent {
             });
         }
     }
+
+    onVerify(): void {
+        if (!this.mfaToken) {
+            return;
+        }
+
+        this.error = '';
+
+        this.authService.verifyMFA({ mfa_token: this.mfaToken, code: this.code }).subscribe({
+            error: (err) => {
+                this.error = err.error || 'Verification failed';
+                if (err.status === 401 && err.error?.startsWith('login expired')) {
+                    this.mfaToken = null;
+                }
+            }
+        });
+    }
 }
\ No newline at end of file
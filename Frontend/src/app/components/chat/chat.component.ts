@@ -1,5 +1,5 @@
 import { Component, ElementRef, OnDestroy, OnInit, ViewChild } from "@angular/core";
-import { Message } from "../../models/message.model";
+import { Message, MessagePage } from "../../models/message.model";
 import { WebsocketService } from "../../services/websocket.service";
 import { AuthService } from "../../services/auth.service";
 import { HttpClient, HttpHeaders } from "@angular/common/http";
@@ -20,7 +20,7 @@ export class ChatComponent implements OnInit, OnDestroy {
     onlineUsers: string[] = [];
     newMessage: string = '';
     isLoadingMore: boolean = false;
-    lastMessageId: number = 0;
+    olderCursor: string | null = null;
 
     constructor(
         private websocketService: WebsocketService,
@@ -52,16 +52,12 @@ export class ChatComponent implements OnInit, OnDestroy {
             'Authorization': `Bearer ${this.authService.token}`
         });
 
-        this.http.get<Message[]>(this.authService.API_URL + '/messages/recent', { headers })
+        this.http.get<MessagePage>(this.authService.API_URL + '/messages', { headers })
             .subscribe({
-                next: (messages) => {
-                    if (messages != null) {
-                        this.messages = messages;
-                        if (messages.length > 0) {
-                            this.lastMessageId = messages[0].id;
-                        }
-                        setTimeout(() => this.scrollToBottom(), 0);
-                    }
+                next: (page) => {
+                    this.messages = page.messages;
+                    this.olderCursor = page.has_more ? page.next ?? null : null;
+                    setTimeout(() => this.scrollToBottom(), 0);
                 },
                 error: (error) => {
                     console.error('Failed to load messages:', error);
@@ -70,20 +66,18 @@ export class ChatComponent implements OnInit, OnDestroy {
     }
 
     loadPreviousMessages(): void {
-        if (this.isLoadingMore || this.lastMessageId === 0) return;
+        if (this.isLoadingMore || this.olderCursor === null) return;
 
         this.isLoadingMore = true;
         const headers = new HttpHeaders({
             'Authorization': `Bearer ${this.authService.token}`
         });
 
-        this.http.get<Message[]>(`${this.authService.API_URL}/messages/before/${this.lastMessageId}`, { headers })
+        this.http.get<MessagePage>(`${this.authService.API_URL}/messages`, { headers, params: { cursor: this.olderCursor } })
             .subscribe({
-                next: (messages) => {
-                    if (messages != null && messages.length > 0) {
-                        this.messages = [...messages, ...this.messages];
-                        this.lastMessageId = messages[0].id;
-                    }
+                next: (page) => {
+                    this.messages = [...page.messages, ...this.messages];
+                    this.olderCursor = page.has_more ? page.next ?? null : null;
                     this.isLoadingMore = false;
                 },
                 error: (error) => {
@@ -1,7 +1,7 @@
 import { HttpErrorResponse, HttpEvent, HttpHandler, HttpInterceptor, HttpRequest } from "@angular/common/http";
 import { Injectable } from "@angular/core";
 import { AuthService } from "../services/auth.service";
-import { catchError, Observable, throwError } from "rxjs";
+import { catchError, Observable, switchMap, throwError } from "rxjs";
 import { WebsocketService } from "../services/websocket.service";
 
 @Injectable()
@@ -12,25 +12,40 @@ export class AuthInterceptor implements HttpInterceptor {
     ) { }
 
     intercept(request: HttpRequest<any>, next: HttpHandler): Observable<HttpEvent<any>> {
-        const token = this.authService.token;
-
-        if (token) {
-            request = request.clone({
-                setHeaders: {
-                    Authorization: `Bearer ${token}`
-                }
-            });
-        }
-
-        return next.handle(request).pipe(
+        return next.handle(this.withToken(request, this.authService.token)).pipe(
             catchError((error: HttpErrorResponse) => {
+                // An expired access token is renewed once before giving up.
+                if (error.status === 401 && !request.url.includes('/auth/')) {
+                    return this.authService.refresh().pipe(
+                        switchMap(response => next.handle(this.withToken(request, response.token))),
+                        catchError(refreshError => {
+                            this.signOut();
+                            return throwError(() => refreshError);
+                        })
+                    );
+                }
                 if (error.status === 401 || error.status === 403) {
-                    localStorage.clear();
-                    this.websocketService.disconnect();
-                    this.authService.clearState();
+                    this.signOut();
                 }
                 return throwError(() => error);
             })
         );
     }
+
+    private withToken(request: HttpRequest<any>, token: string | null): HttpRequest<any> {
+        if (!token) {
+            return request;
+        }
+        return request.clone({
+            setHeaders: {
+                Authorization: `Bearer ${token}`
+            }
+        });
+    }
+
+    private signOut(): void {
+        localStorage.clear();
+        this.websocketService.disconnect();
+        this.authService.clearState();
+    }
 }
\ No newline at end of file
@@ -10,6 +10,15 @@ export interface RegisterRequest {
 
 export interface AuthResponse {
     token: string;
+    refresh_token: string;
+    expires_at: number;
     username: string;
+    mfa_required?: boolean;
+    mfa_token?: string;
+}
+
+export interface MFAVerifyRequest {
+    mfa_token: string;
+    code: string;
 }
 
@@ -3,5 +3,17 @@ export interface Message {
     content: string;
     user_id: number;
     username: string;
-    created_at: number;
-}
\ No newline at end of file
+    display_name?: string;
+    bot?: boolean;
+    created_at: string;
+    created_at_unix: number;
+}
+
+export interface MessagePage {
+    messages: Message[];
+    next?: string;
+    prev?: string;
+    has_more: boolean;
+    last_read_id?: number;
+    unread?: number;
+}
@@ -1 +1 @@
-export type MessageType = 'chat' | 'join' | 'leave' | 'users';
+export type MessageType = 'chat' | 'join' | 'leave' | 'users' | 'token_expiring' | 'auth_ok' | 'auth_error';
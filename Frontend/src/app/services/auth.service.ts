@@ -1,6 +1,6 @@
 import { Injectable } from "@angular/core";
-import { BehaviorSubject, map, Observable } from "rxjs";
-import { AuthResponse, LoginRequest, RegisterRequest } from "../models/auth.model";
+import { BehaviorSubject, finalize, map, Observable, shareReplay } from "rxjs";
+import { AuthResponse, LoginRequest, MFAVerifyRequest, RegisterRequest } from "../models/auth.model";
 import { HttpClient } from "@angular/common/http";
 
 @Injectable({
@@ -10,6 +10,7 @@ export class AuthService {
     public readonly API_URL = '/api';
     private currentUserSubject: BehaviorSubject<string | null>;
     private tokenSubject: BehaviorSubject<string | null>;
+    private refreshInFlight: Observable<AuthResponse> | null = null;
 
     constructor(private http: HttpClient) {
         this.currentUserSubject = new BehaviorSubject<string | null>(
@@ -35,45 +36,53 @@ export class AuthService {
     public clearState(): void {
         localStorage.removeItem('currentUser');
         localStorage.removeItem('token');
+        localStorage.removeItem('refreshToken');
         this.currentUserSubject.next(null);
         this.tokenSubject.next(null);
     }
 
+    // Users with two-factor authentication get a challenge instead of
+    // tokens; the login is finished with verifyMFA.
     public login(credentials: LoginRequest): Observable<AuthResponse> {
         return this.http.post<AuthResponse>(`${this.API_URL}/auth/login`, credentials)
-            .pipe(
-                map(response => {
-                    localStorage.setItem('currentUser', response.username);
-                    localStorage.setItem('token', response.token);
-                    this.currentUserSubject.next(response.username);
-                    this.tokenSubject.next(response.token);
-                    return response;
-                })
-            );
+            .pipe(map(response => response.mfa_required ? response : this.storeState(response)));
+    }
+
+    public verifyMFA(request: MFAVerifyRequest): Observable<AuthResponse> {
+        return this.http.post<AuthResponse>(`${this.API_URL}/auth/2fa/verify`, request)
+            .pipe(map(response => this.storeState(response)));
     }
 
     public register(credentials: RegisterRequest): Observable<AuthResponse> {
         return this.http.post<AuthResponse>(`${this.API_URL}/auth/register`, credentials)
-            .pipe(
-                map(response => {
-                    localStorage.setItem('currentUser', response.username);
-                    localStorage.setItem('token', response.token);
-                    this.currentUserSubject.next(response.username);
-                    this.tokenSubject.next(response.token);
-                    return response;
-                })
-            );
+            .pipe(map(response => this.storeState(response)));
+    }
+
+    // Refresh tokens are single use, so concurrent callers share one request.
+    public refresh(): Observable<AuthResponse> {
+        if (!this.refreshInFlight) {
+            const refreshToken = localStorage.getItem('refreshToken');
+            this.refreshInFlight = this.http.post<AuthResponse>(`${this.API_URL}/auth/refresh`, { refresh_token: refreshToken })
+                .pipe(
+                    map(response => this.storeState(response)),
+                    finalize(() => this.refreshInFlight = null),
+                    shareReplay(1)
+                );
+        }
+        return this.refreshInFlight;
     }
 
     public logout(): Observable<void> {
         return this.http.post<void>(`${this.API_URL}/auth/logout`, null)
-            .pipe(
-                map(() => {
-                    localStorage.removeItem('currentUser');
-                    localStorage.removeItem('token');
-                    this.currentUserSubject.next(null);
-                    this.tokenSubject.next(null);
-                })
-            );
+            .pipe(map(() => this.clearState()));
+    }
+
+    private storeState(response: AuthResponse): AuthResponse {
+        localStorage.setItem('currentUser', response.username);
+        localStorage.setItem('token', response.token);
+        localStorage.setItem('refreshToken', response.refresh_token);
+        this.currentUserSubject.next(response.username);
+        this.tokenSubject.next(response.token);
+        return response;
     }
-}
\ No newline at end of file
+}
@@ -46,6 +46,14 @@ export class WebsocketService {
                     case 'leave':
                         // Handle join/leave notifications if needed
                         break;
+
+                    case 'token_expiring':
+                        this.reauthenticate();
+                        break;
+
+                    case 'auth_error':
+                        console.error('Re-authentication failed:', wsMessage.payload.error);
+                        break;
                 }
             } catch (e) {
                 console.error('Error parsing message:', e);
@@ -53,6 +61,17 @@ export class WebsocketService {
         };
     }
 
+    private reauthenticate(): void {
+        this.authService.refresh().subscribe({
+            next: (response) => {
+                if (this.socket?.readyState === WebSocket.OPEN) {
+                    this.socket.send(JSON.stringify({ type: 'auth', payload: { token: response.token } }));
+                }
+            },
+            error: (error) => console.error('Failed to refresh token:', error)
+        });
+    }
+
     public disconnect(): void {
         if (this.socket) {
             this.socket.close();